@@ -2,13 +2,14 @@ package aws
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/apigateway"
+	"github.com/aws/aws-sdk-go-v2/service/apigateway/types"
 	"github.com/sirupsen/logrus"
 )
 
-var awsClient *apigateway.Client
-
 // credentialProvider /* Credential provider */
 type credentialProvider struct {
 	accessKeyId, secretAccessKey, sessionToken string
@@ -28,44 +29,173 @@ func (cp *credentialProvider) Retrieve(ctx context.Context) (aws.Credentials, er
 	}, nil
 }
 
-func InitAwsClient(AccessKeyId, SecretAccessKey, sessionToken, AWSRegion string) *apigateway.Client {
+func InitAwsClient(AccessKeyId, SecretAccessKey, sessionToken, AWSRegion string) KeyGateway {
 	credProvider := &credentialProvider{}
 	//TBD: Credential provider need to change based on discussion
 	credProvider.setCredentials(AccessKeyId, SecretAccessKey, sessionToken)
 	conf := aws.Config{Credentials: credProvider, Region: AWSRegion, RetryMaxAttempts: 10, RetryMode: aws.RetryModeStandard}
 	//AWS client for APIGateway related functions
-	awsClient = apigateway.NewFromConfig(conf)
-	return awsClient
+	return NewApiGateway(apigateway.NewFromConfig(conf))
+}
+
+// apiGateway is the KeyGateway backed by the real API Gateway control plane
+type apiGateway struct {
+	client *apigateway.Client
+}
+
+func NewApiGateway(client *apigateway.Client) KeyGateway {
+	return &apiGateway{client: client}
 }
 
-func CreateApiKey(ctx context.Context, name, subscriptionId, prdExtId, email string) (string, string, error) {
-	tags := map[string]string{"operation": "perf_testing", "maintainer": email}
-	apiKeyOut, err := awsClient.CreateApiKey(ctx, &apigateway.CreateApiKeyInput{
-		Description: aws.String(name),
+func (g *apiGateway) CreateKey(ctx context.Context, name, description string, tags map[string]string) (ApiKey, error) {
+	out, err := g.client.CreateApiKey(ctx, &apigateway.CreateApiKeyInput{
+		Description: aws.String(description),
 		Enabled:     true,
-		Name:        aws.String(subscriptionId),
+		Name:        aws.String(name),
 		Tags:        tags,
 	})
 	if err != nil {
-		return "", "", err
+		return ApiKey{}, mapError(err)
 	}
+	return toApiKey(types.ApiKey{
+		Id:          out.Id,
+		Name:        out.Name,
+		Description: out.Description,
+		Value:       out.Value,
+		Enabled:     out.Enabled,
+		Tags:        out.Tags,
+		CreatedDate: out.CreatedDate,
+	}), nil
+}
 
-	_, err = awsClient.CreateUsagePlanKey(ctx, &apigateway.CreateUsagePlanKeyInput{
-		KeyId:       apiKeyOut.Id,
+func (g *apiGateway) AttachToUsagePlan(ctx context.Context, keyId, usagePlanId string) error {
+	_, err := g.client.CreateUsagePlanKey(ctx, &apigateway.CreateUsagePlanKeyInput{
+		KeyId:       aws.String(keyId),
 		KeyType:     aws.String("API_KEY"),
-		UsagePlanId: aws.String(prdExtId),
+		UsagePlanId: aws.String(usagePlanId),
+	})
+	return mapError(err)
+}
+
+func (g *apiGateway) DetachFromUsagePlan(ctx context.Context, keyId, usagePlanId string) error {
+	_, err := g.client.DeleteUsagePlanKey(ctx, &apigateway.DeleteUsagePlanKeyInput{
+		KeyId:       aws.String(keyId),
+		UsagePlanId: aws.String(usagePlanId),
 	})
+	return mapError(err)
+}
+
+func (g *apiGateway) DeleteKey(ctx context.Context, keyId string) error {
+	_, err := g.client.DeleteApiKey(ctx, &apigateway.DeleteApiKeyInput{ApiKey: aws.String(keyId)})
+	return mapError(err)
+}
 
+func (g *apiGateway) GetKey(ctx context.Context, keyId string) (ApiKey, error) {
+	out, err := g.client.GetApiKey(ctx, &apigateway.GetApiKeyInput{ApiKey: aws.String(keyId), IncludeValue: aws.Bool(true)})
 	if err != nil {
-		return "", "", err
+		return ApiKey{}, mapError(err)
+	}
+	return toApiKey(types.ApiKey{
+		Id:          out.Id,
+		Name:        out.Name,
+		Description: out.Description,
+		Value:       out.Value,
+		Enabled:     out.Enabled,
+		Tags:        out.Tags,
+		CreatedDate: out.CreatedDate,
+	}), nil
+}
+
+func (g *apiGateway) InUsagePlan(ctx context.Context, keyId, usagePlanId string) (bool, error) {
+	_, err := g.client.GetUsagePlanKey(ctx, &apigateway.GetUsagePlanKeyInput{
+		KeyId:       aws.String(keyId),
+		UsagePlanId: aws.String(usagePlanId),
+	})
+	if err = mapError(err); errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (g *apiGateway) ListKeysByTag(ctx context.Context, tagKey, tagValue string) ([]ApiKey, error) {
+	keys := make([]ApiKey, 0)
+	paginator := apigateway.NewGetApiKeysPaginator(g.client, &apigateway.GetApiKeysInput{Limit: aws.Int32(500)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, mapError(err)
+		}
+		for _, item := range page.Items {
+			if v, ok := item.Tags[tagKey]; !ok || v != tagValue {
+				continue
+			}
+			keys = append(keys, toApiKey(item))
+		}
+	}
+	return keys, nil
+}
+
+func toApiKey(item types.ApiKey) ApiKey {
+	key := ApiKey{
+		Id:          aws.ToString(item.Id),
+		Name:        aws.ToString(item.Name),
+		Description: aws.ToString(item.Description),
+		Value:       aws.ToString(item.Value),
+		Enabled:     item.Enabled,
+		Tags:        item.Tags,
+	}
+	if item.CreatedDate != nil {
+		key.CreatedDate = *item.CreatedDate
 	}
+	return key
+}
 
-	return *apiKeyOut.Id, *apiKeyOut.Value, nil
+// mapError wraps API Gateway exceptions into the package level errors so callers do not depend on the sdk types
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var notFound *types.NotFoundException
+	if errors.As(err, &notFound) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	var conflict *types.ConflictException
+	if errors.As(err, &conflict) {
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	}
+	var tooMany *types.TooManyRequestsException
+	var limitExceeded *types.LimitExceededException
+	if errors.As(err, &tooMany) || errors.As(err, &limitExceeded) {
+		return fmt.Errorf("%w: %v", ErrThrottled, err)
+	}
+	return err
 }
 
-func CleanupApiKeys(ctx context.Context, id string) error {
-	_, err := awsClient.DeleteApiKey(ctx, &apigateway.DeleteApiKeyInput{ApiKey: aws.String(id)})
+func CreateApiKey(ctx context.Context, gw KeyGateway, name, subscriptionId, prdExtId string, tags map[string]string) (string, string, error) {
+	apiKey, err := gw.CreateKey(ctx, subscriptionId, name, tags)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = gw.AttachToUsagePlan(ctx, apiKey.Id, prdExtId)
 	if err != nil {
+		// do not leave a key that is not in any usage plan behind
+		if delErr := gw.DeleteKey(context.WithoutCancel(ctx), apiKey.Id); delErr != nil {
+			logrus.Errorf("Error in deleting api key %s after failed usage plan attach %v", apiKey.Id, delErr)
+		}
+		return "", "", err
+	}
+
+	return apiKey.Id, apiKey.Value, nil
+}
+
+func CleanupApiKeys(ctx context.Context, gw KeyGateway, id string) error {
+	err := gw.DeleteKey(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		logrus.Infof("Api key %s is already deleted", id)
+	} else if err != nil {
 		logrus.Errorf("Error in delete key from aws %s", id)
 	} else {
 		logrus.Infof("Deleted api key %s", id)
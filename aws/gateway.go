@@ -0,0 +1,53 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Tags set on every key the tool creates
+const (
+	TagOperation         = "operation"
+	TagMaintainer        = "maintainer"
+	TagRunId             = "run_id"
+	OperationPerfTesting = "perf_testing"
+)
+
+// KeyTags are the tags of a key created by run runId for maintainer
+func KeyTags(maintainer, runId string) map[string]string {
+	tags := map[string]string{TagOperation: OperationPerfTesting, TagMaintainer: maintainer}
+	if runId != "" {
+		tags[TagRunId] = runId
+	}
+	return tags
+}
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("conflict")
+	//ErrThrottled is returned when API Gateway still rejects a call for its rate limit after the sdk retries
+	ErrThrottled = errors.New("throttled")
+)
+
+// KeyGateway is the set of API Gateway operations the tool needs to manage api keys
+type KeyGateway interface {
+	CreateKey(ctx context.Context, name, description string, tags map[string]string) (ApiKey, error)
+	AttachToUsagePlan(ctx context.Context, keyId, usagePlanId string) error
+	DetachFromUsagePlan(ctx context.Context, keyId, usagePlanId string) error
+	DeleteKey(ctx context.Context, keyId string) error
+	GetKey(ctx context.Context, keyId string) (ApiKey, error)
+	//InUsagePlan tells whether the key is attached to the usage plan
+	InUsagePlan(ctx context.Context, keyId, usagePlanId string) (bool, error)
+	ListKeysByTag(ctx context.Context, tagKey, tagValue string) ([]ApiKey, error)
+}
+
+type ApiKey struct {
+	Id          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Value       string            `json:"value"`
+	Enabled     bool              `json:"enabled"`
+	Tags        map[string]string `json:"tags"`
+	CreatedDate time.Time         `json:"created_date"`
+}
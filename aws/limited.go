@@ -0,0 +1,61 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"github.com/apikey-gen/throttle"
+)
+
+// limitedGateway rate limits the write calls of a KeyGateway, reads are passed through
+type limitedGateway struct {
+	KeyGateway
+	create, attach, delete *throttle.Limiter
+}
+
+// NewLimitedGateway waits on create before CreateKey, attach before AttachToUsagePlan and DetachFromUsagePlan and
+// delete before DeleteKey. Throttling errors of gw are counted on the limiter of the call.
+func NewLimitedGateway(gw KeyGateway, create, attach, delete *throttle.Limiter) KeyGateway {
+	return &limitedGateway{KeyGateway: gw, create: create, attach: attach, delete: delete}
+}
+
+func (g *limitedGateway) CreateKey(ctx context.Context, name, description string, tags map[string]string) (ApiKey, error) {
+	if err := g.create.Wait(ctx); err != nil {
+		return ApiKey{}, err
+	}
+	key, err := g.KeyGateway.CreateKey(ctx, name, description, tags)
+	countThrottled(g.create, err)
+	return key, err
+}
+
+func (g *limitedGateway) AttachToUsagePlan(ctx context.Context, keyId, usagePlanId string) error {
+	if err := g.attach.Wait(ctx); err != nil {
+		return err
+	}
+	err := g.KeyGateway.AttachToUsagePlan(ctx, keyId, usagePlanId)
+	countThrottled(g.attach, err)
+	return err
+}
+
+func (g *limitedGateway) DetachFromUsagePlan(ctx context.Context, keyId, usagePlanId string) error {
+	if err := g.attach.Wait(ctx); err != nil {
+		return err
+	}
+	err := g.KeyGateway.DetachFromUsagePlan(ctx, keyId, usagePlanId)
+	countThrottled(g.attach, err)
+	return err
+}
+
+func (g *limitedGateway) DeleteKey(ctx context.Context, keyId string) error {
+	if err := g.delete.Wait(ctx); err != nil {
+		return err
+	}
+	err := g.KeyGateway.DeleteKey(ctx, keyId)
+	countThrottled(g.delete, err)
+	return err
+}
+
+func countThrottled(l *throttle.Limiter, err error) {
+	if errors.Is(err, ErrThrottled) {
+		l.Throttled()
+	}
+}
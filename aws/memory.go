@@ -0,0 +1,233 @@
+package aws
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	memoryKeyIdLength    = 10
+	memoryKeyValueLength = 40
+)
+
+var memoryRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+
+// MemoryGateway is an in-memory KeyGateway that mimics API Gateway behaviour for local and CI runs
+type MemoryGateway struct {
+	mu         sync.Mutex
+	Keys       map[string]ApiKey          `json:"keys"`
+	UsagePlans map[string]map[string]bool `json:"usage_plans"`
+}
+
+func NewMemoryGateway(usagePlanIds ...string) *MemoryGateway {
+	g := &MemoryGateway{
+		Keys:       map[string]ApiKey{},
+		UsagePlans: map[string]map[string]bool{},
+	}
+	for _, id := range usagePlanIds {
+		g.AddUsagePlan(id)
+	}
+	return g
+}
+
+// LoadMemoryGateway restores a gateway saved with SaveFile, a missing file gives an empty gateway
+func LoadMemoryGateway(fileName string, usagePlanIds ...string) (*MemoryGateway, error) {
+	g := NewMemoryGateway()
+	byt, err := os.ReadFile(fileName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(byt, g); err != nil {
+			return nil, fmt.Errorf("error in reading gateway state %s, %v", fileName, err)
+		}
+	}
+	for _, id := range usagePlanIds {
+		g.AddUsagePlan(id)
+	}
+	return g, nil
+}
+
+func (g *MemoryGateway) SaveFile(fileName string) error {
+	g.mu.Lock()
+	byt, err := json.MarshalIndent(g, "", "  ")
+	g.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, byt, 0600)
+}
+
+func (g *MemoryGateway) AddUsagePlan(usagePlanId string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.UsagePlans[usagePlanId]; !ok {
+		g.UsagePlans[usagePlanId] = map[string]bool{}
+	}
+}
+
+// UsagePlanKeys returns the key ids attached to the usage plan
+func (g *MemoryGateway) UsagePlanKeys(usagePlanId string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	plan, ok := g.UsagePlans[usagePlanId]
+	if !ok {
+		return nil, fmt.Errorf("%w: usage plan %s", ErrNotFound, usagePlanId)
+	}
+	ids := make([]string, 0, len(plan))
+	for id := range plan {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (g *MemoryGateway) CreateKey(ctx context.Context, name, description string, tags map[string]string) (ApiKey, error) {
+	if err := ctx.Err(); err != nil {
+		return ApiKey{}, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := randomString(memoryKeyIdLength)
+	for _, ok := g.Keys[id]; ok; _, ok = g.Keys[id] {
+		id = randomString(memoryKeyIdLength)
+	}
+	t := make(map[string]string, len(tags))
+	for k, v := range tags {
+		t[k] = v
+	}
+	key := ApiKey{
+		Id:          id,
+		Name:        name,
+		Description: description,
+		Value:       randomString(memoryKeyValueLength),
+		Enabled:     true,
+		Tags:        t,
+		CreatedDate: time.Now().UTC(),
+	}
+	g.Keys[id] = key
+	return key, nil
+}
+
+func (g *MemoryGateway) AttachToUsagePlan(ctx context.Context, keyId, usagePlanId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	plan, ok := g.UsagePlans[usagePlanId]
+	if !ok {
+		return fmt.Errorf("%w: invalid usage plan identifier specified %s", ErrNotFound, usagePlanId)
+	}
+	if _, ok := g.Keys[keyId]; !ok {
+		return fmt.Errorf("%w: invalid api key identifier specified %s", ErrNotFound, keyId)
+	}
+	if plan[keyId] {
+		return fmt.Errorf("%w: usage plan %s already contains key %s", ErrConflict, usagePlanId, keyId)
+	}
+	plan[keyId] = true
+	return nil
+}
+
+func (g *MemoryGateway) DetachFromUsagePlan(ctx context.Context, keyId, usagePlanId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	plan, ok := g.UsagePlans[usagePlanId]
+	if !ok {
+		return fmt.Errorf("%w: invalid usage plan identifier specified %s", ErrNotFound, usagePlanId)
+	}
+	if !plan[keyId] {
+		return fmt.Errorf("%w: usage plan %s does not contain key %s", ErrNotFound, usagePlanId, keyId)
+	}
+	delete(plan, keyId)
+	return nil
+}
+
+func (g *MemoryGateway) DeleteKey(ctx context.Context, keyId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.Keys[keyId]; !ok {
+		return fmt.Errorf("%w: invalid api key identifier specified %s", ErrNotFound, keyId)
+	}
+	delete(g.Keys, keyId)
+	for _, plan := range g.UsagePlans {
+		delete(plan, keyId)
+	}
+	return nil
+}
+
+func (g *MemoryGateway) GetKey(ctx context.Context, keyId string) (ApiKey, error) {
+	if err := ctx.Err(); err != nil {
+		return ApiKey{}, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key, ok := g.Keys[keyId]
+	if !ok {
+		return ApiKey{}, fmt.Errorf("%w: invalid api key identifier specified %s", ErrNotFound, keyId)
+	}
+	return key, nil
+}
+
+// InUsagePlan answers false for an unknown usage plan or key, API Gateway does not tell them apart from a key
+// that is not attached
+func (g *MemoryGateway) InUsagePlan(ctx context.Context, keyId, usagePlanId string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.UsagePlans[usagePlanId][keyId], nil
+}
+
+func (g *MemoryGateway) ListKeysByTag(ctx context.Context, tagKey, tagValue string) ([]ApiKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	keys := make([]ApiKey, 0)
+	for _, key := range g.Keys {
+		if v, ok := key.Tags[tagKey]; ok && v == tagValue {
+			// list calls on API Gateway do not return key values
+			key.Value = ""
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Id < keys[j].Id })
+	return keys, nil
+}
+
+func randomString(n int) string {
+	b := make([]rune, n)
+	max := big.NewInt(int64(len(memoryRunes)))
+	for i := range b {
+		r, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = memoryRunes[r.Int64()]
+	}
+	return string(b)
+}
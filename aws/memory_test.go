@@ -0,0 +1,96 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemoryGatewayInUsagePlan(t *testing.T) {
+	ctx := context.Background()
+	g := NewMemoryGateway("plan-a", "plan-b")
+	attached, err := g.CreateKey(ctx, "attached", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AttachToUsagePlan(ctx, attached.Id, "plan-a"); err != nil {
+		t.Fatal(err)
+	}
+	detached, err := g.CreateKey(ctx, "detached", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// API Gateway answers NotFound for a missing binding, key or plan alike, which InUsagePlan maps to false
+	tests := []struct {
+		name        string
+		keyId, plan string
+		want        bool
+	}{
+		{name: "attached", keyId: attached.Id, plan: "plan-a", want: true},
+		{name: "other plan", keyId: attached.Id, plan: "plan-b"},
+		{name: "not attached", keyId: detached.Id, plan: "plan-a"},
+		{name: "unknown key", keyId: "missing", plan: "plan-a"},
+		{name: "unknown plan", keyId: attached.Id, plan: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := g.InUsagePlan(ctx, tt.keyId, tt.plan)
+			if err != nil || got != tt.want {
+				t.Errorf("got %v, %v, want %v, nil", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryGatewayKeyLifecycle(t *testing.T) {
+	ctx := context.Background()
+	g := NewMemoryGateway("plan-a")
+	key, err := g.CreateKey(ctx, "name", "description", KeyTags("perf@example.com", "run-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AttachToUsagePlan(ctx, key.Id, "plan-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.AttachToUsagePlan(ctx, key.Id, "plan-a"); !errors.Is(err, ErrConflict) {
+		t.Errorf("attaching twice: got %v, want %v", err, ErrConflict)
+	}
+	if err := g.AttachToUsagePlan(ctx, key.Id, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("attaching to an unknown plan: got %v, want %v", err, ErrNotFound)
+	}
+
+	got, err := g.GetKey(ctx, key.Id)
+	if err != nil || got.Value != key.Value || !got.Enabled {
+		t.Errorf("got %+v, %v, want the created key", got, err)
+	}
+	listed, err := g.ListKeysByTag(ctx, TagRunId, "run-1")
+	if err != nil || len(listed) != 1 || listed[0].Id != key.Id {
+		t.Fatalf("got %+v, %v, want the created key", listed, err)
+	}
+	if listed[0].Value != "" {
+		t.Errorf("listed key has its value, API Gateway lists keys without them")
+	}
+
+	if err := g.DeleteKey(ctx, key.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.DeleteKey(ctx, key.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting twice: got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := g.GetKey(ctx, key.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("getting a deleted key: got %v, want %v", err, ErrNotFound)
+	}
+	if ids, err := g.UsagePlanKeys("plan-a"); err != nil || len(ids) != 0 {
+		t.Errorf("got usage plan keys %v, %v, want the deleted key detached", ids, err)
+	}
+}
+
+func TestMemoryGatewayCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g := NewMemoryGateway("plan-a")
+	if _, err := g.CreateKey(ctx, "name", "", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,120 @@
+package crypt
+
+import (
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Ext is appended to the name of an encrypted file
+const Ext = ".age"
+
+// Options select how files holding api keys are encrypted, either for age recipients or with a passphrase. The
+// zero value does not encrypt.
+type Options struct {
+	//Recipients are age public keys, age1...
+	Recipients []string
+	Passphrase string
+}
+
+func (o Options) Enabled() bool {
+	return len(o.Recipients) > 0 || o.Passphrase != ""
+}
+
+// Validate checks the recipients, age can not mix a passphrase with recipients
+func (o Options) Validate() error {
+	if len(o.Recipients) > 0 && o.Passphrase != "" {
+		return errors.New("set either recipients or a passphrase, not both")
+	}
+	_, err := o.recipients()
+	return err
+}
+
+func (o Options) recipients() ([]age.Recipient, error) {
+	if o.Passphrase != "" {
+		r, err := age.NewScryptRecipient(o.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	}
+	recipients := make([]age.Recipient, 0, len(o.Recipients))
+	for _, s := range o.Recipients {
+		r, err := age.ParseX25519Recipient(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q, %v", s, err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, nil
+}
+
+// WriteFile writes data with owner only permissions, encrypted to fileName+Ext when o is enabled, and returns the
+// name of the file written
+func WriteFile(fileName string, data []byte, o Options) (string, error) {
+	if o.Enabled() {
+		recipients, err := o.recipients()
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, recipients...)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write(data); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		fileName, data = fileName+Ext, buf.Bytes()
+	}
+
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	// an existing file keeps its mode with O_CREATE
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	return fileName, f.Close()
+}
+
+// Decrypt opens a file encrypted by WriteFile with the identities in identityFiles or with passphrase
+func Decrypt(r io.Reader, identityFiles []string, passphrase string) (io.Reader, error) {
+	identities := make([]age.Identity, 0)
+	for _, fileName := range identityFiles {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error in reading identities %s, %v", fileName, err)
+		}
+		identities = append(identities, ids...)
+	}
+	if passphrase != "" {
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("no identity or passphrase to decrypt with")
+	}
+	return age.Decrypt(r, identities...)
+}
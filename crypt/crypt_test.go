@@ -0,0 +1,110 @@
+package crypt
+
+import (
+	"filippo.io/age"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	identityFile := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       Options
+		identities []string
+		passphrase string
+		encrypted  bool
+	}{
+		{name: "plain"},
+		{name: "recipient", opts: Options{Recipients: []string{" " + identity.Recipient().String()}}, identities: []string{identityFile}, encrypted: true},
+		{name: "passphrase", opts: Options{Passphrase: "secret"}, passphrase: "secret", encrypted: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(dir, tt.name+".csv")
+			want := fileName
+			if tt.encrypted {
+				want += Ext
+			}
+			// a file left by an earlier run keeps its mode unless it is changed
+			if err := os.WriteFile(want, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			written, err := WriteFile(fileName, []byte("key1,key2"), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != want {
+				t.Fatalf("got file %s, want %s", written, want)
+			}
+			info, err := os.Stat(written)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("got mode %v, want owner only", info.Mode().Perm())
+			}
+
+			f, err := os.Open(written)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			var r io.Reader = f
+			if tt.encrypted {
+				if r, err = Decrypt(f, tt.identities, tt.passphrase); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "key1,key2" {
+				t.Errorf("got %q, want the written data", data)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "disabled"},
+		{name: "recipient", opts: Options{Recipients: []string{identity.Recipient().String()}}},
+		{name: "passphrase", opts: Options{Passphrase: "secret"}},
+		{name: "both", opts: Options{Recipients: []string{identity.Recipient().String()}, Passphrase: "secret"}, wantErr: true},
+		{name: "invalid recipient", opts: Options{Recipients: []string{"ssh-rsa AAAA"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecryptWithoutIdentity(t *testing.T) {
+	if _, err := Decrypt(nil, nil, ""); err == nil {
+		t.Error("decrypted without an identity or passphrase")
+	}
+}
@@ -10,7 +10,8 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/schema"
-	"strings"
+	"sort"
+	"time"
 )
 
 func GetConnection(ctx context.Context, cfg model.DBConf) (db *gorm.DB, err error) {
@@ -81,104 +82,331 @@ func GetProductExtId(ctx context.Context, tx *gorm.DB, productId uuid.UUID) (str
 	return externalId, nil
 }
 
-func GetSubscriptionIds(ctx context.Context, tx *gorm.DB, tenantEmailDomain string, count int) ([]string, error) {
-	if strings.TrimSpace(tenantEmailDomain) == "" {
-		return nil, errors.New("tenantEmailDomain can not be empty")
-	}
-	extIds := make([]string, 0)
-	query := fmt.Sprintf("select external_id from subscription where tenant_id in (select id from tenant where email like '%s@%s')", "%", tenantEmailDomain)
-	if count > 0 {
-		query = fmt.Sprintf("select external_id from subscription where tenant_id in (select id from tenant where email like '%s@%s' order by id limit %d)", "%", tenantEmailDomain, count)
-	}
-	res := tx.Raw(query)
+func GetSubscriptionByVariableKey(ctx context.Context, tx *gorm.DB, variableKey string) (model.Subscription, error) {
+	var subscription model.Subscription
+	res := tx.Where("variable_key = ?", variableKey).Limit(1).Find(&subscription)
 	if res.Error != nil {
-		return nil, res.Error
+		return model.Subscription{}, res.Error
 	}
-	if rows, err := res.Rows(); err != nil {
-		return nil, err
-	} else {
-		for rows.Next() {
-			var extId string
-			err := rows.Scan(&extId)
-			if err != nil {
-				return nil, err
-			}
-			extIds = append(extIds, extId)
-		}
+	if res.RowsAffected == 0 {
+		return model.Subscription{}, errors.New("subscription not found")
 	}
-	return extIds, nil
+	return subscription, nil
 }
 
-func DeleteSubscriptions(ctx context.Context, tx *gorm.DB, tenantEmailDomain string, count int) error {
-	if strings.TrimSpace(tenantEmailDomain) == "" {
-		return errors.New("tenantEmailDomain can not be empty")
+func GetSubscriptionsByExternalIds(ctx context.Context, tx *gorm.DB, externalIds []string) ([]model.Subscription, error) {
+	subscriptions := make([]model.Subscription, 0)
+	if len(externalIds) == 0 {
+		return subscriptions, nil
 	}
+	return findByIds(externalIds, func(batch []string) ([]model.Subscription, error) {
+		var rows []model.Subscription
+		return rows, tx.Where("external_id in ?", batch).Find(&rows).Error
+	})
+}
 
-	query := fmt.Sprintf("delete from subscription where tenant_id in (select id from tenant where email like '%s@%s')", "%", tenantEmailDomain)
-	if count > 0 {
-		query = fmt.Sprintf("delete from subscription where tenant_id in (select id from tenant where email like '%s@%s' order by id limit %d)", "%", tenantEmailDomain, count)
+func UpdateSubscriptionStatus(ctx context.Context, tx *gorm.DB, subscriptionIds []uuid.UUID, status string) error {
+	if len(subscriptionIds) == 0 {
+		return nil
 	}
-
-	res := tx.Exec(query)
+	res := tx.Exec("update subscription set status = ?, updated_at = ? where id in ?", status, time.Now(), subscriptionIds)
 	if res.Error != nil {
-		logrus.Errorf("Error in deleting subscriptions %v", res.Error)
+		logrus.Errorf("Error in updating subscriptions %v", res.Error)
 		return res.Error
+	}
+	logrus.Infof("%d subscriptions set to %s", res.RowsAffected, status)
+	return nil
+}
+
+func DeleteSubscriptionPoliciesBySubscriptionIds(ctx context.Context, tx *gorm.DB, subscriptionIds []uuid.UUID) error {
+	if len(subscriptionIds) == 0 {
+		return nil
+	}
+	affected, err := execByIds(tx, "delete from subscription_policy where subscription_id in ?", subscriptionIds)
+	if err != nil {
+		logrus.Errorf("Error in deleting subscription policies %v", err)
+		return err
 	} else {
-		logrus.Infof("%d subscriptions deleted", res.RowsAffected)
+		logrus.Infof("%d subscription policies deleted", affected)
 	}
 	return nil
 }
 
-func DeletePolicies(ctx context.Context, tx *gorm.DB, tenantEmailDomain string, count int) error {
-	if strings.TrimSpace(tenantEmailDomain) == "" {
-		return errors.New("tenantEmailDomain can not be empty")
+func DeleteSubscriptionPoliciesByTenantIds(ctx context.Context, tx *gorm.DB, tenantIds []uuid.UUID) error {
+	if len(tenantIds) == 0 {
+		return nil
 	}
-	query := fmt.Sprintf("delete from policy where cast( tenant_id as uuid) in (select id from tenant where email like '%s@%s')", "%", tenantEmailDomain)
-	if count > 0 {
-		query = fmt.Sprintf("delete from policy where cast( tenant_id as uuid) in (select id from tenant where email like '%s@%s' order by id limit %d)", "%", tenantEmailDomain, count)
+	affected, err := execByIds(tx, "delete from subscription_policy where tenant_id in ?", tenantIds)
+	if err != nil {
+		logrus.Errorf("Error in deleting subscription policies of tenants %v", err)
+		return err
+	} else {
+		logrus.Infof("%d subscription policies of tenants deleted", affected)
 	}
-	res := tx.Exec(query)
-	if res.Error != nil {
-		logrus.Errorf("Error in deleting policies %v", res.Error)
-		return res.Error
+	return nil
+}
+
+// DeleteSubscriptionPoliciesByPolicyIds removes the rows that point to the policies, they would keep them from
+// being deleted
+func DeleteSubscriptionPoliciesByPolicyIds(ctx context.Context, tx *gorm.DB, policyIds []uuid.UUID) error {
+	if len(policyIds) == 0 {
+		return nil
+	}
+	affected, err := execByIds(tx, "delete from subscription_policy where policy_id in ?", policyIds)
+	if err != nil {
+		logrus.Errorf("Error in deleting subscription policies of policies %v", err)
+		return err
 	} else {
-		logrus.Infof("%d Policies deleted", res.RowsAffected)
+		logrus.Infof("%d subscription policies of policies deleted", affected)
 	}
 	return nil
 }
 
-func DeleteService(ctx context.Context, tx *gorm.DB, tenantEmailDomain string, count int) error {
-	if strings.TrimSpace(tenantEmailDomain) == "" {
-		return errors.New("tenantEmailDomain can not be empty")
+func DeleteSubscriptionsByIds(ctx context.Context, tx *gorm.DB, subscriptionIds []uuid.UUID) error {
+	if len(subscriptionIds) == 0 {
+		return nil
 	}
-	query := fmt.Sprintf("delete from service where tenant_id in (select id from tenant where email like '%s@%s')", "%", tenantEmailDomain)
-	if count > 0 {
-		query = fmt.Sprintf("delete from service where tenant_id in (select id from tenant where email like '%s@%s' order by id limit %d)", "%", tenantEmailDomain, count)
+	affected, err := execByIds(tx, "delete from subscription where id in ?", subscriptionIds)
+	if err != nil {
+		logrus.Errorf("Error in deleting subscriptions %v", err)
+		return err
+	} else {
+		logrus.Infof("%d subscriptions deleted", affected)
 	}
-	res := tx.Exec(query)
-	if res.Error != nil {
-		logrus.Errorf("Error in deleting Service %v", res.Error)
-		return res.Error
+	return nil
+}
+
+func DeletePoliciesByIds(ctx context.Context, tx *gorm.DB, policyIds []uuid.UUID) error {
+	if len(policyIds) == 0 {
+		return nil
+	}
+	affected, err := execByIds(tx, "delete from policy where id in ?", policyIds)
+	if err != nil {
+		logrus.Errorf("Error in deleting policies %v", err)
+		return err
 	} else {
-		logrus.Infof("%d Services deleted", res.RowsAffected)
+		logrus.Infof("%d Policies deleted", affected)
 	}
 	return nil
 }
 
-func DeleteTenants(ctx context.Context, tx *gorm.DB, tenantEmailDomain string, count int) error {
-	if strings.TrimSpace(tenantEmailDomain) == "" {
-		return errors.New("tenantEmailDomain can not be empty")
+func DeleteServicesByIds(ctx context.Context, tx *gorm.DB, serviceIds []uuid.UUID) error {
+	if len(serviceIds) == 0 {
+		return nil
 	}
-	query := fmt.Sprintf("delete from tenant where email like '%s@%s'", "%", tenantEmailDomain)
-	if count > 0 {
-		query = fmt.Sprintf("delete from tenant where id in (select id from tenant where email like '%s@%s' order by id limit %d)", "%", tenantEmailDomain, count)
+	affected, err := execByIds(tx, "delete from service where id in ?", serviceIds)
+	if err != nil {
+		logrus.Errorf("Error in deleting Service %v", err)
+		return err
+	} else {
+		logrus.Infof("%d Services deleted", affected)
 	}
-	res := tx.Exec(query)
-	if res.Error != nil {
-		logrus.Errorf("Error in deleting tenants %v", res.Error)
-		return res.Error
+	return nil
+}
+
+func DeleteTenantsByIds(ctx context.Context, tx *gorm.DB, tenantIds []uuid.UUID) error {
+	if len(tenantIds) == 0 {
+		return nil
+	}
+	affected, err := execByIds(tx, "delete from tenant where id in ?", tenantIds)
+	if err != nil {
+		logrus.Errorf("Error in deleting tenants %v", err)
+		return err
 	} else {
-		logrus.Infof("%d tenants deleted", res.RowsAffected)
+		logrus.Infof("%d tenants deleted", affected)
 	}
 	return nil
 }
+
+// idBatch is the most ids bound to one statement, postgres takes at most 65535 parameters
+const idBatch = 10000
+
+// execByIds runs a statement with a single "in ?" once per batch of ids and adds up the affected rows
+func execByIds(tx *gorm.DB, sql string, ids []uuid.UUID) (int64, error) {
+	var affected int64
+	for start := 0; start < len(ids); start += idBatch {
+		res := tx.Exec(sql, ids[start:min(start+idBatch, len(ids))])
+		if res.Error != nil {
+			return affected, res.Error
+		}
+		affected += res.RowsAffected
+	}
+	return affected, nil
+}
+
+func CountTenantRows(ctx context.Context, tx *gorm.DB, tenantIds []uuid.UUID) (map[string]int64, error) {
+	counts := map[string]int64{}
+	// policy.tenant_id is a string column
+	tables := []struct {
+		table, column string
+		strings       bool
+	}{
+		{"subscription_policy", "tenant_id", false},
+		{"subscription", "tenant_id", false},
+		{"policy", "tenant_id", true},
+		{"service", "tenant_id", false},
+		{"tenant", "id", false},
+	}
+	for start := 0; start < len(tenantIds); start += idBatch {
+		batch := tenantIds[start:min(start+idBatch, len(tenantIds))]
+		batchStrings := make([]string, 0, len(batch))
+		for _, id := range batch {
+			batchStrings = append(batchStrings, id.String())
+		}
+		for _, t := range tables {
+			var ids interface{} = batch
+			if t.strings {
+				ids = batchStrings
+			}
+			var n int64
+			if res := tx.Table(t.table).Where(t.column+" in ?", ids).Count(&n); res.Error != nil {
+				return nil, res.Error
+			}
+			if n > 0 {
+				counts[t.table] += n
+			}
+		}
+	}
+	return counts, nil
+}
+
+// findByIds runs a lookup with a single "in ?" once per batch of ids and joins the rows
+func findByIds[I, T any](ids []I, find func(batch []I) ([]T, error)) ([]T, error) {
+	all := make([]T, 0)
+	for start := 0; start < len(ids); start += idBatch {
+		rows, err := find(ids[start:min(start+idBatch, len(ids))])
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rows...)
+	}
+	return all, nil
+}
+
+func SelectTenantIds(ctx context.Context, tx *gorm.DB, sel TenantSelector) ([]uuid.UUID, error) {
+	if err := sel.validate(); err != nil {
+		return nil, err
+	}
+	ids := make([]uuid.UUID, 0)
+	if sel.TenantIds == nil {
+		if res := sel.where(tx.Table("tenant").Select("id")).Scan(&ids); res.Error != nil {
+			return nil, res.Error
+		}
+		return ids, nil
+	}
+	// each batch is ordered and limited, so the first ids of all batches hold the first ids overall
+	ids, err := findByIds(sel.TenantIds, func(batch []uuid.UUID) ([]uuid.UUID, error) {
+		batchSel := sel
+		batchSel.TenantIds = batch
+		var rows []uuid.UUID
+		return rows, batchSel.where(tx.Table("tenant").Select("id")).Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	// postgres orders uuids by their bytes, which is the order of their strings
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	if sel.Limit > 0 && len(ids) > sel.Limit {
+		ids = ids[:sel.Limit]
+	}
+	return ids, nil
+}
+
+func GetSubscriptionPolicyIds(ctx context.Context, tx *gorm.DB, subscriptionIds []uuid.UUID) (map[uuid.UUID][]uuid.UUID, error) {
+	policyIds := make(map[uuid.UUID][]uuid.UUID, len(subscriptionIds))
+	if len(subscriptionIds) == 0 {
+		return policyIds, nil
+	}
+	rows, err := findByIds(subscriptionIds, func(batch []uuid.UUID) ([]model.SubscriptionPolicy, error) {
+		var rows []model.SubscriptionPolicy
+		return rows, tx.Table("subscription_policy").Select("subscription_id, policy_id").Where("subscription_id in ? and deleted = ?", batch, false).Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		policyIds[row.SubscriptionId] = append(policyIds[row.SubscriptionId], row.PolicyId)
+	}
+	return policyIds, nil
+}
+
+func GetTenantResources(ctx context.Context, tx *gorm.DB, tenantIds []uuid.UUID) ([]model.TenantResources, error) {
+	resources := make([]model.TenantResources, 0, len(tenantIds))
+	if len(tenantIds) == 0 {
+		return resources, nil
+	}
+	byTenant := make(map[uuid.UUID]*model.TenantResources, len(tenantIds))
+	tenants, err := findByIds(tenantIds, func(batch []uuid.UUID) ([]model.Tenant, error) {
+		var rows []model.Tenant
+		return rows, tx.Table("tenant").Select("id, email").Where("id in ?", batch).Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID.String() < tenants[j].ID.String() })
+	for _, t := range tenants {
+		resources = append(resources, model.TenantResources{TenantId: t.ID, Email: t.Email})
+	}
+	for i := range resources {
+		byTenant[resources[i].TenantId] = &resources[i]
+	}
+
+	services, err := findByIds(tenantIds, func(batch []uuid.UUID) ([]model.Service, error) {
+		var rows []model.Service
+		return rows, tx.Table("service").Select("id, tenant_id").Where("tenant_id in ?", batch).Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range services {
+		if r, ok := byTenant[s.TenantId]; ok {
+			r.ServiceIds = append(r.ServiceIds, s.ID)
+		}
+	}
+
+	subscriptions, err := findByIds(tenantIds, func(batch []uuid.UUID) ([]model.Subscription, error) {
+		var rows []model.Subscription
+		return rows, tx.Unscoped().Where("tenant_id in ?", batch).Find(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range subscriptions {
+		if r, ok := byTenant[s.TenantId]; ok {
+			r.Subscriptions = append(r.Subscriptions, s)
+		}
+	}
+
+	tenantIdStrings := make([]string, 0, len(tenantIds))
+	for _, id := range tenantIds {
+		tenantIdStrings = append(tenantIdStrings, id.String())
+	}
+	policies, err := findByIds(tenantIdStrings, func(batch []string) ([]model.Policy, error) {
+		var rows []model.Policy
+		return rows, tx.Table("policy").Select("id, tenant_id").Where("tenant_id in ?", batch).Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		if tenantId, err := uuid.Parse(p.TenantId); err == nil {
+			if r, ok := byTenant[tenantId]; ok {
+				r.PolicyIds = append(r.PolicyIds, p.ID)
+			}
+		}
+	}
+
+	subscriptionPolicies, err := findByIds(tenantIds, func(batch []uuid.UUID) ([]model.SubscriptionPolicy, error) {
+		var rows []model.SubscriptionPolicy
+		return rows, tx.Table("subscription_policy").Select("tenant_id").Where("tenant_id in ?", batch).Scan(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, sp := range subscriptionPolicies {
+		if r, ok := byTenant[sp.TenantId]; ok {
+			r.SubscriptionPolicies++
+		}
+	}
+	return resources, nil
+}
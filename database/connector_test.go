@@ -0,0 +1,152 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingConnector is a database/sql driver that records the statements it gets and answers every query with
+// the uuids bound to it as the id column, as if every id asked for exists
+type recordingConnector struct {
+	mu         sync.Mutex
+	statements []recordedStatement
+}
+
+type recordedStatement struct {
+	query string
+	args  int
+}
+
+func (c *recordingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return recordingConn{c}, nil
+}
+func (c *recordingConnector) Driver() driver.Driver { return nil }
+
+func (c *recordingConnector) record(query string, args []driver.NamedValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = append(c.statements, recordedStatement{query: query, args: len(args)})
+}
+
+type recordingConn struct{ c *recordingConnector }
+
+func (rc recordingConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (rc recordingConn) Close() error                              { return nil }
+func (rc recordingConn) Begin() (driver.Tx, error)                 { return recordingTx{}, nil }
+
+func (rc recordingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rc.c.record(query, args)
+	rows := &idRows{}
+	for _, a := range args {
+		if s, ok := a.Value.(string); ok {
+			if _, err := uuid.Parse(s); err == nil {
+				rows.ids = append(rows.ids, s)
+			}
+		}
+	}
+	return rows, nil
+}
+
+func (rc recordingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rc.c.record(query, args)
+	return driver.RowsAffected(len(args)), nil
+}
+
+type recordingTx struct{}
+
+func (recordingTx) Commit() error   { return nil }
+func (recordingTx) Rollback() error { return nil }
+
+type idRows struct{ ids []string }
+
+func (r *idRows) Columns() []string { return []string{"id"} }
+func (r *idRows) Close() error      { return nil }
+func (r *idRows) Next(dest []driver.Value) error {
+	if len(r.ids) == 0 {
+		return io.EOF
+	}
+	dest[0], r.ids = r.ids[0], r.ids[1:]
+	return nil
+}
+
+func newRecordingDB(t *testing.T) (*gorm.DB, *recordingConnector) {
+	t.Helper()
+	c := &recordingConnector{}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(c)}), &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{SingularTable: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, c
+}
+
+func newIds(n int) []uuid.UUID {
+	ids := make([]uuid.UUID, n)
+	for i := range ids {
+		ids[i] = uuid.New()
+	}
+	return ids
+}
+
+func TestSelectTenantIdsBatchesTenantIds(t *testing.T) {
+	ids := newIds(2*idBatch + 5)
+	sorted := slices.Clone(ids)
+	slices.SortFunc(sorted, func(a, b uuid.UUID) int { return strings.Compare(a.String(), b.String()) })
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []uuid.UUID
+	}{
+		{name: "all", want: sorted},
+		{name: "limit", limit: 7, want: sorted[:7]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, c := newRecordingDB(t)
+			got, err := SelectTenantIds(context.Background(), db, TenantSelector{EmailDomain: "example.com", TenantIds: ids, Limit: tt.limit})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %d ids, want the %d first by id", len(got), len(tt.want))
+			}
+			if len(c.statements) != 3 {
+				t.Fatalf("got %d statements, want 3 batches", len(c.statements))
+			}
+			for _, s := range c.statements {
+				// the ids of the batch, the email pattern and the limit
+				if s.args > idBatch+2 {
+					t.Errorf("got %d parameters in %q, want at most %d", s.args, s.query[:40], idBatch+2)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectTenantIdsWithoutTenantIds(t *testing.T) {
+	db, c := newRecordingDB(t)
+	if _, err := SelectTenantIds(context.Background(), db, TenantSelector{EmailDomain: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.statements) != 1 || strings.Contains(c.statements[0].query, " IN ") {
+		t.Errorf("got %v, want one query by email domain", c.statements)
+	}
+
+	db, c = newRecordingDB(t)
+	got, err := SelectTenantIds(context.Background(), db, TenantSelector{EmailDomain: "example.com", TenantIds: []uuid.UUID{}})
+	if err != nil || len(got) != 0 || len(c.statements) != 0 {
+		t.Errorf("got %v, %v and %d statements for no tenant ids, want no query", got, err, len(c.statements))
+	}
+}
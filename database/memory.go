@@ -0,0 +1,672 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errTxDone = errors.New("transaction has already been committed or rolled back")
+
+// memoryTables holds one map per table the tool reads or writes
+type memoryTables struct {
+	Tenant             map[uuid.UUID]model.Tenant
+	Service            map[uuid.UUID]model.Service
+	Subscription       map[uuid.UUID]model.Subscription
+	SubscriptionPolicy []model.SubscriptionPolicy
+	Policy             map[uuid.UUID]model.Policy
+	Product            map[uuid.UUID]model.Product
+	Source             map[uuid.UUID]model.Source
+}
+
+func newMemoryTables() *memoryTables {
+	return &memoryTables{
+		Tenant:       map[uuid.UUID]model.Tenant{},
+		Service:      map[uuid.UUID]model.Service{},
+		Subscription: map[uuid.UUID]model.Subscription{},
+		Policy:       map[uuid.UUID]model.Policy{},
+		Product:      map[uuid.UUID]model.Product{},
+		Source:       map[uuid.UUID]model.Source{},
+	}
+}
+
+// memoryTable names one table of memoryTables, a set of them is or'ed together
+type memoryTable int
+
+const (
+	tenantTable memoryTable = 1 << iota
+	serviceTable
+	subscriptionTable
+	subscriptionPolicyTable
+	policyTable
+	productTable
+	sourceTable
+)
+
+// cloneTables returns the tables with the ones in set copied, the others are shared with t
+func (t *memoryTables) cloneTables(set memoryTable) *memoryTables {
+	c := *t
+	if set&tenantTable != 0 {
+		c.Tenant = maps.Clone(t.Tenant)
+	}
+	if set&serviceTable != 0 {
+		c.Service = maps.Clone(t.Service)
+	}
+	if set&subscriptionTable != 0 {
+		c.Subscription = maps.Clone(t.Subscription)
+	}
+	if set&subscriptionPolicyTable != 0 {
+		c.SubscriptionPolicy = slices.Clone(t.SubscriptionPolicy)
+	}
+	if set&policyTable != 0 {
+		c.Policy = maps.Clone(t.Policy)
+	}
+	if set&productTable != 0 {
+		c.Product = maps.Clone(t.Product)
+	}
+	if set&sourceTable != 0 {
+		c.Source = maps.Clone(t.Source)
+	}
+	return &c
+}
+
+// overlay returns t with the tables in set taken from own
+func (t *memoryTables) overlay(own *memoryTables, set memoryTable) *memoryTables {
+	c := *t
+	if set&tenantTable != 0 {
+		c.Tenant = own.Tenant
+	}
+	if set&serviceTable != 0 {
+		c.Service = own.Service
+	}
+	if set&subscriptionTable != 0 {
+		c.Subscription = own.Subscription
+	}
+	if set&subscriptionPolicyTable != 0 {
+		c.SubscriptionPolicy = own.SubscriptionPolicy
+	}
+	if set&policyTable != 0 {
+		c.Policy = own.Policy
+	}
+	if set&productTable != 0 {
+		c.Product = own.Product
+	}
+	if set&sourceTable != 0 {
+		c.Source = own.Source
+	}
+	return &c
+}
+
+type memoryOp func(t *memoryTables) error
+
+// memoryWrite is an op of a transaction with the table it writes
+type memoryWrite struct {
+	table memoryTable
+	op    memoryOp
+}
+
+// MemoryStore is a Store kept in maps, used for offline runs. Foreign keys to source, tenant, service and product
+// are checked on insert and delete like the postgres schema does, policy rows are not since they are owned by the
+// policy service.
+type MemoryStore struct {
+	mu     sync.Mutex
+	tables *memoryTables
+	parent *MemoryStore
+	// tables a transaction has written, it holds its own copy of them in tables and reads the others from parent
+	copied memoryTable
+	ops    []memoryWrite
+	done   bool
+	//ctx of Begin, a transaction is not committed once it is cancelled like with database/sql
+	ctx context.Context
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tables: newMemoryTables()}
+}
+
+// LoadMemoryStore restores a store saved with SaveFile, a missing file gives an empty store
+func LoadMemoryStore(fileName string) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	byt, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(byt)).Decode(s.tables); err != nil {
+		return nil, fmt.Errorf("error in reading database state %s, %v", fileName, err)
+	}
+	return s, nil
+}
+
+// SaveFile writes the tables with gob rather than json, the models hide some columns from json
+func (s *MemoryStore) SaveFile(fileName string) error {
+	var buf bytes.Buffer
+	s.mu.Lock()
+	err := gob.NewEncoder(&buf).Encode(s.tables)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, buf.Bytes(), 0600)
+}
+
+func (s *MemoryStore) AddSource(source model.Source) error {
+	return s.write(sourceTable, func(t *memoryTables) error {
+		t.Source[source.ID] = source
+		return nil
+	})
+}
+
+func (s *MemoryStore) AddProduct(product model.Product) error {
+	return s.write(productTable, func(t *memoryTables) error {
+		t.Product[product.ID] = product
+		return nil
+	})
+}
+
+func (s *MemoryStore) AddPolicy(policy model.Policy) error {
+	return s.write(policyTable, func(t *memoryTables) error {
+		if _, ok := t.Policy[policy.ID]; ok {
+			return fmt.Errorf("duplicate key value violates unique constraint \"policy_pkey\" %s", policy.ID)
+		}
+		t.Policy[policy.ID] = policy
+		return nil
+	})
+}
+
+func (s *MemoryStore) write(table memoryTable, op memoryOp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return errTxDone
+	}
+	if s.parent == nil {
+		return op(s.tables)
+	}
+
+	s.parent.mu.Lock()
+	defer s.parent.mu.Unlock()
+	if s.copied&table == 0 {
+		s.tables = s.tables.overlay(s.parent.tables.cloneTables(table), table)
+		s.copied |= table
+	}
+	view := s.parent.tables.overlay(s.tables, s.copied)
+	if err := op(view); err != nil {
+		return err
+	}
+	// the op may have replaced a slice, keep what it left in the view
+	s.tables = s.tables.overlay(view, table)
+	s.ops = append(s.ops, memoryWrite{table: table, op: op})
+	return nil
+}
+
+func (s *MemoryStore) read(fn func(t *memoryTables) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return errTxDone
+	}
+	if s.parent == nil {
+		return fn(s.tables)
+	}
+	s.parent.mu.Lock()
+	defer s.parent.mu.Unlock()
+	return fn(s.parent.tables.overlay(s.tables, s.copied))
+}
+
+func (s *MemoryStore) GetTenantSourceId(ctx context.Context, sourceName string) (uuid.UUID, error) {
+	var sUid uuid.UUID
+	err := s.read(func(t *memoryTables) error {
+		for id, source := range t.Source {
+			if source.Name == sourceName {
+				sUid = id
+				return nil
+			}
+		}
+		return errors.New("no uuid")
+	})
+	return sUid, err
+}
+
+func (s *MemoryStore) GetProductExtId(ctx context.Context, productId uuid.UUID) (string, error) {
+	var externalId string
+	err := s.read(func(t *memoryTables) error {
+		externalId = t.Product[productId].ExternalId
+		return nil
+	})
+	return externalId, err
+}
+
+func (s *MemoryStore) GetSubscriptionByVariableKey(ctx context.Context, variableKey string) (model.Subscription, error) {
+	var subscription model.Subscription
+	err := s.read(func(t *memoryTables) error {
+		for _, sub := range t.Subscription {
+			if sub.VariableKey == variableKey {
+				subscription = sub
+				return nil
+			}
+		}
+		return errors.New("subscription not found")
+	})
+	return subscription, err
+}
+
+func (s *MemoryStore) GetSubscriptionsByExternalIds(ctx context.Context, externalIds []string) ([]model.Subscription, error) {
+	subscriptions := make([]model.Subscription, 0)
+	err := s.read(func(t *memoryTables) error {
+		wanted := make(map[string]bool, len(externalIds))
+		for _, id := range externalIds {
+			wanted[id] = true
+		}
+		for _, sub := range t.Subscription {
+			if wanted[sub.ExternalId] {
+				subscriptions = append(subscriptions, sub)
+			}
+		}
+		return nil
+	})
+	return subscriptions, err
+}
+
+func (s *MemoryStore) MakeTenantEntry(ctx context.Context, tenant *model.Tenant) error {
+	row := *tenant
+	return s.write(tenantTable, func(t *memoryTables) error {
+		if _, ok := t.Tenant[row.ID]; ok {
+			return fmt.Errorf("duplicate key value violates unique constraint \"tenant_pkey\" %s", row.ID)
+		}
+		if _, ok := t.Source[row.SourceId]; !ok {
+			return fmt.Errorf("insert on tenant violates foreign key constraint, source %s not found", row.SourceId)
+		}
+		t.Tenant[row.ID] = row
+		return nil
+	})
+}
+
+func (s *MemoryStore) MakeServiceEntry(ctx context.Context, service *model.Service) error {
+	row := *service
+	return s.write(serviceTable, func(t *memoryTables) error {
+		if _, ok := t.Service[row.ID]; ok {
+			return fmt.Errorf("duplicate key value violates unique constraint \"service_pkey\" %s", row.ID)
+		}
+		if _, ok := t.Tenant[row.TenantId]; !ok {
+			return fmt.Errorf("insert on service violates foreign key constraint, tenant %s not found", row.TenantId)
+		}
+		for _, existing := range t.Service {
+			if existing.TenantId == row.TenantId && existing.Name == row.Name && existing.ServiceOfferPlanSourceId == row.ServiceOfferPlanSourceId {
+				return errors.New("duplicate key value violates unique constraint \"idx_tenant_service-offer_plan_name\"")
+			}
+		}
+		t.Service[row.ID] = row
+		return nil
+	})
+}
+
+func (s *MemoryStore) MakeSubscriptionEntry(ctx context.Context, subscription *model.Subscription) error {
+	row := *subscription
+	return s.write(subscriptionTable, func(t *memoryTables) error {
+		if _, ok := t.Subscription[row.ID]; ok {
+			return fmt.Errorf("duplicate key value violates unique constraint \"subscription_pkey\" %s", row.ID)
+		}
+		if _, ok := t.Tenant[row.TenantId]; !ok {
+			return fmt.Errorf("insert on subscription violates foreign key constraint, tenant %s not found", row.TenantId)
+		}
+		if _, ok := t.Service[row.ServiceId]; !ok {
+			return fmt.Errorf("insert on subscription violates foreign key constraint, service %s not found", row.ServiceId)
+		}
+		if _, ok := t.Product[row.ProductId]; !ok {
+			return fmt.Errorf("insert on subscription violates foreign key constraint, product %s not found", row.ProductId)
+		}
+		for _, existing := range t.Subscription {
+			if existing.ServiceId == row.ServiceId && existing.ProductId == row.ProductId && existing.Name == row.Name {
+				return errors.New("duplicate key value violates unique constraint \"idx_product_service_name\"")
+			}
+		}
+		t.Subscription[row.ID] = row
+		return nil
+	})
+}
+
+func (s *MemoryStore) MakeSubscriptionPolicyEntry(ctx context.Context, subscriptionPolicy *model.SubscriptionPolicy) error {
+	row := *subscriptionPolicy
+	return s.write(subscriptionPolicyTable, func(t *memoryTables) error {
+		if _, ok := t.Subscription[row.SubscriptionId]; !ok {
+			return fmt.Errorf("insert on subscription_policy violates foreign key constraint, subscription %s not found", row.SubscriptionId)
+		}
+		for _, existing := range t.SubscriptionPolicy {
+			if !existing.Deleted && !row.Deleted && existing.SubscriptionId == row.SubscriptionId && existing.PolicyId == row.PolicyId {
+				return errors.New("duplicate key value violates unique constraint \"idx_unique_sub_policy\"")
+			}
+		}
+		t.SubscriptionPolicy = append(t.SubscriptionPolicy, row)
+		return nil
+	})
+}
+
+func (s *MemoryStore) SelectTenantIds(ctx context.Context, sel TenantSelector) ([]uuid.UUID, error) {
+	if err := sel.validate(); err != nil {
+		return nil, err
+	}
+	ids := make([]uuid.UUID, 0)
+	err := s.read(func(t *memoryTables) error {
+		for id, tenant := range t.Tenant {
+			if sel.matches(tenant) {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	if sel.Limit > 0 && len(ids) > sel.Limit {
+		ids = ids[:sel.Limit]
+	}
+	return ids, err
+}
+
+func (s *MemoryStore) GetSubscriptionPolicyIds(ctx context.Context, subscriptionIds []uuid.UUID) (map[uuid.UUID][]uuid.UUID, error) {
+	policyIds := make(map[uuid.UUID][]uuid.UUID, len(subscriptionIds))
+	err := s.read(func(t *memoryTables) error {
+		wanted := make(map[uuid.UUID]bool, len(subscriptionIds))
+		for _, id := range subscriptionIds {
+			wanted[id] = true
+		}
+		for _, sp := range t.SubscriptionPolicy {
+			if wanted[sp.SubscriptionId] && !sp.Deleted {
+				policyIds[sp.SubscriptionId] = append(policyIds[sp.SubscriptionId], sp.PolicyId)
+			}
+		}
+		return nil
+	})
+	return policyIds, err
+}
+
+func (s *MemoryStore) GetTenantResources(ctx context.Context, tenantIds []uuid.UUID) ([]model.TenantResources, error) {
+	resources := make([]model.TenantResources, 0, len(tenantIds))
+	err := s.read(func(t *memoryTables) error {
+		byTenant := map[uuid.UUID]int{}
+		for _, id := range tenantIds {
+			tenant, ok := t.Tenant[id]
+			if !ok {
+				continue
+			}
+			byTenant[id] = len(resources)
+			resources = append(resources, model.TenantResources{TenantId: id, Email: tenant.Email})
+		}
+		for _, service := range t.Service {
+			if i, ok := byTenant[service.TenantId]; ok {
+				resources[i].ServiceIds = append(resources[i].ServiceIds, service.ID)
+			}
+		}
+		for _, sub := range t.Subscription {
+			if i, ok := byTenant[sub.TenantId]; ok {
+				resources[i].Subscriptions = append(resources[i].Subscriptions, sub)
+			}
+		}
+		for _, policy := range t.Policy {
+			if tenantId, err := uuid.Parse(policy.TenantId); err == nil {
+				if i, ok := byTenant[tenantId]; ok {
+					resources[i].PolicyIds = append(resources[i].PolicyIds, policy.ID)
+				}
+			}
+		}
+		for _, sp := range t.SubscriptionPolicy {
+			if i, ok := byTenant[sp.TenantId]; ok {
+				resources[i].SubscriptionPolicies++
+			}
+		}
+		return nil
+	})
+	sort.Slice(resources, func(i, j int) bool { return resources[i].TenantId.String() < resources[j].TenantId.String() })
+	return resources, err
+}
+
+func (s *MemoryStore) DeleteSubscriptionPoliciesBySubscriptionIds(ctx context.Context, subscriptionIds []uuid.UUID) error {
+	ids := idSet(subscriptionIds)
+	return s.deleteSubscriptionPolicies("", func(sp model.SubscriptionPolicy) bool { return ids[sp.SubscriptionId] })
+}
+
+func (s *MemoryStore) DeleteSubscriptionPoliciesByTenantIds(ctx context.Context, tenantIds []uuid.UUID) error {
+	ids := idSet(tenantIds)
+	return s.deleteSubscriptionPolicies(" of tenants", func(sp model.SubscriptionPolicy) bool { return ids[sp.TenantId] })
+}
+
+func (s *MemoryStore) DeleteSubscriptionPoliciesByPolicyIds(ctx context.Context, policyIds []uuid.UUID) error {
+	ids := idSet(policyIds)
+	return s.deleteSubscriptionPolicies(" of policies", func(sp model.SubscriptionPolicy) bool { return ids[sp.PolicyId] })
+}
+
+func (s *MemoryStore) deleteSubscriptionPolicies(of string, match func(sp model.SubscriptionPolicy) bool) error {
+	var deleted int
+	err := s.write(subscriptionPolicyTable, func(t *memoryTables) error {
+		kept := make([]model.SubscriptionPolicy, 0, len(t.SubscriptionPolicy))
+		for _, sp := range t.SubscriptionPolicy {
+			if !match(sp) {
+				kept = append(kept, sp)
+			}
+		}
+		deleted = len(t.SubscriptionPolicy) - len(kept)
+		t.SubscriptionPolicy = kept
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error in deleting subscription policies%s %v", of, err)
+		return err
+	}
+	logrus.Infof("%d subscription policies%s deleted", deleted, of)
+	return nil
+}
+
+func (s *MemoryStore) UpdateSubscriptionStatus(ctx context.Context, subscriptionIds []uuid.UUID, status string) error {
+	var updated int
+	err := s.write(subscriptionTable, func(t *memoryTables) error {
+		updated = 0
+		for _, id := range subscriptionIds {
+			if sub, ok := t.Subscription[id]; ok {
+				sub.Status, sub.UpdatedAt = status, time.Now()
+				t.Subscription[id] = sub
+				updated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error in updating subscriptions %v", err)
+		return err
+	}
+	logrus.Infof("%d subscriptions set to %s", updated, status)
+	return nil
+}
+
+func (s *MemoryStore) DeleteSubscriptionsByIds(ctx context.Context, subscriptionIds []uuid.UUID) error {
+	var deleted int
+	err := s.write(subscriptionTable, func(t *memoryTables) error {
+		ids := idSet(subscriptionIds)
+		for _, sp := range t.SubscriptionPolicy {
+			if ids[sp.SubscriptionId] {
+				return referencedError("subscription", sp.SubscriptionId, "subscription_policy")
+			}
+		}
+		deleted = deleteKeys(t.Subscription, subscriptionIds)
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error in deleting subscriptions %v", err)
+		return err
+	}
+	logrus.Infof("%d subscriptions deleted", deleted)
+	return nil
+}
+
+func (s *MemoryStore) DeletePoliciesByIds(ctx context.Context, policyIds []uuid.UUID) error {
+	var deleted int
+	err := s.write(policyTable, func(t *memoryTables) error {
+		deleted = deleteKeys(t.Policy, policyIds)
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error in deleting policies %v", err)
+		return err
+	}
+	logrus.Infof("%d Policies deleted", deleted)
+	return nil
+}
+
+func (s *MemoryStore) DeleteServicesByIds(ctx context.Context, serviceIds []uuid.UUID) error {
+	var deleted int
+	err := s.write(serviceTable, func(t *memoryTables) error {
+		ids := idSet(serviceIds)
+		for _, sub := range t.Subscription {
+			if ids[sub.ServiceId] {
+				return referencedError("service", sub.ServiceId, "subscription")
+			}
+		}
+		deleted = deleteKeys(t.Service, serviceIds)
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error in deleting Service %v", err)
+		return err
+	}
+	logrus.Infof("%d Services deleted", deleted)
+	return nil
+}
+
+func (s *MemoryStore) DeleteTenantsByIds(ctx context.Context, tenantIds []uuid.UUID) error {
+	var deleted int
+	err := s.write(tenantTable, func(t *memoryTables) error {
+		ids := idSet(tenantIds)
+		for _, service := range t.Service {
+			if ids[service.TenantId] {
+				return referencedError("tenant", service.TenantId, "service")
+			}
+		}
+		for _, sub := range t.Subscription {
+			if ids[sub.TenantId] {
+				return referencedError("tenant", sub.TenantId, "subscription")
+			}
+		}
+		deleted = deleteKeys(t.Tenant, tenantIds)
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Error in deleting tenants %v", err)
+		return err
+	}
+	logrus.Infof("%d tenants deleted", deleted)
+	return nil
+}
+
+func (s *MemoryStore) CountTenantRows(ctx context.Context, tenantIds []uuid.UUID) (map[string]int64, error) {
+	ids := idSet(tenantIds)
+	counts := map[string]int64{}
+	err := s.read(func(t *memoryTables) error {
+		for _, sp := range t.SubscriptionPolicy {
+			if ids[sp.TenantId] {
+				counts["subscription_policy"]++
+			}
+		}
+		for _, sub := range t.Subscription {
+			if ids[sub.TenantId] {
+				counts["subscription"]++
+			}
+		}
+		for _, policy := range t.Policy {
+			if tenantId, err := uuid.Parse(policy.TenantId); err == nil && ids[tenantId] {
+				counts["policy"]++
+			}
+		}
+		for _, service := range t.Service {
+			if ids[service.TenantId] {
+				counts["service"]++
+			}
+		}
+		for id := range t.Tenant {
+			if ids[id] {
+				counts["tenant"]++
+			}
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// referencedError is the error postgres gives when a delete would leave rows of another table without their parent
+func referencedError(table string, id uuid.UUID, referencedBy string) error {
+	return fmt.Errorf("update or delete on table \"%s\" violates foreign key constraint on table \"%s\", %s %s is still referenced", table, referencedBy, table, id)
+}
+
+func idSet(ids []uuid.UUID) map[uuid.UUID]bool {
+	set := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func deleteKeys[T any](table map[uuid.UUID]T, ids []uuid.UUID) int {
+	deleted := 0
+	for _, id := range ids {
+		if _, ok := table[id]; ok {
+			delete(table, id)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Begin starts a transaction that shares the tables of the store until it writes them
+func (s *MemoryStore) Begin(ctx context.Context) (Tx, error) {
+	if s.parent != nil {
+		return nil, errors.New("nested transactions are not supported")
+	}
+	return &MemoryStore{tables: &memoryTables{}, parent: s, ctx: ctx}, nil
+}
+
+// Commit replays the transaction writes on the parent store, all of them apply or none do
+func (s *MemoryStore) Commit() error {
+	if s.parent == nil {
+		return errors.New("not in a transaction")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return errTxDone
+	}
+	s.done = true
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	s.parent.mu.Lock()
+	defer s.parent.mu.Unlock()
+	tables := s.parent.tables.cloneTables(s.copied)
+	for _, w := range s.ops {
+		if err := w.op(tables); err != nil {
+			return err
+		}
+	}
+	s.parent.tables = tables
+	return nil
+}
+
+func (s *MemoryStore) Rollback() error {
+	if s.parent == nil {
+		return errors.New("not in a transaction")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.ops = nil
+	return nil
+}
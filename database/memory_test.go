@@ -0,0 +1,169 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"sync"
+	"testing"
+)
+
+func newSourcedStore(t *testing.T) (*MemoryStore, uuid.UUID) {
+	t.Helper()
+	s := NewMemoryStore()
+	source := model.Source{ID: uuid.New(), Name: "perf"}
+	if err := s.AddSource(source); err != nil {
+		t.Fatal(err)
+	}
+	return s, source.ID
+}
+
+func countTenants(t *testing.T, s Store, ids ...uuid.UUID) int64 {
+	t.Helper()
+	counts, err := s.CountTenantRows(context.Background(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counts["tenant"]
+}
+
+func TestMemoryStoreTransaction(t *testing.T) {
+	ctx := context.Background()
+	s, sourceId := newSourcedStore(t)
+	tenant := model.Tenant{ID: uuid.New(), Email: "a@example.com", SourceId: sourceId}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.MakeTenantEntry(ctx, &tenant); err != nil {
+		t.Fatal(err)
+	}
+	if got := countTenants(t, tx, tenant.ID); got != 1 {
+		t.Errorf("transaction sees %d of its tenants, want 1", got)
+	}
+	if got := countTenants(t, s, tenant.ID); got != 0 {
+		t.Errorf("store sees %d uncommitted tenants, want 0", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := countTenants(t, s, tenant.ID); got != 1 {
+		t.Errorf("store sees %d committed tenants, want 1", got)
+	}
+	if err := tx.Commit(); !errors.Is(err, errTxDone) {
+		t.Errorf("committing twice: got %v, want %v", err, errTxDone)
+	}
+
+	rolledBack := model.Tenant{ID: uuid.New(), Email: "b@example.com", SourceId: sourceId}
+	tx, err = s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.MakeTenantEntry(ctx, &rolledBack); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if got := countTenants(t, s, rolledBack.ID); got != 0 {
+		t.Errorf("store sees %d rolled back tenants, want 0", got)
+	}
+}
+
+func TestMemoryStoreTransactionCopiesWrittenTables(t *testing.T) {
+	ctx := context.Background()
+	s, sourceId := newSourcedStore(t)
+	txn, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := txn.(*MemoryStore)
+	if tx.tables.Source != nil || tx.tables.Tenant != nil {
+		t.Fatal("Begin copied the tables")
+	}
+	if _, err := tx.GetTenantSourceId(ctx, "perf"); err != nil {
+		t.Fatalf("transaction does not read the store, %v", err)
+	}
+	if err := tx.MakeTenantEntry(ctx, &model.Tenant{ID: uuid.New(), SourceId: sourceId}); err != nil {
+		t.Fatal(err)
+	}
+	if tx.copied != tenantTable || tx.tables.Source != nil {
+		t.Errorf("got copied tables %b, want only the tenant table", tx.copied)
+	}
+}
+
+func TestMemoryStoreCommitIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	s, sourceId := newSourcedStore(t)
+	service := model.Service{ID: uuid.New(), Name: "svc"}
+	tenant := model.Tenant{ID: uuid.New(), SourceId: sourceId}
+	service.TenantId = tenant.ID
+	if err := s.MakeTenantEntry(ctx, &tenant); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := model.Tenant{ID: uuid.New(), SourceId: sourceId}
+	if err := tx.MakeTenantEntry(ctx, &other); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.MakeServiceEntry(ctx, &service); err != nil {
+		t.Fatal(err)
+	}
+	// the tenant of the service goes away before the commit, so its replay fails
+	if err := s.DeleteTenantsByIds(ctx, []uuid.UUID{tenant.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("commit replayed a service of a deleted tenant")
+	}
+	if got := countTenants(t, s, other.ID); got != 0 {
+		t.Errorf("store has %d tenants of the failed commit, want 0", got)
+	}
+}
+
+func TestMemoryStoreConcurrentTransactions(t *testing.T) {
+	ctx := context.Background()
+	s, sourceId := newSourcedStore(t)
+	ids := make([]uuid.UUID, 20)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(ids))
+	for i := range ids {
+		ids[i] = uuid.New()
+		wg.Add(1)
+		go func(tenant model.Tenant) {
+			defer wg.Done()
+			tx, err := s.Begin(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			service := model.Service{ID: uuid.New(), TenantId: tenant.ID, Name: "svc"}
+			if err := tx.MakeTenantEntry(ctx, &tenant); err != nil {
+				errs <- err
+			} else if err := tx.MakeServiceEntry(ctx, &service); err != nil {
+				errs <- err
+			} else if err := tx.Commit(); err != nil {
+				errs <- fmt.Errorf("commit of tenant %s, %v", tenant.ID, err)
+			}
+		}(model.Tenant{ID: ids[i], SourceId: sourceId})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	counts, err := s.CountTenantRows(ctx, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["tenant"] != 20 || counts["service"] != 20 {
+		t.Errorf("got rows %v, want 20 tenants and 20 services", counts)
+	}
+}
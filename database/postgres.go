@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// postgresStore is the Store backed by the platform postgres database
+type postgresStore struct {
+	db   *gorm.DB
+	inTx bool
+}
+
+func NewPostgresStore(db *gorm.DB) Store {
+	return &postgresStore{db: db}
+}
+
+// conn is the connection, or transaction, bound to ctx so a cancelled run aborts its queries
+func (s *postgresStore) conn(ctx context.Context) *gorm.DB {
+	return s.db.WithContext(ctx)
+}
+
+func (s *postgresStore) GetTenantSourceId(ctx context.Context, sourceName string) (uuid.UUID, error) {
+	return GetTenantSourceId(ctx, s.conn(ctx), sourceName)
+}
+
+func (s *postgresStore) GetProductExtId(ctx context.Context, productId uuid.UUID) (string, error) {
+	return GetProductExtId(ctx, s.conn(ctx), productId)
+}
+
+func (s *postgresStore) GetSubscriptionByVariableKey(ctx context.Context, variableKey string) (model.Subscription, error) {
+	return GetSubscriptionByVariableKey(ctx, s.conn(ctx), variableKey)
+}
+
+func (s *postgresStore) MakeTenantEntry(ctx context.Context, tenant *model.Tenant) error {
+	return MakeTenantEntry(ctx, s.conn(ctx), tenant)
+}
+
+func (s *postgresStore) MakeServiceEntry(ctx context.Context, service *model.Service) error {
+	return MakeServiceEntry(ctx, s.conn(ctx), service)
+}
+
+func (s *postgresStore) MakeSubscriptionEntry(ctx context.Context, subscription *model.Subscription) error {
+	return MakeSubscriptionEntry(ctx, s.conn(ctx), subscription)
+}
+
+func (s *postgresStore) MakeSubscriptionPolicyEntry(ctx context.Context, subscriptionPolicy *model.SubscriptionPolicy) error {
+	return MakeSubscriptionPolicyEntry(ctx, s.conn(ctx), subscriptionPolicy)
+}
+
+func (s *postgresStore) SelectTenantIds(ctx context.Context, sel TenantSelector) ([]uuid.UUID, error) {
+	return SelectTenantIds(ctx, s.conn(ctx), sel)
+}
+
+func (s *postgresStore) GetSubscriptionPolicyIds(ctx context.Context, subscriptionIds []uuid.UUID) (map[uuid.UUID][]uuid.UUID, error) {
+	return GetSubscriptionPolicyIds(ctx, s.conn(ctx), subscriptionIds)
+}
+
+func (s *postgresStore) GetSubscriptionsByExternalIds(ctx context.Context, externalIds []string) ([]model.Subscription, error) {
+	return GetSubscriptionsByExternalIds(ctx, s.conn(ctx), externalIds)
+}
+
+func (s *postgresStore) UpdateSubscriptionStatus(ctx context.Context, subscriptionIds []uuid.UUID, status string) error {
+	return UpdateSubscriptionStatus(ctx, s.conn(ctx), subscriptionIds, status)
+}
+
+func (s *postgresStore) GetTenantResources(ctx context.Context, tenantIds []uuid.UUID) ([]model.TenantResources, error) {
+	return GetTenantResources(ctx, s.conn(ctx), tenantIds)
+}
+
+func (s *postgresStore) DeleteSubscriptionPoliciesBySubscriptionIds(ctx context.Context, subscriptionIds []uuid.UUID) error {
+	return DeleteSubscriptionPoliciesBySubscriptionIds(ctx, s.conn(ctx), subscriptionIds)
+}
+
+func (s *postgresStore) DeleteSubscriptionPoliciesByTenantIds(ctx context.Context, tenantIds []uuid.UUID) error {
+	return DeleteSubscriptionPoliciesByTenantIds(ctx, s.conn(ctx), tenantIds)
+}
+
+func (s *postgresStore) DeleteSubscriptionPoliciesByPolicyIds(ctx context.Context, policyIds []uuid.UUID) error {
+	return DeleteSubscriptionPoliciesByPolicyIds(ctx, s.conn(ctx), policyIds)
+}
+
+func (s *postgresStore) DeleteSubscriptionsByIds(ctx context.Context, subscriptionIds []uuid.UUID) error {
+	return DeleteSubscriptionsByIds(ctx, s.conn(ctx), subscriptionIds)
+}
+
+func (s *postgresStore) DeletePoliciesByIds(ctx context.Context, policyIds []uuid.UUID) error {
+	return DeletePoliciesByIds(ctx, s.conn(ctx), policyIds)
+}
+
+func (s *postgresStore) DeleteServicesByIds(ctx context.Context, serviceIds []uuid.UUID) error {
+	return DeleteServicesByIds(ctx, s.conn(ctx), serviceIds)
+}
+
+func (s *postgresStore) DeleteTenantsByIds(ctx context.Context, tenantIds []uuid.UUID) error {
+	return DeleteTenantsByIds(ctx, s.conn(ctx), tenantIds)
+}
+
+func (s *postgresStore) CountTenantRows(ctx context.Context, tenantIds []uuid.UUID) (map[string]int64, error) {
+	return CountTenantRows(ctx, s.conn(ctx), tenantIds)
+}
+
+func (s *postgresStore) Begin(ctx context.Context) (Tx, error) {
+	if s.inTx {
+		return nil, errors.New("nested transactions are not supported")
+	}
+	// database/sql rolls the transaction back when ctx is cancelled before Commit
+	tx := s.db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &postgresStore{db: tx, inTx: true}, nil
+}
+
+func (s *postgresStore) Commit() error {
+	return s.db.Commit().Error
+}
+
+func (s *postgresStore) Rollback() error {
+	err := s.db.Rollback().Error
+	if errors.Is(err, gorm.ErrInvalidTransaction) || errors.Is(err, sql.ErrTxDone) {
+		// already committed or rolled back
+		return nil
+	}
+	return err
+}
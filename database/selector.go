@@ -0,0 +1,70 @@
+package database
+
+import (
+	"errors"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TenantSelector picks tenants of an email domain, every other field that is set narrows the selection further
+type TenantSelector struct {
+	EmailDomain string
+	TenantIds   []uuid.UUID
+	//CreatedAfter and CreatedBefore bound tenant.created_at, the zero time leaves that side open
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	//Limit keeps the first tenants by id, 0 keeps all
+	Limit int
+}
+
+func (s TenantSelector) validate() error {
+	if strings.TrimSpace(s.EmailDomain) == "" {
+		return errors.New("tenantEmailDomain can not be empty")
+	}
+	return nil
+}
+
+// where narrows a query on the tenant table to the selected tenants, with bound parameters only
+func (s TenantSelector) where(query *gorm.DB) *gorm.DB {
+	query = query.Where("email like ? escape '\\'", "%@"+escapeLike(s.EmailDomain))
+	if s.TenantIds != nil {
+		query = query.Where("id in ?", s.TenantIds)
+	}
+	if !s.CreatedAfter.IsZero() {
+		query = query.Where("created_at >= ?", s.CreatedAfter)
+	}
+	if !s.CreatedBefore.IsZero() {
+		query = query.Where("created_at < ?", s.CreatedBefore)
+	}
+	query = query.Order("id")
+	if s.Limit > 0 {
+		query = query.Limit(s.Limit)
+	}
+	return query
+}
+
+// matches is where for the memory store, without the limit
+func (s TenantSelector) matches(t model.Tenant) bool {
+	if !strings.HasSuffix(t.Email, "@"+s.EmailDomain) {
+		return false
+	}
+	if s.TenantIds != nil && !slices.Contains(s.TenantIds, t.ID) {
+		return false
+	}
+	if !s.CreatedAfter.IsZero() && t.CreatedAt.Before(s.CreatedAfter) {
+		return false
+	}
+	if !s.CreatedBefore.IsZero() && !t.CreatedAt.Before(s.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// escapeLike makes % and _ in a domain match themselves in a like pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
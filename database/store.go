@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+)
+
+// Store is the persistence used by the create and cleanup flows
+type Store interface {
+	GetTenantSourceId(ctx context.Context, sourceName string) (uuid.UUID, error)
+	GetProductExtId(ctx context.Context, productId uuid.UUID) (string, error)
+	GetSubscriptionByVariableKey(ctx context.Context, variableKey string) (model.Subscription, error)
+	//GetSubscriptionsByExternalIds returns the subscriptions of the given API Gateway key ids
+	GetSubscriptionsByExternalIds(ctx context.Context, externalIds []string) ([]model.Subscription, error)
+
+	MakeTenantEntry(ctx context.Context, tenant *model.Tenant) error
+	MakeServiceEntry(ctx context.Context, service *model.Service) error
+	MakeSubscriptionEntry(ctx context.Context, subscription *model.Subscription) error
+	MakeSubscriptionPolicyEntry(ctx context.Context, subscriptionPolicy *model.SubscriptionPolicy) error
+
+	//SelectTenantIds returns the ids of the tenants sel picks, ordered by id
+	SelectTenantIds(ctx context.Context, sel TenantSelector) ([]uuid.UUID, error)
+	GetTenantResources(ctx context.Context, tenantIds []uuid.UUID) ([]model.TenantResources, error)
+	//GetSubscriptionPolicyIds returns the policy ids of the subscription_policy rows of each subscription
+	GetSubscriptionPolicyIds(ctx context.Context, subscriptionIds []uuid.UUID) (map[uuid.UUID][]uuid.UUID, error)
+
+	UpdateSubscriptionStatus(ctx context.Context, subscriptionIds []uuid.UUID, status string) error
+	DeleteSubscriptionPoliciesBySubscriptionIds(ctx context.Context, subscriptionIds []uuid.UUID) error
+	DeleteSubscriptionPoliciesByTenantIds(ctx context.Context, tenantIds []uuid.UUID) error
+	DeleteSubscriptionPoliciesByPolicyIds(ctx context.Context, policyIds []uuid.UUID) error
+	DeleteSubscriptionsByIds(ctx context.Context, subscriptionIds []uuid.UUID) error
+	DeletePoliciesByIds(ctx context.Context, policyIds []uuid.UUID) error
+	DeleteServicesByIds(ctx context.Context, serviceIds []uuid.UUID) error
+	DeleteTenantsByIds(ctx context.Context, tenantIds []uuid.UUID) error
+	//CountTenantRows returns the number of rows per table that still belong to the tenants, tables without any are left out
+	CountTenantRows(ctx context.Context, tenantIds []uuid.UUID) (map[string]int64, error)
+
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// Tx is a Store whose writes become visible to others only after Commit
+type Tx interface {
+	Store
+	Commit() error
+	Rollback() error
+}
@@ -0,0 +1,173 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Options of the load tool files, TargetUrl, Method and BodyFile are only used by vegeta
+type Options struct {
+	TargetUrl     string
+	Method        string
+	BodyFile      string
+	SplitKeyTypes bool
+}
+
+// exporter writes api keys in the data format of a load tool
+type exporter struct {
+	//suffix replaces the extension of the report in the file name
+	suffix string
+	write  func(w io.Writer, apiKeys []model.ApiKeyModel, opts Options) error
+}
+
+var exporters = map[string]exporter{
+	"k6":     {suffix: ".k6.js", write: writeK6},
+	"jmeter": {suffix: ".jmeter.csv", write: writeJMeter},
+	"locust": {suffix: "_locust.py", write: writeLocust},
+	"vegeta": {suffix: ".vegeta.txt", write: writeVegeta},
+}
+
+// jmeterColumns are the columns, and so the JMeter variable names, of the CSV Data Set file
+var jmeterColumns = []string{"run_id", "tenant_id", "subscription_id", "key_type", "product_id", "key_id", "full_key", "policy_ids"}
+
+// File is the name and content of a load tool data file
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Render exports apiKeys for tool into files named after reportFile. With SplitKeyTypes the attestation and
+// management keys go to separate files.
+func Render(tool, reportFile string, apiKeys []model.ApiKeyModel, opts Options) ([]File, error) {
+	e, ok := exporters[tool]
+	if !ok {
+		return nil, fmt.Errorf("unknown load tool %q", tool)
+	}
+	groups := map[string][]model.ApiKeyModel{"": apiKeys}
+	if opts.SplitKeyTypes {
+		groups = map[string][]model.ApiKeyModel{}
+		for _, apiKey := range apiKeys {
+			groups[apiKey.KeyType] = append(groups[apiKey.KeyType], apiKey)
+		}
+	}
+
+	keyTypes := make([]string, 0, len(groups))
+	for keyType := range groups {
+		keyTypes = append(keyTypes, keyType)
+	}
+	sort.Strings(keyTypes)
+
+	files := make([]File, 0, len(groups))
+	for _, keyType := range keyTypes {
+		fileName := FileName(reportFile, e.suffix, keyType)
+		var buf bytes.Buffer
+		if err := e.write(&buf, groups[keyType], opts); err != nil {
+			return nil, fmt.Errorf("error in exporting %s data %s, %v", tool, fileName, err)
+		}
+		files = append(files, File{Name: fileName, Data: buf.Bytes()})
+	}
+	return files, nil
+}
+
+// FileName puts an export next to the report, report_1.csv gives report_1.k6.js or report_1_attestation.k6.js
+func FileName(reportFile, suffix, keyType string) string {
+	base := strings.TrimSuffix(reportFile, filepath.Ext(reportFile))
+	if keyType != "" {
+		base += "_" + keyType
+	}
+	return base + suffix
+}
+
+// writeK6 writes an ES module exporting the keys as a SharedArray, so every VU shares one copy
+func writeK6(w io.Writer, apiKeys []model.ApiKeyModel, opts Options) error {
+	byt, err := json.MarshalIndent(apiKeys, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `import { SharedArray } from 'k6/data';
+
+// generated by api-key-gen, send full_key in the x-api-key header
+export const apiKeys = new SharedArray('api keys', function () {
+  return %s;
+});
+
+export default apiKeys;
+`, byt)
+	return err
+}
+
+// writeJMeter writes a CSV Data Set file, its header line names the JMeter variables
+func writeJMeter(w io.Writer, apiKeys []model.ApiKeyModel, opts Options) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(jmeterColumns); err != nil {
+		return err
+	}
+	for _, k := range apiKeys {
+		record := []string{k.RunId, uuidString(k.TenantId), uuidString(k.ID), k.KeyType, uuidString(k.ProductId), k.KeyId, k.FullKey, strings.Join(k.PolicyIds, " | ")}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// uuidString leaves ids missing from the report empty
+func uuidString(id uuid.UUID) string {
+	if id == uuid.Nil {
+		return ""
+	}
+	return id.String()
+}
+
+// writeLocust writes a python module that loads the keys, as JSON in a raw string, into a list of dicts. JSON
+// null, true and false are not python, so the module does not embed the JSON as a literal.
+func writeLocust(w io.Writer, apiKeys []model.ApiKeyModel, opts Options) error {
+	keys := make([]model.ApiKeyModel, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		if k.PolicyIds == nil {
+			k.PolicyIds = []string{}
+		}
+		keys = append(keys, k)
+	}
+	// JSON escapes every quote in its strings, so the raw string can not be ended early
+	byt, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("# generated by api-key-gen, send full_key in the x-api-key header\n\nimport json\n\n")
+	fmt.Fprintf(&b, "API_KEYS = json.loads(r\"\"\"\n%s\n\"\"\")\n\n", byt)
+	b.WriteString("ATTESTATION_KEYS = [k for k in API_KEYS if k[\"key_type\"] == \"attestation\"]\n")
+	b.WriteString("MANAGEMENT_KEYS = [k for k in API_KEYS if k[\"key_type\"] == \"management\"]\n")
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// writeVegeta writes targets in the vegeta http format, one request per key with its x-api-key header
+func writeVegeta(w io.Writer, apiKeys []model.ApiKeyModel, opts Options) error {
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	var b strings.Builder
+	for _, k := range apiKeys {
+		fmt.Fprintf(&b, "%s %s\n", strings.ToUpper(method), opts.TargetUrl)
+		fmt.Fprintf(&b, "x-api-key: %s\n", k.FullKey)
+		if opts.BodyFile != "" {
+			b.WriteString("Content-Type: application/json\n")
+			fmt.Fprintf(&b, "@%s\n", opts.BodyFile)
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,139 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testKeys() []model.ApiKeyModel {
+	return []model.ApiKeyModel{
+		{TenantId: uuid.New(), ID: uuid.New(), KeyId: "key1", FullKey: "djE6dmFyOmtleTE=", KeyType: "management", RunId: "run-1"},
+		{TenantId: uuid.New(), ID: uuid.New(), KeyId: "key2", FullKey: "djE6dmFyOmtleTI=", KeyType: "attestation", RunId: "run-1", PolicyIds: []string{"p1", "p2"}},
+	}
+}
+
+func TestFileName(t *testing.T) {
+	tests := []struct {
+		reportFile, suffix, keyType, want string
+	}{
+		{"report_1.csv", ".k6.js", "", "report_1.k6.js"},
+		{"out/report_1.csv", ".vegeta.txt", "attestation", "out/report_1_attestation.vegeta.txt"},
+		{"report_1", "_locust.py", "management", "report_1_management_locust.py"},
+	}
+	for _, tt := range tests {
+		if got := FileName(tt.reportFile, tt.suffix, tt.keyType); got != tt.want {
+			t.Errorf("FileName(%q, %q, %q) = %q, want %q", tt.reportFile, tt.suffix, tt.keyType, got, tt.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		tool  string
+		split bool
+		files []string
+	}{
+		{tool: "k6", files: []string{"report_1.k6.js"}},
+		{tool: "jmeter", files: []string{"report_1.jmeter.csv"}},
+		{tool: "locust", files: []string{"report_1_locust.py"}},
+		{tool: "vegeta", split: true, files: []string{"report_1_attestation.vegeta.txt", "report_1_management.vegeta.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tool, func(t *testing.T) {
+			files, err := Render(tt.tool, "report_1.csv", testKeys(), Options{TargetUrl: "https://api.example.com", SplitKeyTypes: tt.split})
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0, len(files))
+			for _, f := range files {
+				names = append(names, f.Name)
+			}
+			if !slices.Equal(names, tt.files) {
+				t.Errorf("got files %v, want %v", names, tt.files)
+			}
+		})
+	}
+	if _, err := Render("gatling", "report_1.csv", testKeys(), Options{}); err == nil {
+		t.Error("unknown tool is rendered")
+	}
+}
+
+func TestWriteJMeter(t *testing.T) {
+	var b strings.Builder
+	if err := writeJMeter(&b, testKeys(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || !slices.Equal(records[0], jmeterColumns) {
+		t.Fatalf("got %v, want a header and 2 keys", records)
+	}
+	if got := records[2][len(records[2])-1]; got != "p1 | p2" {
+		t.Errorf("got policy ids %q, want %q", got, "p1 | p2")
+	}
+	// ids missing from the report stay empty instead of the nil uuid
+	if got := records[1][4]; got != "" {
+		t.Errorf("got product id %q, want it empty", got)
+	}
+}
+
+func TestWriteVegeta(t *testing.T) {
+	var b strings.Builder
+	if err := writeVegeta(&b, testKeys()[:1], Options{TargetUrl: "https://api.example.com/attest", Method: "post", BodyFile: "body.json"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "POST https://api.example.com/attest\nx-api-key: djE6dmFyOmtleTE=\nContent-Type: application/json\n@body.json\n\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestWriteLocust(t *testing.T) {
+	var b strings.Builder
+	if err := writeLocust(&b, testKeys(), Options{}); err != nil {
+		t.Fatal(err)
+	}
+	module := b.String()
+	start, end := strings.Index(module, `r"""`), strings.LastIndex(module, `"""`)
+	if start < 0 || end <= start {
+		t.Fatalf("no raw string with the keys in\n%s", module)
+	}
+	var keys []map[string]any
+	if err := json.Unmarshal([]byte(module[start+4:end]), &keys); err != nil {
+		t.Fatalf("keys are not JSON, %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	if ids, ok := keys[0]["policy_ids"].([]any); !ok || len(ids) != 0 {
+		t.Errorf("got policy_ids %v of the management key, want an empty list", keys[0]["policy_ids"])
+	}
+
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed, the module is not run")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "keys_locust.py"), []byte(module), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(python, "-c", "import keys_locust as k; print(len(k.ATTESTATION_KEYS), len(k.MANAGEMENT_KEYS), k.MANAGEMENT_KEYS[0]['policy_ids'])")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("python can not load the module, %v\n%s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != "1 1 []" {
+		t.Errorf("got %q from python, want %q", got, "1 1 []")
+	}
+}
@@ -0,0 +1,103 @@
+// Package fullkey encodes and decodes the full api keys clients send in the x-api-key header. A full key is the
+// base64 of "version:variable_key:api_key"; the version decides how the rest is read so the format can change.
+package fullkey
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+)
+
+// V1 is the version written by the tool
+const V1 = "v1"
+
+var (
+	ErrMalformed      = errors.New("malformed full key")
+	ErrUnknownVersion = errors.New("unknown full key version")
+)
+
+// Key is a full key split into its parts
+type Key struct {
+	Version string
+	//VariableKey is the variable_key of the subscription
+	VariableKey string
+	//ApiKey is the value of the API Gateway key
+	ApiKey string
+}
+
+// codec encodes and decodes the parts after the version of one full key version
+type codec struct {
+	encode func(k Key) (string, error)
+	decode func(rest string) (Key, error)
+}
+
+var codecs = map[string]codec{
+	V1: {encode: encodeV1, decode: decodeV1},
+}
+
+// New is the current version of the full key of variableKey and apiKey
+func New(variableKey, apiKey string) (string, error) {
+	return Encode(Key{Version: V1, VariableKey: variableKey, ApiKey: apiKey})
+}
+
+// Encode validates k and returns its full key
+func Encode(k Key) (string, error) {
+	c, ok := codecs[k.Version]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownVersion, k.Version)
+	}
+	rest, err := c.encode(k)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString([]byte(k.Version + ":" + rest)), nil
+}
+
+// Decode splits a full key into its parts, surrounding white space is ignored
+func Decode(fullKey string) (Key, error) {
+	byt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(fullKey))
+	if err != nil {
+		return Key{}, fmt.Errorf("%w, not base64, %v", ErrMalformed, err)
+	}
+	version, rest, ok := strings.Cut(string(byt), ":")
+	if !ok {
+		return Key{}, fmt.Errorf("%w, no version", ErrMalformed)
+	}
+	c, ok := codecs[version]
+	if !ok {
+		return Key{}, fmt.Errorf("%w %q", ErrUnknownVersion, version)
+	}
+	return c.decode(rest)
+}
+
+// encodeV1 is "variable_key:api_key", the variable key is a uuid and neither part may hold a ':'
+func encodeV1(k Key) (string, error) {
+	if err := validateV1(k); err != nil {
+		return "", err
+	}
+	return k.VariableKey + ":" + k.ApiKey, nil
+}
+
+func decodeV1(rest string) (Key, error) {
+	parts := strings.Split(rest, ":")
+	if len(parts) != 2 {
+		return Key{}, fmt.Errorf("%w, v1 has 3 parts separated by ':', got %d", ErrMalformed, len(parts)+1)
+	}
+	k := Key{Version: V1, VariableKey: parts[0], ApiKey: parts[1]}
+	if err := validateV1(k); err != nil {
+		return Key{}, err
+	}
+	return k, nil
+}
+
+func validateV1(k Key) error {
+	if _, err := uuid.Parse(k.VariableKey); err != nil {
+		return fmt.Errorf("%w, variable key %q is not a uuid", ErrMalformed, k.VariableKey)
+	}
+	if k.ApiKey == "" || strings.Contains(k.ApiKey, ":") {
+		return fmt.Errorf("%w, api key must be set and can not hold ':'", ErrMalformed)
+	}
+	return nil
+}
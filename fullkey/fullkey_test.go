@@ -0,0 +1,86 @@
+package fullkey
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+const testVariableKey = "0b3c2f4e-5d6a-4b7c-8d9e-0f1a2b3c4d5e"
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		key  Key
+	}{
+		{name: "v1", key: Key{Version: V1, VariableKey: testVariableKey, ApiKey: "AbCdEf0123456789AbCdEf0123456789AbCdEf01"}},
+		{name: "api key with base64 padding", key: Key{Version: V1, VariableKey: testVariableKey, ApiKey: "a+b/c=="}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full, err := Encode(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Decode(" " + full + "\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.key {
+				t.Errorf("got %+v, want %+v", got, tt.key)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	full, err := New(testVariableKey, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := base64.StdEncoding.EncodeToString([]byte("v1:" + testVariableKey + ":key")); full != want {
+		t.Errorf("got %q, want %q", full, want)
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  Key
+		want error
+	}{
+		{name: "unknown version", key: Key{Version: "v9", VariableKey: testVariableKey, ApiKey: "key"}, want: ErrUnknownVersion},
+		{name: "variable key not a uuid", key: Key{Version: V1, VariableKey: "tenant", ApiKey: "key"}, want: ErrMalformed},
+		{name: "empty api key", key: Key{Version: V1, VariableKey: testVariableKey}, want: ErrMalformed},
+		{name: "api key with separator", key: Key{Version: V1, VariableKey: testVariableKey, ApiKey: "a:b"}, want: ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Encode(tt.key); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name, fullKey string
+		want          error
+	}{
+		{name: "not base64", fullKey: "not base64!", want: ErrMalformed},
+		{name: "no version", fullKey: b64("v1"), want: ErrMalformed},
+		{name: "unknown version", fullKey: b64("v2:" + testVariableKey + ":key"), want: ErrUnknownVersion},
+		{name: "missing api key", fullKey: b64("v1:" + testVariableKey), want: ErrMalformed},
+		{name: "too many parts", fullKey: b64("v1:" + testVariableKey + ":key:extra"), want: ErrMalformed},
+		{name: "variable key not a uuid", fullKey: b64("v1:tenant:key"), want: ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.fullKey); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
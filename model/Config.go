@@ -2,9 +2,26 @@ package model
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apikey-gen/crypt"
+	"github.com/google/uuid"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 )
 import "github.com/spf13/viper"
 
+// EnvPrefix prefixes the environment variables that override config values, e.g. APIKEYGEN_DB_CONF_PASSWORD
+const EnvPrefix = "APIKEYGEN"
+
 type DBConf struct {
 	Host     string `json:"host" mapstructure:"host"`
 	User     string `json:"user" mapstructure:"user"`
@@ -12,6 +29,9 @@ type DBConf struct {
 	DBName   string `json:"db_name" mapstructure:"db_name"`
 	SSLMode  string `json:"ssl_mode" mapstructure:"ssl_mode"`
 	Port     int    `json:"port" mapstructure:"port"`
+	//Driver is "postgres" (default) or "memory" for an in-memory database
+	Driver     string `json:"driver" mapstructure:"driver"`
+	MemoryFile string `json:"memory_file" mapstructure:"memory_file"`
 }
 
 type RequiredDetail struct {
@@ -25,6 +45,15 @@ type RequiredDetail struct {
 	ReportTmpl           string `json:"report_tmpl" mapstructure:"report_tmpl"`
 	ReportFileName       string `json:"report_file" mapstructure:"report_file"`
 	TenantSource         string `json:"tenant_source" mapstructure:"tenant_source"`
+	ManifestFileName     string `json:"manifest_file" mapstructure:"manifest_file"`
+	//AllOrNothing removes every tenant of a run again when one of them fails
+	AllOrNothing bool `json:"all_or_nothing" mapstructure:"all_or_nothing"`
+	//ReportFormat is one of ReportFormats, report_tmpl is only used by "template" and [report_template] by "gotemplate"
+	ReportFormat string `json:"report_format" mapstructure:"report_format"`
+	//ReportRecipients are age public keys the report is encrypted for, ReportPassphrase encrypts it with a
+	//passphrase instead and is best set in the environment
+	ReportRecipients []string `json:"report_recipients" mapstructure:"report_recipients"`
+	ReportPassphrase string   `json:"-" mapstructure:"report_passphrase"`
 }
 
 type AwsConf struct {
@@ -32,6 +61,10 @@ type AwsConf struct {
 	SecretAccessKey string `json:"secret_access_key" mapstructure:"secret_access_key"`
 	SessionToken    string `json:"session_token" mapstructure:"session_token"`
 	AWSRegion       string `json:"aws_region" mapstructure:"aws_region"`
+	//Backend is "aws" (default) or "memory" for an in-memory api gateway
+	Backend      string   `json:"backend" mapstructure:"backend"`
+	UsagePlanIds []string `json:"usage_plan_ids" mapstructure:"usage_plan_ids"`
+	MemoryFile   string   `json:"memory_file" mapstructure:"memory_file"`
 }
 
 type PoliciesConfig struct {
@@ -44,27 +77,331 @@ type PoliciesConfig struct {
 	PlanId                   string `json:"plan_id" mapstructure:"plan_id"`
 	ServiceOfferPlanSourceId string `json:"service_offer_plan_source_id" mapstructure:"service_offer_plan_source_id"`
 	PolicyCount              int    `json:"policy_count" mapstructure:"policies_per_tennant"`
+	//ReadinessUrl is polled with a new management key until it is accepted, defaults to ap_url
+	ReadinessUrl             string        `json:"readiness_url" mapstructure:"readiness_url"`
+	ReadinessTimeout         time.Duration `json:"readiness_timeout" mapstructure:"readiness_timeout"`
+	ReadinessInitialInterval time.Duration `json:"readiness_initial_interval" mapstructure:"readiness_initial_interval"`
+	ReadinessMaxInterval     time.Duration `json:"readiness_max_interval" mapstructure:"readiness_max_interval"`
+}
+
+// LimitsConf bounds how hard a run drives API Gateway and the policy api, zero values use the defaults and a
+// negative rps turns that limit off
+type LimitsConf struct {
+	//Concurrency is the number of tenants worked on at the same time
+	Concurrency        int     `json:"concurrency" mapstructure:"concurrency"`
+	GatewayCreateRps   float64 `json:"gateway_create_rps" mapstructure:"gateway_create_rps"`
+	UsagePlanAttachRps float64 `json:"usage_plan_attach_rps" mapstructure:"usage_plan_attach_rps"`
+	GatewayDeleteRps   float64 `json:"gateway_delete_rps" mapstructure:"gateway_delete_rps"`
+	PolicyCreateRps    float64 `json:"policy_create_rps" mapstructure:"policy_create_rps"`
+	//Burst is the number of calls of one kind allowed at once before the rate applies
+	Burst int `json:"burst" mapstructure:"burst"`
+}
+
+// ExportConf selects the load tool data files written next to the report of a create run
+type ExportConf struct {
+	//Tools are names of ExportTools, none by default
+	Tools []string `json:"tools" mapstructure:"tools"`
+	//TargetUrl, Method and BodyFile make the vegeta targets
+	TargetUrl string `json:"target_url" mapstructure:"target_url"`
+	Method    string `json:"method" mapstructure:"method"`
+	BodyFile  string `json:"body_file" mapstructure:"body_file"`
+	//SplitKeyTypes writes the attestation and management keys to separate files
+	SplitKeyTypes bool `json:"split_key_types" mapstructure:"split_key_types"`
 }
 
+// ExportTools are the load tools data can be exported for
+var ExportTools = []string{"k6", "jmeter", "locust", "vegeta"}
+
 type Config struct {
-	DbConf         DBConf         `json:"db_conf" mapstructure:"db_conf"`
-	RequiredDetail RequiredDetail `json:"required_detail" mapstructure:"required_detail"`
-	AwsConf        AwsConf        `json:"aws_conf" mapstructure:"aws_conf"`
-	PoliciesConfig PoliciesConfig `json:"policies_config" mapstructure:"policies_config"`
+	DbConf         DBConf             `json:"db_conf" mapstructure:"db_conf"`
+	RequiredDetail RequiredDetail     `json:"required_detail" mapstructure:"required_detail"`
+	AwsConf        AwsConf            `json:"aws_conf" mapstructure:"aws_conf"`
+	PoliciesConfig PoliciesConfig     `json:"policies_config" mapstructure:"policies_config"`
+	Limits         LimitsConf         `json:"limits" mapstructure:"limits"`
+	Export         ExportConf         `json:"export" mapstructure:"export"`
+	ReportTemplate ReportTemplateConf `json:"report_template" mapstructure:"report_template"`
 }
 
+// WithDefaults fills unset limits with values below the default API Gateway control plane quotas
+func (l LimitsConf) WithDefaults() LimitsConf {
+	if l.Concurrency == 0 {
+		l.Concurrency = 10
+	}
+	if l.GatewayCreateRps == 0 {
+		l.GatewayCreateRps = 5
+	}
+	if l.UsagePlanAttachRps == 0 {
+		l.UsagePlanAttachRps = 5
+	}
+	if l.GatewayDeleteRps == 0 {
+		l.GatewayDeleteRps = 5
+	}
+	if l.PolicyCreateRps == 0 {
+		l.PolicyCreateRps = 10
+	}
+	if l.Burst == 0 {
+		l.Burst = 1
+	}
+	return l
+}
+
+// GetConfig reads the config file and applies APIKEYGEN_<SECTION>_<KEY> environment overrides on top of it
 func GetConfig(ctx context.Context, fileName string) (Config, error) {
-	viper.SetConfigFile(fileName)
-	err := viper.ReadInConfig()
+	v := viper.New()
+	v.SetConfigFile(fileName)
+	err := v.ReadInConfig()
 
 	if err != nil {
 		return Config{}, err
 	}
 
+	for _, key := range ConfigKeys() {
+		if err := v.BindEnv(key, EnvName(key)); err != nil {
+			return Config{}, err
+		}
+	}
+
 	c := new(Config)
-	err = viper.Unmarshal(c)
+	err = v.Unmarshal(c)
 	if err != nil {
 		return Config{}, err
 	}
 	return *c, nil
 }
+
+// ConfigKeys lists every config key as section.key
+func ConfigKeys() []string {
+	keys := make([]string, 0)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		section := t.Field(i)
+		for j := 0; j < section.Type.NumField(); j++ {
+			keys = append(keys, section.Tag.Get("mapstructure")+"."+section.Type.Field(j).Tag.Get("mapstructure"))
+		}
+	}
+	return keys
+}
+
+// EnvName is the environment variable overriding a section.key config key
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// ReportPlaceholder matches a report_tmpl placeholder, {{field}} with optional spaces around the field name
+var ReportPlaceholder = regexp.MustCompile(`{{\s*([^}]*?)\s*}}`)
+
+// Validate checks the values a run depends on and returns every problem found
+func (c Config) Validate() error {
+	var errs []error
+	problem := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	isUUID := func(key, value string) {
+		if _, err := uuid.Parse(value); err != nil {
+			problem(key, "invalid uuid %q", value)
+		}
+	}
+	isURL := func(key, value string) {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem(key, "invalid http(s) url %q", value)
+		}
+	}
+
+	rd := c.RequiredDetail
+	if rd.TenantsCount < 1 {
+		problem("required_detail.tenants_count", "must be at least 1, got %d", rd.TenantsCount)
+	}
+	if rd.MagtKeyPerTenant < 1 {
+		problem("required_detail.mgmt_key_per_tenant", "must be at least 1, got %d", rd.MagtKeyPerTenant)
+	}
+	if rd.AttKeyPerTenant < 0 {
+		problem("required_detail.att_keys_per_tenant", "must not be negative, got %d", rd.AttKeyPerTenant)
+	}
+	isUUID("required_detail.attestation_product_id", rd.AttestationProductId)
+	isUUID("required_detail.management_product_id", rd.ManagementProductId)
+	if rd.EmailDomain == "" || strings.ContainsAny(rd.EmailDomain, "@ %") {
+		problem("required_detail.email_domain", "invalid domain %q", rd.EmailDomain)
+	}
+	if rd.MaintainerEmail == "" {
+		problem("required_detail.maintainer_email", "is required")
+	}
+	if !strings.Contains(rd.ReportFileName, "%d") {
+		problem("required_detail.report_file", "must contain %%d for the timestamp, got %q", rd.ReportFileName)
+	}
+	if rd.ManifestFileName != "" && !strings.Contains(rd.ManifestFileName, "%s") {
+		problem("required_detail.manifest_file", "must contain %%s for the run id, got %q", rd.ManifestFileName)
+	}
+	if rd.ReportFormat != "" && !slices.Contains(ReportFormats, rd.ReportFormat) {
+		problem("required_detail.report_format", "must be one of %s, got %q", strings.Join(ReportFormats, ", "), rd.ReportFormat)
+	}
+	if rd.ReportFormat == "gotemplate" {
+		if _, err := c.ReportTemplate.Parse(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := rd.ReportEncryption().Validate(); err != nil {
+		problem("required_detail.report_recipients", "%v", err)
+	}
+	fields := ApiKeyModelFields()
+	for _, m := range ReportPlaceholder.FindAllStringSubmatch(rd.ReportTmpl, -1) {
+		if !fields[m[1]] {
+			problem("required_detail.report_tmpl", "unknown placeholder %s", m[0])
+		}
+	}
+
+	pc := c.PoliciesConfig
+	if pc.PolicyCount < 0 {
+		problem("policies_config.policies_per_tennant", "must not be negative, got %d", pc.PolicyCount)
+	}
+	if pc.PolicyCount > 0 {
+		for key, value := range map[string]string{
+			"policies_config.policy":           pc.Policy,
+			"policies_config.policy_name":      pc.PolicyName,
+			"policies_config.policy_type":      pc.PolicyType,
+			"policies_config.attestation_type": pc.AttestationType,
+		} {
+			if value == "" {
+				problem(key, "is required")
+			}
+		}
+	}
+	isUUID("policies_config.service_offer_id", pc.ServiceOfferId)
+	isUUID("policies_config.plan_id", pc.PlanId)
+	isUUID("policies_config.service_offer_plan_source_id", pc.ServiceOfferPlanSourceId)
+	isURL("policies_config.ap_url", pc.Url)
+	if pc.ReadinessUrl != "" {
+		isURL("policies_config.readiness_url", pc.ReadinessUrl)
+	}
+	for key, d := range map[string]time.Duration{
+		"policies_config.readiness_timeout":          pc.ReadinessTimeout,
+		"policies_config.readiness_initial_interval": pc.ReadinessInitialInterval,
+		"policies_config.readiness_max_interval":     pc.ReadinessMaxInterval,
+	} {
+		if d < 0 {
+			problem(key, "must not be negative, got %v", d)
+		}
+	}
+
+	db := c.DbConf
+	switch strings.ToLower(db.Driver) {
+	case "", "postgres":
+		for key, value := range map[string]string{"db_conf.host": db.Host, "db_conf.user": db.User, "db_conf.db_name": db.DBName} {
+			if value == "" {
+				problem(key, "is required for the postgres driver")
+			}
+		}
+		if db.Port < 1 || db.Port > 65535 {
+			problem("db_conf.port", "invalid port %d", db.Port)
+		}
+	case "memory":
+	default:
+		problem("db_conf.driver", "unknown driver %q, use postgres or memory", db.Driver)
+	}
+
+	aw := c.AwsConf
+	switch strings.ToLower(aw.Backend) {
+	case "", "aws":
+		for key, value := range map[string]string{
+			"aws_conf.access_key_id":     aw.AccessKeyId,
+			"aws_conf.secret_access_key": aw.SecretAccessKey,
+			"aws_conf.aws_region":        aw.AWSRegion,
+		} {
+			if value == "" {
+				problem(key, "is required for the aws backend (set it or %s)", EnvName(key))
+			}
+		}
+	case "memory":
+	default:
+		problem("aws_conf.backend", "unknown backend %q, use aws or memory", aw.Backend)
+	}
+
+	lc := c.Limits
+	if lc.Concurrency < 0 {
+		problem("limits.concurrency", "must not be negative, got %d", lc.Concurrency)
+	}
+	if lc.Burst < 0 {
+		problem("limits.burst", "must not be negative, got %d", lc.Burst)
+	}
+
+	errs = append(errs, c.Export.problems()...)
+
+	sortErrors(errs)
+	return errors.Join(errs...)
+}
+
+// ReportEncryption is how files holding full api keys are encrypted
+func (rd RequiredDetail) ReportEncryption() crypt.Options {
+	return crypt.Options{Recipients: rd.ReportRecipients, Passphrase: rd.ReportPassphrase}
+}
+
+// ReportFormats are the values of report_format, empty means "template"
+var ReportFormats = []string{"template", "gotemplate", "csv", "json", "jsonl", "yaml"}
+
+// ApiKeyModelFields are the json names of ApiKeyModel usable as report_tmpl placeholders, and policy_id which
+// older templates use for policy_ids
+func ApiKeyModelFields() map[string]bool {
+	fields := map[string]bool{"policy_id": true}
+	t := reflect.TypeOf(ApiKeyModel{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+// Validate checks the export options, the export command needs no other part of the config
+func (e ExportConf) Validate() error {
+	return errors.Join(e.problems()...)
+}
+
+func (e ExportConf) problems() []error {
+	var errs []error
+	for _, tool := range e.Tools {
+		if !slices.Contains(ExportTools, tool) {
+			errs = append(errs, fmt.Errorf("export.tools: unknown tool %q, use %s", tool, strings.Join(ExportTools, ", ")))
+		}
+		if tool == "vegeta" {
+			if u, err := url.Parse(e.TargetUrl); err != nil || u.Scheme == "" || u.Host == "" {
+				errs = append(errs, fmt.Errorf("export.target_url: vegeta needs an absolute url, got %q", e.TargetUrl))
+			}
+		}
+	}
+	return errs
+}
+
+// sortErrors orders problems by key, the map iterations above would otherwise shuffle them
+func sortErrors(errs []error) {
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+}
+
+// Hash identifies the parts of the config that decide what a create run makes. Report, manifest, readiness and limit
+// settings are left out, changing them does not keep a run from being resumed or retried.
+func (c Config) Hash() string {
+	rd, pc := c.RequiredDetail, c.PoliciesConfig
+	byt, _ := json.Marshal(struct {
+		TenantsCount             int    `json:"tenants_count"`
+		AttKeyPerTenant          int    `json:"att_key_per_tenant"`
+		MagtKeyPerTenant         int    `json:"mgmt_key_per_tenant"`
+		MaintainerEmail          string `json:"maintainer_email"`
+		AttestationProductId     string `json:"attestation_product_id"`
+		ManagementProductId      string `json:"management_product_id"`
+		EmailDomain              string `json:"email_domain"`
+		TenantSource             string `json:"tenant_source"`
+		Policy                   string `json:"policy"`
+		PolicyName               string `json:"policy_name"`
+		PolicyType               string `json:"policy_type"`
+		AttestationType          string `json:"attestation_type"`
+		ServiceOfferId           string `json:"service_offer_id"`
+		Url                      string `json:"url"`
+		PlanId                   string `json:"plan_id"`
+		ServiceOfferPlanSourceId string `json:"service_offer_plan_source_id"`
+		PolicyCount              int    `json:"policy_count"`
+	}{rd.TenantsCount, rd.AttKeyPerTenant, rd.MagtKeyPerTenant, rd.MaintainerEmail, rd.AttestationProductId, rd.ManagementProductId,
+		rd.EmailDomain, rd.TenantSource, pc.Policy, pc.PolicyName, pc.PolicyType, pc.AttestationType, pc.ServiceOfferId, pc.Url,
+		pc.PlanId, pc.ServiceOfferPlanSourceId, pc.PolicyCount})
+	sum := sha256.Sum256(byt)
+	return hex.EncodeToString(sum[:])
+}
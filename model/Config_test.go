@@ -0,0 +1,58 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+// validConfig passes Validate, tests change the field they are about
+func validConfig() Config {
+	return Config{
+		RequiredDetail: RequiredDetail{
+			TenantsCount:         1,
+			AttKeyPerTenant:      1,
+			MagtKeyPerTenant:     1,
+			MaintainerEmail:      "perf@example.com",
+			AttestationProductId: "c9ae42c4-73c3-47c2-9c22-ce70e406591b",
+			ManagementProductId:  "24e8554a-dbf7-4a36-94b5-ab6232a52028",
+			EmailDomain:          "example.com",
+			ReportFileName:       "report_%d.csv",
+		},
+		PoliciesConfig: PoliciesConfig{
+			ServiceOfferId:           "1398df08-5ad0-4b23-a15c-a0b845a3299b",
+			PlanId:                   "21a61d35-252c-48ab-b342-b41fde768d95",
+			ServiceOfferPlanSourceId: "2a55bdd9-5f43-4b22-b656-f1b24cb28580",
+			Url:                      "http://127.0.0.1:18080/management/v1/policies",
+		},
+		DbConf:  DBConf{Driver: "memory"},
+		AwsConf: AwsConf{Backend: "memory"},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		problem string
+	}{
+		{name: "valid", change: func(c *Config) {}},
+		{name: "manifest file with run id", change: func(c *Config) { c.RequiredDetail.ManifestFileName = "runs/%s.json" }},
+		{name: "manifest file without run id", change: func(c *Config) { c.RequiredDetail.ManifestFileName = "manifest.json" }, problem: "required_detail.manifest_file"},
+		{name: "report template placeholders", change: func(c *Config) { c.RequiredDetail.ReportTmpl = "{{tenant_id}},{{ full_key }},{{policy_id}}" }},
+		{name: "unknown report template placeholder", change: func(c *Config) { c.RequiredDetail.ReportTmpl = "{{tenant_id}},{{ secret }}" }, problem: "unknown placeholder {{ secret }}"},
+		{name: "report file without timestamp", change: func(c *Config) { c.RequiredDetail.ReportFileName = "report.csv" }, problem: "required_detail.report_file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.change(&c)
+			err := c.Validate()
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("got %v, want no problem", err)
+			case tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)):
+				t.Errorf("got %v, want a problem with %s", err, tt.problem)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package model
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"sync"
+	"time"
+)
+
+// states of a tenant in a checkpoint
+const (
+	TenantPending    = "pending"
+	TenantInProgress = "in_progress"
+	TenantDone       = "done"
+)
+
+const (
+	eventStart     = "start"
+	eventTenants   = "tenants_planned"
+	eventKey       = "key"
+	eventPolicy    = "policy"
+	eventDone      = "tenant_done"
+	eventUndone    = "tenant_undone"
+	checkpointMode = 0600
+)
+
+// Checkpoint is the progress of a create run, kept as an append-only journal of JSON lines so a crashed or
+// interrupted run can be resumed. It holds the ids of the keys, not their values, which a resume reads back from
+// API Gateway, and is written with owner only permissions.
+type Checkpoint struct {
+	mu   sync.Mutex
+	file *os.File
+
+	RunId        string
+	ConfigHash   string
+	ManifestFile string
+	Tenants      []CheckpointTenant
+	index        map[uuid.UUID]int
+}
+
+type CheckpointTenant struct {
+	TenantId  uuid.UUID     `json:"tenant_id"`
+	ServiceId uuid.UUID     `json:"service_id"`
+	State     string        `json:"-"`
+	ApiKeys   []ApiKeyModel `json:"-"`
+	PolicyIds []string      `json:"-"`
+}
+
+type checkpointEvent struct {
+	Type         string             `json:"type"`
+	Time         time.Time          `json:"time"`
+	RunId        string             `json:"run_id,omitempty"`
+	ConfigHash   string             `json:"config_hash,omitempty"`
+	ManifestFile string             `json:"manifest_file,omitempty"`
+	Tenants      []CheckpointTenant `json:"tenants,omitempty"`
+	TenantId     uuid.UUID          `json:"tenant_id,omitempty"`
+	ApiKey       *ApiKeyModel       `json:"api_key,omitempty"`
+	PolicyId     string             `json:"policy_id,omitempty"`
+}
+
+// CreateCheckpoint starts the journal of a new run, an existing file is not overwritten
+func CreateCheckpoint(fileName, runId, configHash, manifestFile string) (*Checkpoint, error) {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, checkpointMode)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{file: f, RunId: runId, ConfigHash: configHash, ManifestFile: manifestFile, index: map[uuid.UUID]int{}}
+	if err := c.append(checkpointEvent{Type: eventStart, RunId: runId, ConfigHash: configHash, ManifestFile: manifestFile}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// OpenCheckpoint replays the journal and opens it to record the rest of the run. A torn last line, left by a
+// crash in the middle of a write, is ignored.
+func OpenCheckpoint(fileName string) (*Checkpoint, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_APPEND, checkpointMode)
+	if err != nil {
+		return nil, err
+	}
+	c := &Checkpoint{file: f, index: map[uuid.UUID]int{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e checkpointEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		c.apply(e)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if c.RunId == "" {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a checkpoint", fileName)
+	}
+	// terminate a torn line so the next event starts on its own line
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			if _, err := f.Write([]byte{'\n'}); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func (c *Checkpoint) apply(e checkpointEvent) {
+	switch e.Type {
+	case eventStart:
+		c.RunId, c.ConfigHash, c.ManifestFile = e.RunId, e.ConfigHash, e.ManifestFile
+	case eventTenants:
+		for _, t := range e.Tenants {
+			c.index[t.TenantId] = len(c.Tenants)
+			c.Tenants = append(c.Tenants, CheckpointTenant{TenantId: t.TenantId, ServiceId: t.ServiceId, State: TenantPending})
+		}
+	case eventKey, eventPolicy, eventDone, eventUndone:
+		i, ok := c.index[e.TenantId]
+		if !ok {
+			return
+		}
+		t := &c.Tenants[i]
+		switch e.Type {
+		case eventKey:
+			t.State = TenantInProgress
+			t.ApiKeys = append(t.ApiKeys, *e.ApiKey)
+		case eventPolicy:
+			t.State = TenantInProgress
+			t.PolicyIds = append(t.PolicyIds, e.PolicyId)
+		case eventDone:
+			t.State = TenantDone
+		case eventUndone:
+			t.State, t.ApiKeys, t.PolicyIds = TenantPending, nil, nil
+		}
+	}
+}
+
+func (c *Checkpoint) append(e checkpointEvent) error {
+	e.Time = time.Now().UTC()
+	byt, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := c.file.Write(append(byt, '\n')); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+// record applies and appends an event, a nil Checkpoint records nothing
+func (c *Checkpoint) record(e checkpointEvent) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apply(e)
+	return c.append(e)
+}
+
+// TenantsPlanned records the tenants of the run, their rows are written when their keys are created
+func (c *Checkpoint) TenantsPlanned(tenants []CheckpointTenant) error {
+	return c.record(checkpointEvent{Type: eventTenants, Tenants: tenants})
+}
+
+// KeyCreated records a key without its value, the journal is not encrypted like the report
+func (c *Checkpoint) KeyCreated(tenantId uuid.UUID, apiKey ApiKeyModel) error {
+	apiKey.ApiKey, apiKey.FullKey = "", ""
+	return c.record(checkpointEvent{Type: eventKey, TenantId: tenantId, ApiKey: &apiKey})
+}
+
+func (c *Checkpoint) PolicyCreated(tenantId uuid.UUID, policyId string) error {
+	return c.record(checkpointEvent{Type: eventPolicy, TenantId: tenantId, PolicyId: policyId})
+}
+
+func (c *Checkpoint) TenantDone(tenantId uuid.UUID) error {
+	return c.record(checkpointEvent{Type: eventDone, TenantId: tenantId})
+}
+
+// TenantUndone records that the rows, keys and policies of a tenant were removed again and it has to be redone
+func (c *Checkpoint) TenantUndone(tenantId uuid.UUID) error {
+	return c.record(checkpointEvent{Type: eventUndone, TenantId: tenantId})
+}
+
+// Remaining returns the tenants that are not done
+func (c *Checkpoint) Remaining() []CheckpointTenant {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	remaining := make([]CheckpointTenant, 0)
+	for _, t := range c.Tenants {
+		if t.State != TenantDone {
+			remaining = append(remaining, t)
+		}
+	}
+	return remaining
+}
+
+func (c *Checkpoint) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.file.Close()
+}
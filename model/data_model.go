@@ -68,15 +68,21 @@ type SubscriptionPolicy struct {
 	Deleted        bool      `gorm:"uniqueIndex:idx_unique_sub_policy, where:deleted = 'f';not null"`
 }
 
+// ApiKeyModel is a created api key as written to the report
 type ApiKeyModel struct {
-	TenantId    uuid.UUID `json:"tenant_id"`
-	ID          uuid.UUID `json:"id"`
-	VariableKey string    `json:"variable_key"`
-	ApiKey      string    `json:"api_key"`
-	Version     string    `json:"version"`
-	FullKey     string    `json:"full_key"`
-	KeyType     string    `json:"key_type"`
-	PolicyId    string    `json:"policy_id"`
+	TenantId  uuid.UUID `json:"tenant_id" yaml:"tenant_id"`
+	ServiceId uuid.UUID `json:"service_id" yaml:"service_id"`
+	//ID is the subscription id
+	ID          uuid.UUID `json:"id" yaml:"id"`
+	VariableKey string    `json:"variable_key" yaml:"variable_key"`
+	ApiKey      string    `json:"api_key" yaml:"api_key"`
+	KeyId       string    `json:"key_id" yaml:"key_id"`
+	Version     string    `json:"version" yaml:"version"`
+	FullKey     string    `json:"full_key" yaml:"full_key"`
+	KeyType     string    `json:"key_type" yaml:"key_type"`
+	ProductId   uuid.UUID `json:"product_id" yaml:"product_id"`
+	PolicyIds   []string  `json:"policy_ids" yaml:"policy_ids"`
+	RunId       string    `json:"run_id" yaml:"run_id"`
 }
 
 type PolicyModel struct {
@@ -93,3 +99,32 @@ type ServiceModel struct {
 	Source         string `json:"source"`
 	Name           string `json:"name"`
 }
+
+type Policy struct {
+	ID         uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	TenantId   string    `gorm:"type:string" json:"tenant_id"`
+	PolicyName string    `gorm:"type:string" json:"policy_name"`
+	PolicyType string    `gorm:"type:string" json:"policy_type"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Product struct {
+	ID         uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	Name       string    `gorm:"type:string" json:"name"`
+	ExternalId string    `gorm:"type:string" json:"external_id"`
+}
+
+type Source struct {
+	ID   uuid.UUID `gorm:"primary_key;type:uuid" json:"id"`
+	Name string    `gorm:"type:string" json:"name"`
+}
+
+// TenantResources is everything the create flow makes for one tenant, as found in the database
+type TenantResources struct {
+	TenantId             uuid.UUID      `json:"tenant_id"`
+	Email                string         `json:"email"`
+	ServiceIds           []uuid.UUID    `json:"service_ids"`
+	Subscriptions        []Subscription `json:"subscriptions"`
+	PolicyIds            []uuid.UUID    `json:"policy_ids"`
+	SubscriptionPolicies int            `json:"subscription_policies"`
+}
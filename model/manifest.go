@@ -0,0 +1,177 @@
+package model
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Manifest records every resource created by one create run so cleanup can remove exactly those
+type Manifest struct {
+	mu sync.Mutex
+	//fileMu keeps concurrent writes of the file in order
+	fileMu sync.Mutex
+
+	RunId       string           `json:"run_id"`
+	StartedAt   time.Time        `json:"started_at"`
+	FinishedAt  time.Time        `json:"finished_at"`
+	ConfigHash  string           `json:"config_hash"`
+	EmailDomain string           `json:"email_domain"`
+	Tenants     []ManifestTenant `json:"tenants"`
+	//NotUndone lists resources of failed tenants that could not be rolled back
+	NotUndone []string `json:"not_undone,omitempty"`
+}
+
+type ManifestTenant struct {
+	TenantId      uuid.UUID              `json:"tenant_id"`
+	ServiceId     uuid.UUID              `json:"service_id"`
+	Subscriptions []ManifestSubscription `json:"subscriptions"`
+	PolicyIds     []string               `json:"policy_ids"`
+}
+
+type ManifestSubscription struct {
+	SubscriptionId uuid.UUID `json:"subscription_id"`
+	KeyId          string    `json:"key_id"`
+	KeyType        string    `json:"key_type"`
+	//PolicyIds are the policies of the key, manifests written before they were recorded only have those of the tenant
+	PolicyIds []string `json:"policy_ids,omitempty"`
+}
+
+func NewManifest(runId, configHash, emailDomain string) *Manifest {
+	return &Manifest{
+		RunId:       runId,
+		StartedAt:   time.Now().UTC(),
+		ConfigHash:  configHash,
+		EmailDomain: emailDomain,
+		Tenants:     make([]ManifestTenant, 0),
+	}
+}
+
+func (m *Manifest) AddTenant(tenantId, serviceId uuid.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Tenants = append(m.Tenants, ManifestTenant{TenantId: tenantId, ServiceId: serviceId, Subscriptions: []ManifestSubscription{}, PolicyIds: []string{}})
+}
+
+// SetKeys records the api keys and policies created for an already added tenant, replacing those recorded before
+func (m *Manifest) SetKeys(tenantId uuid.UUID, apiKeys []ApiKeyModel, policyIds []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.Tenants {
+		if m.Tenants[i].TenantId != tenantId {
+			continue
+		}
+		m.Tenants[i].Subscriptions = make([]ManifestSubscription, 0, len(apiKeys))
+		for _, apiKey := range apiKeys {
+			m.Tenants[i].Subscriptions = append(m.Tenants[i].Subscriptions, ManifestSubscription{
+				SubscriptionId: apiKey.ID,
+				KeyId:          apiKey.KeyId,
+				KeyType:        apiKey.KeyType,
+				PolicyIds:      apiKey.PolicyIds,
+			})
+		}
+		m.Tenants[i].PolicyIds = append([]string{}, policyIds...)
+		return
+	}
+}
+
+// MergeCheckpoint adds the keys and policies the checkpoint of the run has and the manifest does not, those of
+// tenants that were in progress when the run stopped
+func (m *Manifest) MergeCheckpoint(cp *Checkpoint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ct := range cp.Tenants {
+		for i := range m.Tenants {
+			t := &m.Tenants[i]
+			if t.TenantId != ct.TenantId {
+				continue
+			}
+			for _, apiKey := range ct.ApiKeys {
+				if !slices.ContainsFunc(t.Subscriptions, func(s ManifestSubscription) bool { return s.SubscriptionId == apiKey.ID }) {
+					t.Subscriptions = append(t.Subscriptions, ManifestSubscription{SubscriptionId: apiKey.ID, KeyId: apiKey.KeyId, KeyType: apiKey.KeyType, PolicyIds: apiKey.PolicyIds})
+				}
+			}
+			for _, policyId := range ct.PolicyIds {
+				if !slices.Contains(t.PolicyIds, policyId) {
+					t.PolicyIds = append(t.PolicyIds, policyId)
+				}
+			}
+		}
+	}
+}
+
+func (m *Manifest) TenantIds() []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(m.Tenants))
+	for _, t := range m.Tenants {
+		ids = append(ids, t.TenantId)
+	}
+	return ids
+}
+
+func (m *Manifest) ServiceIds() []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(m.Tenants))
+	for _, t := range m.Tenants {
+		ids = append(ids, t.ServiceId)
+	}
+	return ids
+}
+
+func (m *Manifest) SubscriptionIds() []uuid.UUID {
+	ids := make([]uuid.UUID, 0)
+	for _, t := range m.Tenants {
+		for _, s := range t.Subscriptions {
+			ids = append(ids, s.SubscriptionId)
+		}
+	}
+	return ids
+}
+
+func (m *Manifest) KeyIds() []string {
+	ids := make([]string, 0)
+	for _, t := range m.Tenants {
+		for _, s := range t.Subscriptions {
+			ids = append(ids, s.KeyId)
+		}
+	}
+	return ids
+}
+
+func (m *Manifest) PolicyIds() []string {
+	ids := make([]string, 0)
+	for _, t := range m.Tenants {
+		ids = append(ids, t.PolicyIds...)
+	}
+	return ids
+}
+
+// WriteFile replaces the file through a rename, so a run killed while writing leaves the previous manifest
+func (m *Manifest) WriteFile(fileName string) error {
+	m.fileMu.Lock()
+	defer m.fileMu.Unlock()
+	m.mu.Lock()
+	byt, err := json.MarshalIndent(m, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := fileName + ".tmp"
+	if err := os.WriteFile(tmp, byt, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
+
+func ReadManifest(fileName string) (*Manifest, error) {
+	byt, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(byt, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"os"
+	"time"
+)
+
+// Outcome is the machine readable result of a create run, one entry per tenant
+type Outcome struct {
+	RunId        string         `json:"run_id"`
+	ManifestFile string         `json:"manifest_file"`
+	ReportFiles  []string       `json:"report_files"`
+	ConfigHash   string         `json:"config_hash"`
+	StartedAt    time.Time      `json:"started_at"`
+	FinishedAt   time.Time      `json:"finished_at"`
+	Tenants      []TenantResult `json:"tenants"`
+}
+
+// TenantResult is the outcome of creating the keys and policies of one tenant
+type TenantResult struct {
+	TenantId  uuid.UUID `json:"tenant_id"`
+	ServiceId uuid.UUID `json:"service_id"`
+	Success   bool      `json:"success"`
+	//Stage is the step that failed and Error why, both empty on success
+	Stage           string  `json:"stage,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	ManagementKeys  int     `json:"management_keys"`
+	AttestationKeys int     `json:"attestation_keys"`
+	Policies        int     `json:"policies"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	//NotUndone lists resources of a failed tenant that could not be rolled back
+	NotUndone []string `json:"not_undone,omitempty"`
+
+	ApiKeys   []ApiKeyModel `json:"-"`
+	PolicyIds []string      `json:"-"`
+}
+
+// Failed returns the tenants that did not get all their keys and policies
+func (o *Outcome) Failed() []TenantResult {
+	failed := make([]TenantResult, 0)
+	for _, t := range o.Tenants {
+		if !t.Success {
+			failed = append(failed, t)
+		}
+	}
+	return failed
+}
+
+// Merge replaces the results of tenants that were run again and adds new ones
+func (o *Outcome) Merge(results []TenantResult) {
+	index := map[uuid.UUID]int{}
+	for i, t := range o.Tenants {
+		index[t.TenantId] = i
+	}
+	for _, r := range results {
+		if i, ok := index[r.TenantId]; ok {
+			o.Tenants[i] = r
+		} else {
+			o.Tenants = append(o.Tenants, r)
+		}
+	}
+}
+
+func (o *Outcome) WriteFile(fileName string) error {
+	byt, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, byt, 0600)
+}
+
+func ReadOutcome(fileName string) (*Outcome, error) {
+	byt, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	o := new(Outcome)
+	if err := json.Unmarshal(byt, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
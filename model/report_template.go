@@ -0,0 +1,114 @@
+package model
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ReportTemplateConf are the text/template templates of the "gotemplate" report format. Rows use the template of
+// their key type when set and Row otherwise.
+type ReportTemplateConf struct {
+	Header         string `json:"header" mapstructure:"header"`
+	Row            string `json:"row" mapstructure:"row"`
+	AttestationRow string `json:"attestation_row" mapstructure:"attestation_row"`
+	ManagementRow  string `json:"management_row" mapstructure:"management_row"`
+}
+
+// ReportTemplates are the parsed templates of a ReportTemplateConf
+type ReportTemplates struct {
+	Header *template.Template
+	rows   map[string]*template.Template
+}
+
+// ReportHeader is the data of the header template
+type ReportHeader struct {
+	RunId   string
+	Time    time.Time
+	Keys    int
+	Tenants int
+}
+
+// ReportRow is the data of a row template, the fields of the key and those of its tenant and service
+type ReportRow struct {
+	ApiKeyModel
+	//Index counts the rows from 0
+	Index   int
+	Tenant  ReportTenant
+	Service ReportService
+}
+
+type ReportTenant struct {
+	Id    uuid.UUID
+	Email string
+}
+
+type ReportService struct {
+	Id             uuid.UUID
+	PlanId         string
+	ServiceOfferId string
+}
+
+// ReportTemplateFuncs are the functions report templates can use besides the text/template builtins
+func ReportTemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"join":  func(items []string, sep string) string { return strings.Join(items, sep) },
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"base64": func(s string) string {
+			return base64.StdEncoding.EncodeToString([]byte(s))
+		},
+		// at is index that gives "" past the end, attestation keys have a random number of policies
+		"at": func(items []string, i int) string {
+			if i < 0 || i >= len(items) {
+				return ""
+			}
+			return items[i]
+		},
+		"now":  func() time.Time { return time.Now().UTC() },
+		"date": func(layout string, t time.Time) string { return t.Format(layout) },
+	}
+}
+
+// Parse parses the templates, a row template is required for every key type
+func (c ReportTemplateConf) Parse() (*ReportTemplates, error) {
+	t := &ReportTemplates{rows: map[string]*template.Template{}}
+	parse := func(name, text string) (*template.Template, error) {
+		tmpl, err := template.New(name).Funcs(ReportTemplateFuncs()).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("report_template.%s: %v", name, err)
+		}
+		return tmpl, nil
+	}
+	var err error
+	if c.Header != "" {
+		if t.Header, err = parse("header", c.Header); err != nil {
+			return nil, err
+		}
+	}
+	for keyType, text := range map[string]string{"attestation": c.AttestationRow, "management": c.ManagementRow} {
+		name := keyType + "_row"
+		if text == "" {
+			name, text = "row", c.Row
+		}
+		if text == "" {
+			return nil, fmt.Errorf("report_template.row: is required unless attestation_row and management_row are set")
+		}
+		if t.rows[keyType], err = parse(name, text); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Row is the template of a key type
+func (t *ReportTemplates) Row(keyType string) (*template.Template, error) {
+	tmpl, ok := t.rows[keyType]
+	if !ok {
+		return nil, fmt.Errorf("no row template for key type %q", keyType)
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,285 @@
+package policyserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PoliciesPath = "/management/v1/policies"
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// KeyValidator checks the x-api-key header and returns the tenant owning the key
+type KeyValidator interface {
+	Validate(ctx context.Context, apiKey string) (tenantId string, err error)
+}
+
+type ValidatorFunc func(ctx context.Context, apiKey string) (string, error)
+
+func (f ValidatorFunc) Validate(ctx context.Context, apiKey string) (string, error) {
+	return f(ctx, apiKey)
+}
+
+// AllowAll accepts any non empty key, every key is its own tenant
+func AllowAll() KeyValidator {
+	return ValidatorFunc(func(ctx context.Context, apiKey string) (string, error) {
+		return apiKey, nil
+	})
+}
+
+// StaticKeys accepts only the given keys, mapped to their tenant ids
+func StaticKeys(keys map[string]string) KeyValidator {
+	return ValidatorFunc(func(ctx context.Context, apiKey string) (string, error) {
+		if tenantId, ok := keys[apiKey]; ok {
+			return tenantId, nil
+		}
+		return "", ErrUnauthorized
+	})
+}
+
+type Options struct {
+	//Latency is added to every request
+	Latency time.Duration
+	//ErrorRate is the probability (0-1) of answering with ErrorStatus instead of serving the request
+	ErrorRate float64
+	//FailFirst answers the first n requests with ErrorStatus
+	FailFirst   int
+	ErrorStatus int
+	//RateLimit in requests per second, requests over the limit get 429
+	RateLimit float64
+	RateBurst int
+}
+
+type Policy struct {
+	PolicyId        string    `json:"policy_id"`
+	TenantId        string    `json:"-"`
+	Policy          string    `json:"policy"`
+	PolicyName      string    `json:"policy_name"`
+	PolicyType      string    `json:"policy_type"`
+	AttestationType string    `json:"attestation_type"`
+	ServiceOfferId  string    `json:"service_offer_id"`
+	CreatedTime     time.Time `json:"creation_time"`
+}
+
+type Server struct {
+	opts      Options
+	validator KeyValidator
+	limiter   *rate.Limiter
+
+	mu       sync.Mutex
+	requests int
+	rnd      *rand.Rand
+	policies map[string]Policy
+}
+
+func New(validator KeyValidator, opts Options) *Server {
+	if opts.ErrorStatus == 0 {
+		opts.ErrorStatus = http.StatusInternalServerError
+	}
+	s := &Server{
+		opts:      opts,
+		validator: validator,
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		policies:  map[string]Policy{},
+	}
+	if opts.RateLimit > 0 {
+		burst := opts.RateBurst
+		if burst < 1 {
+			burst = int(math.Max(1, opts.RateLimit))
+		}
+		s.limiter = rate.NewLimiter(rate.Limit(opts.RateLimit), burst)
+	}
+	return s
+}
+
+// ListenAndServe serves the policy api on addr until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: s}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	logrus.Infof("Mock policy server listening on %s%s", addr, PoliciesPath)
+	err := srv.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Policies returns a copy of every stored policy
+func (s *Server) Policies() []Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedPolicies("")
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Latency > 0 {
+		select {
+		case <-time.After(s.opts.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if s.limiter != nil && !s.limiter.Allow() {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, "Too Many Requests")
+		return
+	}
+
+	if s.injectFailure() {
+		writeError(w, s.opts.ErrorStatus, http.StatusText(s.opts.ErrorStatus))
+		return
+	}
+
+	apiKey := r.Header.Get("x-api-key")
+	if apiKey == "" {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	tenantId, err := s.validator.Validate(r.Context(), apiKey)
+	if err != nil {
+		if !errors.Is(err, ErrUnauthorized) {
+			logrus.Errorf("Error in validating api key %v", err)
+		}
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == PoliciesPath:
+		switch r.Method {
+		case http.MethodPost:
+			s.createPolicy(w, r, tenantId)
+		case http.MethodGet:
+			s.mu.Lock()
+			list := s.sortedPolicies(tenantId)
+			s.mu.Unlock()
+			writeJSON(w, http.StatusOK, list)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	case strings.HasPrefix(path, PoliciesPath+"/"):
+		policyId := strings.TrimPrefix(path, PoliciesPath+"/")
+		switch r.Method {
+		case http.MethodGet:
+			s.mu.Lock()
+			p, ok := s.policies[policyId]
+			s.mu.Unlock()
+			if !ok || p.TenantId != tenantId {
+				writeError(w, http.StatusNotFound, "policy not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, p)
+		case http.MethodDelete:
+			s.mu.Lock()
+			p, ok := s.policies[policyId]
+			if ok && p.TenantId == tenantId {
+				delete(s.policies, policyId)
+			}
+			s.mu.Unlock()
+			if !ok || p.TenantId != tenantId {
+				writeError(w, http.StatusNotFound, "policy not found")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *Server) createPolicy(w http.ResponseWriter, r *http.Request, tenantId string) {
+	var p Policy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+	var missing []string
+	if strings.TrimSpace(p.Policy) == "" {
+		missing = append(missing, "policy")
+	}
+	if strings.TrimSpace(p.PolicyName) == "" {
+		missing = append(missing, "policy_name")
+	}
+	if strings.TrimSpace(p.PolicyType) == "" {
+		missing = append(missing, "policy_type")
+	}
+	if strings.TrimSpace(p.AttestationType) == "" {
+		missing = append(missing, "attestation_type")
+	}
+	if _, err := uuid.Parse(p.ServiceOfferId); err != nil {
+		missing = append(missing, "service_offer_id")
+	}
+	if len(missing) > 0 {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid or missing fields: %s", strings.Join(missing, ", ")))
+		return
+	}
+
+	s.mu.Lock()
+	for _, existing := range s.policies {
+		if existing.TenantId == tenantId && existing.PolicyName == p.PolicyName {
+			s.mu.Unlock()
+			writeError(w, http.StatusConflict, "policy name already exists")
+			return
+		}
+	}
+	p.PolicyId = uuid.NewString()
+	p.TenantId = tenantId
+	p.CreatedTime = time.Now().UTC()
+	s.policies[p.PolicyId] = p
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (s *Server) injectFailure() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.requests <= s.opts.FailFirst {
+		return true
+	}
+	return s.opts.ErrorRate > 0 && s.rnd.Float64() < s.opts.ErrorRate
+}
+
+// sortedPolicies expects s.mu to be held, an empty tenantId returns all policies
+func (s *Server) sortedPolicies(tenantId string) []Policy {
+	list := make([]Policy, 0)
+	for _, p := range s.policies {
+		if tenantId == "" || p.TenantId == tenantId {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedTime.Before(list[j].CreatedTime) })
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"message": message})
+}
@@ -0,0 +1,94 @@
+package policyserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testBody = `{"policy":"default matches_sgx_policy = true","policy_name":"p1","policy_type":"Appraisal policy",` +
+	`"attestation_type":"SGX Attestation","service_offer_id":"0b3c2f4e-5d6a-4b7c-8d9e-0f1a2b3c4d5e"}`
+
+func serve(s *Server, method, path, apiKey, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if apiKey != "" {
+		r.Header.Set("x-api-key", apiKey)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestPolicyLifecycle(t *testing.T) {
+	s := New(StaticKeys(map[string]string{"key-a": "tenant-a", "key-b": "tenant-b"}), Options{})
+
+	w := serve(s, http.MethodPost, PoliciesPath, "key-a", testBody)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body)
+	}
+	var created Policy
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil || created.PolicyId == "" {
+		t.Fatalf("got policy %+v, %v, want an id", created, err)
+	}
+	byId := PoliciesPath + "/" + created.PolicyId
+
+	tests := []struct {
+		name, method, path, apiKey, body string
+		want                             int
+	}{
+		{name: "duplicate name", method: http.MethodPost, path: PoliciesPath, apiKey: "key-a", body: testBody, want: http.StatusConflict},
+		{name: "same name of another tenant", method: http.MethodPost, path: PoliciesPath, apiKey: "key-b", body: testBody, want: http.StatusCreated},
+		{name: "missing fields", method: http.MethodPost, path: PoliciesPath, apiKey: "key-a", body: `{"policy_name":"p2"}`, want: http.StatusBadRequest},
+		{name: "invalid body", method: http.MethodPost, path: PoliciesPath, apiKey: "key-a", body: `{`, want: http.StatusBadRequest},
+		{name: "no key", method: http.MethodGet, path: PoliciesPath, want: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: PoliciesPath, apiKey: "key-c", want: http.StatusForbidden},
+		{name: "get", method: http.MethodGet, path: byId, apiKey: "key-a", want: http.StatusOK},
+		{name: "get of another tenant", method: http.MethodGet, path: byId, apiKey: "key-b", want: http.StatusNotFound},
+		{name: "delete of another tenant", method: http.MethodDelete, path: byId, apiKey: "key-b", want: http.StatusNotFound},
+		{name: "method", method: http.MethodPut, path: PoliciesPath, apiKey: "key-a", want: http.StatusMethodNotAllowed},
+		{name: "unknown path", method: http.MethodGet, path: "/management/v1/other", apiKey: "key-a", want: http.StatusNotFound},
+		{name: "delete", method: http.MethodDelete, path: byId + "/", apiKey: "key-a", want: http.StatusNoContent},
+		{name: "get deleted", method: http.MethodGet, path: byId, apiKey: "key-a", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(s, tt.method, tt.path, tt.apiKey, tt.body); w.Code != tt.want {
+				t.Errorf("got %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+
+	w = serve(s, http.MethodGet, PoliciesPath, "key-b", "")
+	var listed []Policy
+	if err := json.NewDecoder(w.Body).Decode(&listed); err != nil || len(listed) != 1 {
+		t.Errorf("got policies %+v, %v, want the one of tenant-b", listed, err)
+	}
+	if policies := s.Policies(); len(policies) != 1 || policies[0].TenantId != "tenant-b" {
+		t.Errorf("got stored policies %+v, want the one of tenant-b", policies)
+	}
+}
+
+func TestInjectedFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want []int
+	}{
+		{name: "fail first", opts: Options{FailFirst: 2}, want: []int{500, 500, 200}},
+		{name: "error status", opts: Options{FailFirst: 1, ErrorStatus: http.StatusServiceUnavailable}, want: []int{503, 200}},
+		{name: "error rate", opts: Options{ErrorRate: 1}, want: []int{500, 500}},
+		{name: "rate limit", opts: Options{RateLimit: 0.001, RateBurst: 2}, want: []int{200, 200, 429}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(AllowAll(), tt.opts)
+			for i, want := range tt.want {
+				if w := serve(s, http.MethodGet, PoliciesPath, "key", ""); w.Code != want {
+					t.Errorf("request %d: got %d, want %d", i+1, w.Code, want)
+				}
+			}
+		})
+	}
+}
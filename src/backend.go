@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"strings"
+)
+
+// NewGateway returns the api gateway backend selected in aws_conf and a function to persist its state
+func NewGateway(ctx context.Context, conf model.Config) (aws.KeyGateway, func() error, error) {
+	awsConf := conf.AwsConf
+	switch strings.ToLower(awsConf.Backend) {
+	case "", "aws":
+		cli := aws.InitAwsClient(awsConf.AccessKeyId, awsConf.SecretAccessKey, awsConf.SessionToken, awsConf.AWSRegion)
+		if cli == nil {
+			return nil, nil, fmt.Errorf("error in creating aws client")
+		}
+		return cli, func() error { return nil }, nil
+	case "memory":
+		usagePlanIds := awsConf.UsagePlanIds
+		if len(usagePlanIds) == 0 {
+			usagePlanIds = []string{conf.RequiredDetail.AttestationProductId, conf.RequiredDetail.ManagementProductId}
+		}
+		if awsConf.MemoryFile == "" {
+			return aws.NewMemoryGateway(usagePlanIds...), func() error { return nil }, nil
+		}
+		gw, err := aws.LoadMemoryGateway(awsConf.MemoryFile, usagePlanIds...)
+		if err != nil {
+			return nil, nil, err
+		}
+		logrus.Infof("Using in-memory api gateway from %s", awsConf.MemoryFile)
+		return gw, func() error { return gw.SaveFile(awsConf.MemoryFile) }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown aws backend %s", awsConf.Backend)
+	}
+}
+
+// NewStore returns the database selected in db_conf and a function to persist its state
+func NewStore(ctx context.Context, conf model.Config) (database.Store, func() error, error) {
+	switch strings.ToLower(conf.DbConf.Driver) {
+	case "", "postgres":
+		connection, err := database.GetConnection(ctx, conf.DbConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return database.NewPostgresStore(connection), func() error { return nil }, nil
+	case "memory":
+		store := database.NewMemoryStore()
+		save := func() error { return nil }
+		if conf.DbConf.MemoryFile != "" {
+			var err error
+			store, err = database.LoadMemoryStore(conf.DbConf.MemoryFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			logrus.Infof("Using in-memory database from %s", conf.DbConf.MemoryFile)
+			save = func() error { return store.SaveFile(conf.DbConf.MemoryFile) }
+		}
+		if err := seedMemoryStore(ctx, store, conf); err != nil {
+			return nil, nil, err
+		}
+		return store, save, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown database driver %s", conf.DbConf.Driver)
+	}
+}
+
+// seedMemoryStore adds the source and product rows the create flow expects to exist, product external ids are the
+// product ids themselves which is also what the in-memory gateway registers as usage plans by default
+func seedMemoryStore(ctx context.Context, store *database.MemoryStore, conf model.Config) error {
+	tSource := "Amber"
+	if conf.RequiredDetail.TenantSource != "" {
+		tSource = conf.RequiredDetail.TenantSource
+	}
+	if _, err := store.GetTenantSourceId(ctx, tSource); err != nil {
+		if err := store.AddSource(model.Source{ID: uuid.New(), Name: tSource}); err != nil {
+			return err
+		}
+	}
+	for _, productId := range []string{conf.RequiredDetail.AttestationProductId, conf.RequiredDetail.ManagementProductId} {
+		id, err := uuid.Parse(productId)
+		if err != nil {
+			return fmt.Errorf("error in parsing product id %s, %v", productId, err)
+		}
+		if extId, _ := store.GetProductExtId(ctx, id); extId != "" {
+			continue
+		}
+		if err := store.AddProduct(model.Product{ID: id, Name: "perf", ExternalId: productId}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
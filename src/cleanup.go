@@ -2,107 +2,387 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/apikey-gen/aws"
 	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
 	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"os"
+	"slices"
+	"sort"
+	"strings"
 )
 
-func CleanUp(ctx context.Context, count ...int) {
-	conf, err := model.GetConfig(ctx, "properties.toml")
-	cleanupCount := -1
-	if err != nil {
-		logrus.Errorf("error in config file %v", err)
-		return
+var (
+	//ErrAborted is returned when cleanup stopped before changing anything, by the user or a safety check
+	ErrAborted = errors.New("aborted")
+	//ErrPartialFailure is returned when some resources were deleted and others were not
+	ErrPartialFailure = errors.New("partial failure")
+)
+
+// CleanupOptions make cleanup usable without a terminal
+type CleanupOptions struct {
+	//Yes skips the prompts, Confirm must then repeat the email domain or run id being cleaned
+	Yes     bool
+	Confirm string
+	//MaxDelete aborts when more tenants would be removed, 0 means no limit
+	MaxDelete int
+	//PolicyApi deletes the policies through the policy service, with a management key of their tenant, before the
+	//gateway keys and rows are deleted
+	PolicyApi bool
+}
+
+// check aborts unless the target was confirmed and the number of tenants is under the ceiling
+func (o CleanupOptions) check(target string, tenants int) error {
+	if o.MaxDelete > 0 && tenants > o.MaxDelete {
+		return fmt.Errorf("%w: %d tenants would be deleted, more than -max-delete %d", ErrAborted, tenants, o.MaxDelete)
+	}
+	if o.Yes && o.Confirm != target {
+		return fmt.Errorf("%w: -yes requires -confirm=%s", ErrAborted, target)
 	}
+	return nil
+}
 
-	if len(count) > 0 {
-		cleanupCount = count[0]
+// CleanUpManifest removes exactly the resources recorded in the manifest of a create run
+func CleanUpManifest(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, manifest *model.Manifest, opts CleanupOptions) error {
+	if err := opts.check(manifest.RunId, len(manifest.Tenants)); err != nil {
+		return err
+	}
+	set := cleanupSet{
+		label:           fmt.Sprintf("run %s", manifest.RunId),
+		tenantIds:       manifest.TenantIds(),
+		serviceIds:      manifest.ServiceIds(),
+		subscriptionIds: manifest.SubscriptionIds(),
+		keyIds:          manifest.KeyIds(),
+		tenantPolicies:  map[uuid.UUID][]uuid.UUID{},
+	}
+	for _, t := range manifest.Tenants {
+		policyIds, err := parseUUIDs(t.PolicyIds)
+		if err != nil {
+			return fmt.Errorf("error in manifest policy ids %v", err)
+		}
+		set.policyIds = append(set.policyIds, policyIds...)
+		set.tenantPolicies[t.TenantId] = policyIds
+	}
+	// rows of the run's tenants the manifest missed, e.g. of a run killed before it rewrote the manifest, would keep
+	// their tenants from being deleted
+	resources, err := store.GetTenantResources(ctx, set.tenantIds)
+	if err != nil {
+		return fmt.Errorf("error in getting tenant resources %v", err)
 	}
+	if added := set.add(resourcesCleanupSet(set.label, resources)); added > 0 {
+		logrus.Infof("Added %d resources of the run's tenants that are not in the manifest", added)
+	}
+	return deleteCleanupSet(ctx, conf, gw, store, set, opts)
+}
 
-	/************** AWS init *******************/
-	cli := aws.InitAwsClient(conf.AwsConf.AccessKeyId, conf.AwsConf.SecretAccessKey, conf.AwsConf.SessionToken, conf.AwsConf.AWSRegion)
-	if cli == nil {
-		logrus.Errorf("error in creating aws client")
+// mergeCheckpoint adds to the manifest the keys and policies its run checkpoint still holds, those of tenants that
+// were in progress when the run was killed. There is no checkpoint once a run finished.
+func mergeCheckpoint(manifest *model.Manifest, checkpointFile string) {
+	if _, err := os.Stat(checkpointFile); err != nil {
 		return
 	}
-
-	/************** Database ******************/
-	connection, err := database.GetConnection(ctx, model.DBConf{
-		Host:     conf.DbConf.Host,
-		Port:     conf.DbConf.Port,
-		User:     conf.DbConf.User,
-		Password: conf.DbConf.Password,
-		DBName:   conf.DbConf.DBName,
-		SSLMode:  conf.DbConf.SSLMode,
-	})
+	cp, err := model.OpenCheckpoint(checkpointFile)
 	if err != nil {
+		logrus.Warnf("error in reading checkpoint %s, keys of unfinished tenants may be left, %v", checkpointFile, err)
 		return
 	}
+	defer cp.Close()
+	if cp.RunId != manifest.RunId {
+		logrus.Warnf("checkpoint %s is of run %s, not %s, ignoring it", checkpointFile, cp.RunId, manifest.RunId)
+		return
+	}
+	manifest.MergeCheckpoint(cp)
+	logrus.Infof("Added the keys and policies recorded in checkpoint %s", checkpointFile)
+}
 
-	tx := connection.Begin()
-	defer tx.Rollback()
+// CleanUpSelected removes the tenants of the email domain that sel picks, with everything they own. The tenant ids
+// are resolved once, every delete then works on that fixed set.
+func CleanUpSelected(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, sel CleanupSelector, opts CleanupOptions, count ...int) error {
+	resources, err := SelectTenants(ctx, gw, store, conf.RequiredDetail.EmailDomain, sel, count...)
+	if err != nil {
+		return err
+	}
+	if err := opts.check(conf.RequiredDetail.EmailDomain, len(resources)); err != nil {
+		return err
+	}
+	return deleteCleanupSet(ctx, conf, gw, store, resourcesCleanupSet(sel.describe(conf.RequiredDetail.EmailDomain), resources), opts)
+}
+
+// cleanupSet is a fixed set of resources to delete, resolved before anything is deleted
+type cleanupSet struct {
+	label                                             string
+	tenantIds, serviceIds, subscriptionIds, policyIds []uuid.UUID
+	keyIds                                            []string
+	//tenantPolicies are the policyIds by tenant, for deleting them through the policy service
+	tenantPolicies map[uuid.UUID][]uuid.UUID
+}
 
-	ids, err := database.GetSubscriptionIds(ctx, tx, conf.RequiredDetail.EmailDomain, cleanupCount)
+// add adds the ids of other that set does not have yet and returns how many
+func (set *cleanupSet) add(other cleanupSet) int {
+	added := 0
+	addIds := func(ids *[]uuid.UUID, more []uuid.UUID) {
+		have := make(map[uuid.UUID]bool, len(*ids))
+		for _, id := range *ids {
+			have[id] = true
+		}
+		for _, id := range more {
+			if !have[id] {
+				have[id] = true
+				*ids = append(*ids, id)
+				added++
+			}
+		}
+	}
+	addIds(&set.tenantIds, other.tenantIds)
+	addIds(&set.serviceIds, other.serviceIds)
+	addIds(&set.subscriptionIds, other.subscriptionIds)
+	addIds(&set.policyIds, other.policyIds)
+	haveKeys := make(map[string]bool, len(set.keyIds))
+	for _, id := range set.keyIds {
+		haveKeys[id] = true
+	}
+	for _, id := range other.keyIds {
+		if !haveKeys[id] {
+			haveKeys[id] = true
+			set.keyIds = append(set.keyIds, id)
+			added++
+		}
+	}
+	for tenantId, policyIds := range other.tenantPolicies {
+		for _, id := range policyIds {
+			if !slices.Contains(set.tenantPolicies[tenantId], id) {
+				set.tenantPolicies[tenantId] = append(set.tenantPolicies[tenantId], id)
+			}
+		}
+	}
+	return added
+}
+
+func resourcesCleanupSet(label string, resources []model.TenantResources) cleanupSet {
+	set := cleanupSet{label: label, tenantPolicies: map[uuid.UUID][]uuid.UUID{}}
+	for _, r := range resources {
+		set.tenantIds = append(set.tenantIds, r.TenantId)
+		set.serviceIds = append(set.serviceIds, r.ServiceIds...)
+		set.policyIds = append(set.policyIds, r.PolicyIds...)
+		set.tenantPolicies[r.TenantId] = r.PolicyIds
+		for _, s := range r.Subscriptions {
+			set.subscriptionIds = append(set.subscriptionIds, s.ID)
+			if s.ExternalId != "" {
+				set.keyIds = append(set.keyIds, s.ExternalId)
+			}
+		}
+	}
+	return set
+}
+
+// deleteCleanupSet deletes the policies of set through the policy service when asked, its gateway keys, then its rows
+// in one transaction in dependency order, and checks that no rows of its tenants are left
+func deleteCleanupSet(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, set cleanupSet, opts CleanupOptions) error {
+	logrus.Infof("Cleaning up %s: %d tenants, %d subscriptions, %d policies", set.label, len(set.tenantIds), len(set.subscriptionIds), len(set.policyIds))
+	// gateway keys and policies can not be rolled back, so this is asked before anything is deleted
+	if !opts.Yes && !confirmCleanup(set) {
+		return ErrAborted
+	}
+
+	// the management keys are needed for the policy service, so this goes before the gateway keys
+	policyFailed := 0
+	if opts.PolicyApi {
+		var err error
+		if policyFailed, err = deletePoliciesByApi(ctx, conf, gw, store, set); err != nil {
+			return err
+		}
+	}
+
+	tx, err := store.Begin(ctx)
 	if err != nil {
-		return
+		return fmt.Errorf("error in starting transaction %v", err)
 	}
+	defer tx.Rollback()
 
+	keyIds := set.keyIds
 	var ers []error
-	for _, id := range ids {
-		err = aws.CleanupApiKeys(ctx, id)
-		if err != nil {
+	for i, id := range keyIds {
+		if ctx.Err() != nil {
+			return gatewayCleanupError(i, len(ers), ctx.Err())
+		}
+		err = aws.CleanupApiKeys(ctx, gw, id)
+		if err != nil && !errors.Is(err, aws.ErrNotFound) {
 			ers = append(ers, err)
 		}
 	}
-	if len(ids) == len(ers) && len(ers) > 0 {
-		var resp string
-		fmt.Println("All delete api key calls failed, Do you want to terminate? (y/n)")
-		for {
-			_, err := fmt.Scanln(&resp)
-			if err != nil {
-				return
+	if len(keyIds) == len(ers) && len(ers) > 0 {
+		if opts.Yes {
+			return fmt.Errorf("all %d delete api key calls failed, nothing deleted from database", len(ers))
+		}
+		if confirmTerminate() {
+			return fmt.Errorf("%w: all %d delete api key calls failed", ErrAborted, len(ers))
+		}
+	}
+
+	if err = tx.DeleteSubscriptionPoliciesBySubscriptionIds(ctx, set.subscriptionIds); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), err)
+	}
+	if err = tx.DeleteSubscriptionPoliciesByTenantIds(ctx, set.tenantIds); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), err)
+	}
+	if err = tx.DeleteSubscriptionPoliciesByPolicyIds(ctx, set.policyIds); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), err)
+	}
+	if err = tx.DeleteSubscriptionsByIds(ctx, set.subscriptionIds); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), err)
+	}
+	if err = tx.DeletePoliciesByIds(ctx, set.policyIds); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), err)
+	}
+	if err = tx.DeleteServicesByIds(ctx, set.serviceIds); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), err)
+	}
+	if err = tx.DeleteTenantsByIds(ctx, set.tenantIds); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return gatewayCleanupError(len(keyIds), len(ers), fmt.Errorf("error in committing cleanup %v", err))
+	}
+	errs := []error{gatewayCleanupError(len(keyIds), len(ers), nil)}
+	if policyFailed > 0 {
+		errs = append(errs, fmt.Errorf("%w: %d of %d policies could not be deleted through the policy service, their rows were deleted", ErrPartialFailure, policyFailed, len(set.policyIds)))
+	}
+	errs = append(errs, checkCleanedUp(ctx, store, set.tenantIds))
+	return errors.Join(errs...)
+}
+
+// deletePoliciesByApi deletes the policies of set through the policy service with a management key of their tenant
+// and returns how many could not be deleted
+func deletePoliciesByApi(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, set cleanupSet) (int, error) {
+	managementProductId, err := uuid.Parse(conf.RequiredDetail.ManagementProductId)
+	if err != nil {
+		return 0, fmt.Errorf("error in parsing management product id %s, %v", conf.RequiredDetail.ManagementProductId, err)
+	}
+	resources, err := store.GetTenantResources(ctx, set.tenantIds)
+	if err != nil {
+		return 0, fmt.Errorf("error in getting tenant resources %v", err)
+	}
+	failed := 0
+	for _, r := range resources {
+		policyIds := set.tenantPolicies[r.TenantId]
+		if len(policyIds) == 0 {
+			continue
+		}
+		managementKey, err := tenantManagementKey(ctx, gw, r, managementProductId)
+		if err != nil {
+			logrus.Errorf("Error in deleting %d policies of tenant %s %v", len(policyIds), r.TenantId, err)
+			failed += len(policyIds)
+			continue
+		}
+		for _, id := range policyIds {
+			if ctx.Err() != nil {
+				return failed, ctx.Err()
 			}
-			if resp == "y" {
-				return
-			} else if resp == "n" {
-				break
+			if err := DeletePolicy(ctx, conf.PoliciesConfig.Url, managementKey, id.String()); err != nil {
+				logrus.Errorf("Error in deleting policy %s %v", id, err)
+				failed++
+				continue
 			}
+			logrus.Infof("Deleted policy %s through the policy service", id)
 		}
 	}
+	return failed, nil
+}
 
-	err = database.DeleteSubscriptions(ctx, tx, conf.RequiredDetail.EmailDomain, cleanupCount)
-	if err != nil {
-		return
+// tenantManagementKey is the full key of the first management subscription of r whose gateway key is still enabled
+func tenantManagementKey(ctx context.Context, gw aws.KeyGateway, r model.TenantResources, managementProductId uuid.UUID) (string, error) {
+	for _, s := range r.Subscriptions {
+		if s.ProductId != managementProductId || s.ExternalId == "" {
+			continue
+		}
+		key, err := gw.GetKey(ctx, s.ExternalId)
+		if err != nil || !key.Enabled || key.Value == "" {
+			continue
+		}
+		return fullkey.Encode(fullkey.Key{Version: s.Version, VariableKey: s.VariableKey, ApiKey: key.Value})
 	}
+	return "", fmt.Errorf("no management key left for tenant %s", r.TenantId)
+}
 
-	err = database.DeletePolicies(ctx, tx, conf.RequiredDetail.EmailDomain, cleanupCount)
+// checkCleanedUp fails when rows of the tenants are left after the cleanup was committed
+func checkCleanedUp(ctx context.Context, store database.Store, tenantIds []uuid.UUID) error {
+	counts, err := store.CountTenantRows(ctx, tenantIds)
 	if err != nil {
-		return
+		return fmt.Errorf("error in checking cleanup %v", err)
+	}
+	if len(counts) == 0 {
+		logrus.Infof("No rows left for the %d cleaned up tenants", len(tenantIds))
+		return nil
 	}
+	left := make([]string, 0, len(counts))
+	for table, n := range counts {
+		left = append(left, fmt.Sprintf("%d %s", n, table))
+	}
+	sort.Strings(left)
+	return fmt.Errorf("%w: rows left for the cleaned up tenants: %s", ErrPartialFailure, strings.Join(left, ", "))
+}
 
-	err = database.DeleteService(ctx, tx, conf.RequiredDetail.EmailDomain, cleanupCount)
-	if err != nil {
-		return
+// gatewayCleanupError reports a partial failure once some gateway keys are gone, since those can not be rolled back
+func gatewayCleanupError(keys, failed int, err error) error {
+	deleted := keys - failed
+	switch {
+	case err == nil && failed == 0:
+		return nil
+	case err == nil:
+		return fmt.Errorf("%w: %d of %d gateway keys could not be deleted", ErrPartialFailure, failed, keys)
+	case deleted > 0:
+		return fmt.Errorf("%w: %d gateway keys were deleted but the database was not changed, %v", ErrPartialFailure, deleted, err)
+	default:
+		return err
 	}
+}
 
-	err = database.DeleteTenants(ctx, tx, conf.RequiredDetail.EmailDomain, cleanupCount)
-	if err != nil {
-		return
+func parseUUIDs(ids []string) ([]uuid.UUID, error) {
+	uids := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		uid, err := uuid.Parse(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %s, %v", id, err)
+		}
+		uids = append(uids, uid)
 	}
+	return uids, nil
+}
 
+func confirmTerminate() bool {
 	var resp string
-	fmt.Println("Do you want to COMMIT transaction. All deleted data will can not be restored once deleted? (yes/no)")
+	fmt.Println("All delete api key calls failed, Do you want to terminate? (y/n)")
 	for {
 		_, err := fmt.Scanln(&resp)
 		if err != nil {
-			return
+			return true
+		}
+		if resp == "y" {
+			return true
+		} else if resp == "n" {
+			return false
+		}
+	}
+}
+
+func confirmCleanup(set cleanupSet) bool {
+	var resp string
+	fmt.Printf("Do you want to DELETE %d tenants, %d subscriptions, %d gateway keys and %d policies of %s. All deleted data will can not be restored once deleted? (yes/no)\n",
+		len(set.tenantIds), len(set.subscriptionIds), len(set.keyIds), len(set.policyIds), set.label)
+	for {
+		_, err := fmt.Scanln(&resp)
+		if err != nil {
+			return false
 		}
 		if resp == "yes" {
 			break
 		} else if resp == "no" {
-			return
+			return false
 		} else {
 			logrus.Info("Type yes/no")
 		}
@@ -112,16 +392,14 @@ func CleanUp(ctx context.Context, count ...int) {
 	for {
 		_, err := fmt.Scanln(&resp)
 		if err != nil {
-			return
+			return false
 		}
 		if resp == "yes" {
-			break
+			return true
 		} else if resp == "no" {
-			return
+			return false
 		} else {
 			logrus.Info("Type yes/no")
 		}
 	}
-
-	tx.Commit()
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/model"
+	"os"
+	"testing"
+)
+
+func TestCleanUpManifest(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, 2, nil)
+
+	if err := Create(ctx, e.conf, e.gw, e.store); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	removed := e.manifests(t)[0]
+	if err := Create(ctx, e.conf, e.gw, e.store); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	var kept *model.Manifest
+	for _, m := range e.manifests(t) {
+		if m.RunId != removed.RunId {
+			kept = m
+		}
+	}
+
+	if err := CleanUpManifest(ctx, e.conf, e.gw, e.store, removed, CleanupOptions{Yes: true, Confirm: removed.RunId}); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+
+	for table, n := range e.rows(t, removed.TenantIds()) {
+		if n != 0 {
+			t.Errorf("got %d %s rows of the cleaned up run, want 0", n, table)
+		}
+	}
+	if keys := e.keys(t, aws.TagRunId, removed.RunId); len(keys) != 0 {
+		t.Errorf("got %d gateway keys of the cleaned up run, want 0", len(keys))
+	}
+	if rows := e.rows(t, kept.TenantIds()); rows["tenant"] != 2 || rows["subscription"] != 6 {
+		t.Errorf("got rows %v of the other run, want 2 tenants and 6 subscriptions", rows)
+	}
+	if keys := e.keys(t, aws.TagRunId, kept.RunId); len(keys) != 6 {
+		t.Errorf("got %d gateway keys of the other run, want 6", len(keys))
+	}
+}
+
+// withStdin answers the prompts of fn with input
+func withStdin(t *testing.T, input string, fn func()) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := w.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	fn()
+}
+
+func TestCleanupConfirmation(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, 2, nil)
+	if err := Create(ctx, e.conf, e.gw, e.store); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	manifest := e.manifests(t)[0]
+
+	tests := []struct {
+		name  string
+		opts  CleanupOptions
+		stdin string
+	}{
+		{name: "declined prompt", stdin: "no\n"},
+		{name: "declined reconfirmation", stdin: "yes\nno\n"},
+		{name: "closed stdin"},
+		{name: "confirmed with another target", opts: CleanupOptions{Yes: true, Confirm: "run-other"}},
+		{name: "yes without confirm", opts: CleanupOptions{Yes: true}},
+		{name: "over max delete", opts: CleanupOptions{Yes: true, Confirm: manifest.RunId, MaxDelete: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			withStdin(t, tt.stdin, func() {
+				err = CleanUpManifest(ctx, e.conf, e.gw, e.store, manifest, tt.opts)
+			})
+			if !errors.Is(err, ErrAborted) {
+				t.Fatalf("got %v, want %v", err, ErrAborted)
+			}
+			// nothing may be deleted before the cleanup is confirmed
+			if keys := e.keys(t, aws.TagRunId, manifest.RunId); len(keys) != 6 {
+				t.Errorf("got %d gateway keys, want 6", len(keys))
+			}
+			if rows := e.rows(t, manifest.TenantIds()); rows["tenant"] != 2 || rows["subscription"] != 6 {
+				t.Errorf("got rows %v, want 2 tenants and 6 subscriptions", rows)
+			}
+			if policies := e.policies.Policies(); len(policies) != 4 {
+				t.Errorf("got %d policies, want 4", len(policies))
+			}
+		})
+	}
+
+	withStdin(t, "yes\nyes\n", func() {
+		if err := CleanUpManifest(ctx, e.conf, e.gw, e.store, manifest, CleanupOptions{PolicyApi: true}); err != nil {
+			t.Fatalf("confirmed cleanup: %v", err)
+		}
+	})
+	if rows := e.rows(t, manifest.TenantIds()); len(rows) != 0 {
+		t.Errorf("got rows %v after the confirmed cleanup, want none", rows)
+	}
+	if policies := e.policies.Policies(); len(policies) != 0 {
+		t.Errorf("got %d policies after the confirmed cleanup, want 0", len(policies))
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/apikey-gen/aws"
 	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
 	"github.com/apikey-gen/model"
+	"github.com/apikey-gen/throttle"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
@@ -19,118 +21,193 @@ import (
 	"time"
 )
 
+const (
+	policyCreateAttempts = 5
+	policyRetryInterval  = 500 * time.Millisecond
+)
+
 type Tenant struct {
 	ID        uuid.UUID `json:"id"`
 	ServiceId uuid.UUID `json:"service_id"`
 }
 
-func CreateTenant(ctx context.Context, tenantsCount int, tx *gorm.DB, emailDomain string, serviceOfferId, planId, serviceOfferPlanSourceId, sourceId uuid.UUID) ([]Tenant, error) {
-	var tenantsId []Tenant
+// NewTenants picks the ids of the tenants of a run, their rows are written when their keys are created
+func NewTenants(tenantsCount int) []Tenant {
+	tenants := make([]Tenant, 0, tenantsCount)
 	for i := 0; i < tenantsCount; i++ {
-		tenantId := uuid.New()
-		serviceId := uuid.New()
-		err := database.MakeTenantEntry(ctx, tx, &model.Tenant{
-			ID:       tenantId,
-			Name:     fmt.Sprintf("TestName_%s", tenantId),
-			Company:  fmt.Sprintf("TestCompany_%s", tenantId),
-			Email:    fmt.Sprintf("%s@%s", uuid.NewString(), emailDomain),
-			Address:  "address",
-			SourceId: sourceId,
-		})
-		if err != nil {
-			return nil, err
-		}
+		tenants = append(tenants, Tenant{ID: uuid.New(), ServiceId: uuid.New()})
+	}
+	return tenants
+}
 
-		err = database.MakeServiceEntry(ctx, tx, &model.Service{
-			ID:                       serviceId,
-			TenantId:                 tenantId,
-			ServiceOfferId:           serviceOfferId,
-			Name:                     "TEE_Attestation",
-			CreatedAt:                time.Now(),
-			UpdatedAt:                time.Now(),
-			CreatedBy:                uuid.UUID{},
-			UpdatedBy:                uuid.UUID{},
-			CreatorType:              "User",
-			UpdaterType:              "User",
-			ExternalId:               uuid.UUID{},
-			PlanId:                   planId,
-			Active:                   true,
-			Status:                   "Active",
-			ServiceOfferPlanSourceId: serviceOfferPlanSourceId,
-		})
-		if err != nil {
-			return nil, err
-		}
-		tenantsId = append(tenantsId, Tenant{
-			ID:        tenantId,
-			ServiceId: serviceId,
-		})
+// MakeTenant writes the tenant and service rows of t
+func MakeTenant(ctx context.Context, tx database.Store, t Tenant, emailDomain string, serviceOfferId, planId, serviceOfferPlanSourceId, sourceId uuid.UUID) error {
+	err := tx.MakeTenantEntry(ctx, &model.Tenant{
+		ID:        t.ID,
+		Name:      fmt.Sprintf("TestName_%s", t.ID),
+		Company:   fmt.Sprintf("TestCompany_%s", t.ID),
+		Email:     fmt.Sprintf("%s@%s", uuid.NewString(), emailDomain),
+		Address:   "address",
+		SourceId:  sourceId,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
 	}
-	return tenantsId, nil
+
+	return tx.MakeServiceEntry(ctx, &model.Service{
+		ID:                       t.ServiceId,
+		TenantId:                 t.ID,
+		ServiceOfferId:           serviceOfferId,
+		Name:                     "TEE_Attestation",
+		CreatedAt:                time.Now(),
+		UpdatedAt:                time.Now(),
+		CreatedBy:                uuid.UUID{},
+		UpdatedBy:                uuid.UUID{},
+		CreatorType:              "User",
+		UpdaterType:              "User",
+		ExternalId:               uuid.UUID{},
+		PlanId:                   planId,
+		Active:                   true,
+		Status:                   "Active",
+		ServiceOfferPlanSourceId: serviceOfferPlanSourceId,
+	})
+}
+
+// Stages of creating the keys of a tenant, reported in the outcome file
+const (
+	StageTenant         = "tenant"
+	StageManagementKey  = "management key"
+	StageReadiness      = "readiness"
+	StagePolicy         = "policy"
+	StageAttestationKey = "attestation key"
+	StageCommit         = "commit"
+	//StageAllOrNothing marks tenants removed because another tenant of an all_or_nothing run failed
+	StageAllOrNothing = "all or nothing"
+)
+
+// StageError is an error of CreateAPIKey with the stage it happened in
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
 }
 
-func CreateAPIKey(ctx context.Context, attestationKeysPerTenant, managementKeysPerTenant, policiesCount int, tx *gorm.DB, tenantId, attestationProductId, managementProductId,
-	serviceId uuid.UUID, attProductExtId, mgmtProductExtId, email string) ([]model.ApiKeyModel, error) {
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// CreateAPIKey creates the keys and policies of a tenant, recording each in checkpoint when it is not nil.
+//
+// The rows are written in two transactions. The first one runs bootstrap, to write the tenant and service, and holds
+// the management subscriptions; it is committed before any policy is created because the policy api authenticates
+// the management key against them. The second one holds the attestation subscriptions and their subscription_policy
+// rows and is committed once every gateway key and policy exists. Undo steps delete through store, so they also
+// remove committed rows. On error CreateAPIKey returns what was created before the failing stage together with a
+// *StageError.
+func CreateAPIKey(ctx context.Context, gw aws.KeyGateway, probe *ReadinessProbe, undo *UndoLog, checkpoint *model.Checkpoint, attestationKeysPerTenant, managementKeysPerTenant int, policiesConf model.PoliciesConfig, policyLimiter *throttle.Limiter, store database.Store,
+	bootstrap func(tx database.Store) error, tenantId, attestationProductId, managementProductId, serviceId uuid.UUID, attProductExtId, mgmtProductExtId string, tags map[string]string) ([]model.ApiKeyModel, []string, error) {
 	var apiKeyModels []model.ApiKeyModel
+	var policyIds []string
+	policiesCount := policiesConf.PolicyCount
 
-	conf, err := model.GetConfig(context.Background(), "properties.toml")
+	boot, err := store.Begin(ctx)
 	if err != nil {
-		panic(err)
+		return apiKeyModels, policyIds, &StageError{Stage: StageTenant, Err: err}
+	}
+	defer boot.Rollback()
+	if err := bootstrap(boot); err != nil {
+		return apiKeyModels, policyIds, &StageError{Stage: StageTenant, Err: err}
 	}
 
 	for i := 0; i < managementKeysPerTenant; i++ {
-		apiKeyInfo, err := createApiKey(ctx, tx, managementProductId, serviceId, tenantId, mgmtProductExtId, email, nil)
+		apiKeyInfo, err := createApiKey(ctx, gw, undo, store, boot, managementProductId, serviceId, tenantId, mgmtProductExtId, tags, nil)
 		if err != nil {
-			return nil, err
+			return apiKeyModels, policyIds, &StageError{Stage: StageManagementKey, Err: err}
 		}
 		apiKeyInfo.KeyType = "management"
 		apiKeyModels = append(apiKeyModels, apiKeyInfo)
+		checkpointed(checkpoint.KeyCreated(tenantId, apiKeyInfo))
+	}
+	if err := boot.Commit(); err != nil {
+		return apiKeyModels, policyIds, &StageError{Stage: StageManagementKey, Err: fmt.Errorf("error in committing tenant %v", err)}
 	}
 
-	timeToSleep := 120 * time.Second
-	logrus.Infof("Sleeping for %v minutes to set management api keys", timeToSleep)
-	time.Sleep(timeToSleep)
+	if _, err := probe.Wait(ctx, apiKeyModels[0].FullKey); err != nil {
+		return apiKeyModels, policyIds, &StageError{Stage: StageReadiness, Err: err}
+	}
 
-	var policyIds []string
 	//Create policy
 
 	for i := 0; i < policiesCount; i++ {
-		policyId, err := CreatePolicy(ctx, conf.PoliciesConfig.Url, apiKeyModels[0].FullKey)
+		policyId, err := CreatePolicy(ctx, policiesConf, policyLimiter, apiKeyModels[0].FullKey)
 		if err != nil {
-			return nil, err
+			return apiKeyModels, policyIds, &StageError{Stage: StagePolicy, Err: err}
 		}
+		managementKey := apiKeyModels[0].FullKey
+		undo.Add(fmt.Sprintf("policy %s", policyId), func(ctx context.Context) error {
+			return DeletePolicy(ctx, policiesConf.Url, managementKey, policyId)
+		})
 		policyIds = append(policyIds, policyId)
+		checkpointed(checkpoint.PolicyCreated(tenantId, policyId))
 	}
 
+	tx, err := store.Begin(ctx)
+	if err != nil {
+		return apiKeyModels, policyIds, &StageError{Stage: StageAttestationKey, Err: err}
+	}
+	defer tx.Rollback()
 	for i := 0; i < attestationKeysPerTenant; i++ {
 		rPoliciesCount := randRange(0, policiesCount)
 		randomPolicyIds := policyIds[0:rPoliciesCount]
-		apiKeyInfo, err := createApiKey(ctx, tx, attestationProductId, serviceId, tenantId, attProductExtId, email, randomPolicyIds)
+		apiKeyInfo, err := createApiKey(ctx, gw, undo, store, tx, attestationProductId, serviceId, tenantId, attProductExtId, tags, randomPolicyIds)
 		if err != nil {
-			return nil, err
+			return apiKeyModels, policyIds, &StageError{Stage: StageAttestationKey, Err: err}
 		}
 		logrus.Infof("Policy id [%s], for api key id [%s]", strings.Join(randomPolicyIds, " , "), apiKeyInfo.ID.String())
 		apiKeyInfo.KeyType = "attestation"
-		apiKeyInfo.PolicyId = strings.Join(randomPolicyIds, " | ")
 		apiKeyModels = append(apiKeyModels, apiKeyInfo)
+		checkpointed(checkpoint.KeyCreated(tenantId, apiKeyInfo))
+	}
+	if err := tx.Commit(); err != nil {
+		return apiKeyModels, policyIds, &StageError{Stage: StageCommit, Err: fmt.Errorf("error in committing subscriptions %v", err)}
 	}
 
-	return apiKeyModels, nil
+	return apiKeyModels, policyIds, nil
+}
+
+// checkpointed logs a failed checkpoint write, the run goes on but can not be resumed exactly
+func checkpointed(err error) {
+	if err != nil {
+		logrus.Warnf("error in writing checkpoint %v", err)
+	}
 }
 
 func randRange(min, max int) int {
+	if max <= min {
+		return min
+	}
 	return rand.Intn(max-min) + min
 }
 
-func createApiKey(ctx context.Context, tx *gorm.DB, productId, serviceId, tenantId uuid.UUID, prdExtId, email string, policyIds []string) (model.ApiKeyModel, error) {
+func createApiKey(ctx context.Context, gw aws.KeyGateway, undo *UndoLog, store, tx database.Store, productId, serviceId, tenantId uuid.UUID, prdExtId string, tags map[string]string, policyIds []string) (model.ApiKeyModel, error) {
 	apiKey := uuid.New()
 	variableKey := uuid.NewString()
 	name := fmt.Sprintf("ApiKey_Perf_%s", uuid.NewString())
-	keyExtId, keyValue, err := aws.CreateApiKey(ctx, name, apiKey.String(), prdExtId, email)
+	keyExtId, keyValue, err := aws.CreateApiKey(ctx, gw, name, apiKey.String(), prdExtId, tags)
 	if err != nil {
 		return model.ApiKeyModel{}, err
 	}
-	err = database.MakeSubscriptionEntry(ctx, tx, &model.Subscription{
+	undo.Add(fmt.Sprintf("gateway key %s", keyExtId), func(ctx context.Context) error {
+		return ignoreNotFound(gw.DeleteKey(ctx, keyExtId))
+	})
+	undo.Add(fmt.Sprintf("usage plan %s binding of gateway key %s", prdExtId, keyExtId), func(ctx context.Context) error {
+		return ignoreNotFound(gw.DetachFromUsagePlan(ctx, keyExtId, prdExtId))
+	})
+	err = tx.MakeSubscriptionEntry(ctx, &model.Subscription{
 		ID:          apiKey,
 		ServiceId:   serviceId,
 		ProductId:   productId,
@@ -144,19 +221,29 @@ func createApiKey(ctx context.Context, tx *gorm.DB, productId, serviceId, tenant
 		CreatorType: "User",
 		UpdaterType: "User",
 		ExternalId:  keyExtId,
-		Version:     "v1",
+		Version:     fullkey.V1,
 		VariableKey: variableKey,
 		DeletedAt:   gorm.DeletedAt{},
 	})
 	if err != nil {
 		return model.ApiKeyModel{}, err
 	}
+	undo.Add(fmt.Sprintf("subscription %s", apiKey), func(ctx context.Context) error {
+		if err := store.DeleteSubscriptionPoliciesBySubscriptionIds(ctx, []uuid.UUID{apiKey}); err != nil {
+			return err
+		}
+		return store.DeleteSubscriptionsByIds(ctx, []uuid.UUID{apiKey})
+	})
 
 	for _, policyId := range policyIds {
-		err = database.MakeSubscriptionPolicyEntry(ctx, tx, &model.SubscriptionPolicy{
+		pUid, err := uuid.Parse(policyId)
+		if err != nil {
+			return model.ApiKeyModel{}, fmt.Errorf("error in parsing policy id %s, %v", policyId, err)
+		}
+		err = tx.MakeSubscriptionPolicyEntry(ctx, &model.SubscriptionPolicy{
 			TenantId:       tenantId,
 			SubscriptionId: apiKey,
-			PolicyId:       uuid.MustParse(policyId),
+			PolicyId:       pUid,
 			CreatedAt:      time.Now(),
 			UpdatedAt:      time.Now(),
 			CreatedBy:      uuid.UUID{},
@@ -168,63 +255,135 @@ func createApiKey(ctx context.Context, tx *gorm.DB, productId, serviceId, tenant
 		}
 	}
 
+	fullKey, err := fullkey.New(variableKey, keyValue)
+	if err != nil {
+		return model.ApiKeyModel{}, err
+	}
 	apiKeyInfo := model.ApiKeyModel{
 		TenantId:    tenantId,
+		ServiceId:   serviceId,
 		ID:          apiKey,
 		VariableKey: variableKey,
 		ApiKey:      keyValue,
-		Version:     "v1",
+		KeyId:       keyExtId,
+		Version:     fullkey.V1,
+		FullKey:     fullKey,
+		ProductId:   productId,
+		PolicyIds:   append([]string{}, policyIds...),
 	}
-
-	apiKeyInfo.FullKey = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s:%s", apiKeyInfo.Version, apiKeyInfo.VariableKey, apiKeyInfo.ApiKey)))
 	return apiKeyInfo, nil
 }
 
-func CreatePolicy(ctx context.Context, url, managementKey string) (policyId string, err error) {
-	conf, err := model.GetConfig(ctx, "properties.toml")
-	if err != nil {
-		logrus.Errorf("error in config file %v", err)
-		return
-	}
-
+// CreatePolicy posts a policy, waiting on limiter before every attempt and retrying while the policy api answers 429
+func CreatePolicy(ctx context.Context, conf model.PoliciesConfig, limiter *throttle.Limiter, managementKey string) (policyId string, err error) {
 	rStr := fmt.Sprintf("%d", randRange(1000000, 9999999))
 	policy := model.PolicyModel{
-		PolicyName:      strings.ReplaceAll(conf.PoliciesConfig.PolicyName, "{count_ext}", rStr),
-		PolicyType:      conf.PoliciesConfig.PolicyType,
-		AttestationType: conf.PoliciesConfig.AttestationType,
-		ServiceOfferId:  conf.PoliciesConfig.ServiceOfferId,
+		PolicyName:      strings.ReplaceAll(conf.PolicyName, "{count_ext}", rStr),
+		PolicyType:      conf.PolicyType,
+		AttestationType: conf.AttestationType,
+		ServiceOfferId:  conf.ServiceOfferId,
 	}
 
-	policy.Policy = strings.ReplaceAll(conf.PoliciesConfig.Policy, "{count_ext}", rStr)
+	policy.Policy = strings.ReplaceAll(conf.Policy, "{count_ext}", rStr)
 	postBody, err := json.Marshal(policy)
-	responseBody := bytes.NewBuffer(postBody)
-	req, err := http.NewRequest("POST", url, responseBody)
 	if err != nil {
 		return "", err
 	}
+
+	var resp *http.Response
+	var op []byte
+	backoff := policyRetryInterval
+	for attempt := 1; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return "", err
+		}
+		resp, op, err = postPolicy(ctx, conf.Url, managementKey, postBody)
+		if err != nil {
+			logrus.Errorf("Error in create policy %v", err)
+			return "", err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+		limiter.Throttled()
+		if attempt == policyCreateAttempts {
+			break
+		}
+		logrus.Warnf("Create policy throttled, retrying in %v", backoff)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		logrus.Errorf("Error in create poicy, status code %s, [%s]", resp.Status, op)
+		return "", fmt.Errorf("create policy failed with status %s", resp.Status)
+	}
+
+	mp := map[string]interface{}{}
+	err = json.Unmarshal(op, &mp)
+	if err != nil {
+		return "", err
+	}
+
+	policyId, ok := mp["policy_id"].(string)
+	if !ok {
+		return "", fmt.Errorf("policy_id missing in create policy response [%s]", op)
+	}
+	return policyId, nil
+}
+
+func postPolicy(ctx context.Context, url, managementKey string, postBody []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(postBody))
+	if err != nil {
+		return nil, nil, err
+	}
 	req.Header.Set("x-api-key", managementKey)
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer resp.Body.Close()
 	op, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("Output %s", op)
+		return nil, nil, err
 	}
+	return resp, op, nil
+}
 
-	mp := map[string]interface{}{}
-
-	if err != nil || resp.StatusCode != 201 {
-		logrus.Errorf("Error in create poicy %v, status code %s, [%s]", err, resp.Status, op)
-		return "", err
+func DeletePolicy(ctx context.Context, url, managementKey, policyId string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, strings.TrimSuffix(url, "/")+"/"+policyId, nil)
+	if err != nil {
+		return err
 	}
-
-	err = json.Unmarshal(op, &mp)
+	req.Header.Set("x-api-key", managementKey)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer resp.Body.Close()
+	op, _ := io.ReadAll(resp.Body)
 
-	return mp["policy_id"].(string), nil
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("delete policy %s failed with status %s [%s]", policyId, resp.Status, op)
+	}
+	return nil
+}
+
+func ignoreNotFound(err error) error {
+	if errors.Is(err, aws.ErrNotFound) {
+		return nil
+	}
+	return err
 }
 
 func init() {
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/crypt"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const programName = "api-key-gen"
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+func commands() []command {
+	return []command{
+		{"create", "create [flags]", "Create tenants, services, API keys and policies, then write the run manifest and report.", runCreate},
+		{"cleanup", "cleanup [flags] <all | number of tenants | run manifest.json>", "Delete tenants of the email domain, or exactly the resources of one run, from the database and API Gateway.", runCleanup},
+		{"reconcile", "reconcile [flags]", "Find API Gateway keys without a subscription and subscriptions without a gateway key, and optionally repair them.", runReconcile},
+		{"list", "list [flags]", "List the tenants of the email domain, or of one run, with their services, subscriptions and policies.", runList},
+		{"verify", "verify [flags] <run manifest.json | report>", "Check every key of a run: its subscription, subscription policies, API Gateway key and usage plan, and optionally a probe request.", runVerify},
+		{"decode", "decode [flags] <full key | report>...", "Print the version, variable key and api key of full keys, offline.", runDecode},
+		{"inspect", "inspect [flags] <full key | report>...", "Decode full keys and check them against their subscription, found by variable key, and API Gateway key.", runInspect},
+		{"doctor", "doctor [flags]", "Check the config, database, API Gateway and policy API before a run.", runDoctor},
+		{"report", "report <run manifest.json> | report decrypt [flags] <report.age>", "Print a summary of a run from its manifest, or decrypt an encrypted report.", runReport},
+		{"export", "export [flags] <report>", "Write the keys of a json, jsonl, yaml or csv report as k6, JMeter, Locust or Vegeta data files.", runExport},
+		{"config", "config validate [flags]", "Check every config value, with environment and command line overrides applied, and list all problems.", runConfig},
+		{"mock-policy-server", "mock-policy-server [flags]", "Serve a local mock of the policy management API.", RunMockPolicyServer},
+		{"help", "help [command]", "Show help for a command.", runHelp},
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands() {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// runCommand dispatches args[0] to its command
+func runCommand(ctx context.Context, args []string) error {
+	c, ok := findCommand(args[0])
+	if !ok {
+		printUsage()
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+	err := c.run(ctx, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", programName)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, c := range commands() {
+		fmt.Fprintf(w, "  %s\t%s\n", c.name, c.description)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nRun '%s help <command>' for the flags of a command. Without a command the legacy -cleanup/-dry-run flags are used.\n", programName)
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	c, _ := findCommand(name)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n\n%s\n\nFlags:\n", programName, c.usage, c.description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runHelp(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		printUsage()
+		return nil
+	}
+	c, ok := findCommand(args[0])
+	if !ok {
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+	return c.run(ctx, []string{"-help"})
+}
+
+// configFlags are the --config flag and the config values that can be overridden on the command line
+type configFlags struct {
+	fs           *flag.FlagSet
+	file         string
+	emailDomain  string
+	maintainer   string
+	tenants      int
+	attKeys      int
+	mgmtKeys     int
+	policies     int
+	allOrNothing bool
+	//sizes is set when the overrides of the run size are registered
+	sizes bool
+}
+
+// addConfigFlags registers --config and --email-domain, and with sizes the overrides for the run size
+func addConfigFlags(fs *flag.FlagSet, sizes bool) *configFlags {
+	c := &configFlags{fs: fs, sizes: sizes}
+	fs.StringVar(&c.file, "config", defaultConfigFile(), "config file, defaults to $"+model.EnvPrefix+"_CONFIG or properties.toml")
+	fs.StringVar(&c.emailDomain, "email-domain", "", "override email_domain")
+	if sizes {
+		fs.StringVar(&c.maintainer, "maintainer", "", "override maintainer_email")
+		fs.IntVar(&c.tenants, "tenants", 0, "override tenants_count")
+		fs.IntVar(&c.attKeys, "att-keys", 0, "override att_keys_per_tenant")
+		fs.IntVar(&c.mgmtKeys, "mgmt-keys", 0, "override mgmt_key_per_tenant")
+		fs.IntVar(&c.policies, "policies", 0, "override policies_per_tennant")
+		fs.BoolVar(&c.allOrNothing, "all-or-nothing", false, "override all_or_nothing")
+	}
+	return c
+}
+
+func defaultConfigFile() string {
+	if f := os.Getenv(model.EnvPrefix + "_CONFIG"); f != "" {
+		return f
+	}
+	return "properties.toml"
+}
+
+// load reads and validates the config file with the environment and command line overrides applied
+func (c *configFlags) load(ctx context.Context) (model.Config, error) {
+	conf, err := c.loadUnchecked(ctx)
+	if err != nil {
+		return model.Config{}, err
+	}
+	if err := conf.Validate(); err != nil {
+		return model.Config{}, fmt.Errorf("invalid config %s, run '%s config validate' for details:\n%v", c.file, programName, err)
+	}
+	return conf, nil
+}
+
+func (c *configFlags) loadUnchecked(ctx context.Context) (model.Config, error) {
+	conf, err := model.GetConfig(ctx, c.file)
+	if err != nil {
+		return model.Config{}, fmt.Errorf("error in config file %s, %v", c.file, err)
+	}
+	c.fs.Visit(func(f *flag.Flag) {
+		if !c.sizes && f.Name != "email-domain" {
+			// the other names are then flags of the command itself, like the cleanup -maintainer selector
+			return
+		}
+		switch f.Name {
+		case "email-domain":
+			conf.RequiredDetail.EmailDomain = c.emailDomain
+		case "maintainer":
+			conf.RequiredDetail.MaintainerEmail = c.maintainer
+		case "tenants":
+			conf.RequiredDetail.TenantsCount = c.tenants
+		case "att-keys":
+			conf.RequiredDetail.AttKeyPerTenant = c.attKeys
+		case "mgmt-keys":
+			conf.RequiredDetail.MagtKeyPerTenant = c.mgmtKeys
+		case "policies":
+			conf.PoliciesConfig.PolicyCount = c.policies
+		case "all-or-nothing":
+			conf.RequiredDetail.AllOrNothing = c.allOrNothing
+		}
+	})
+	return conf, nil
+}
+
+// openBackends returns the gateway and store selected in conf and a function that saves their state
+func openBackends(ctx context.Context, conf model.Config) (aws.KeyGateway, database.Store, func() error, error) {
+	gw, saveGateway, err := NewGateway(ctx, conf)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error in creating api gateway backend %v", err)
+	}
+	store, saveStore, err := NewStore(ctx, conf)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error in connecting database %v", err)
+	}
+	save := func() error {
+		if err := saveGateway(); err != nil {
+			return fmt.Errorf("error in saving api gateway state %v", err)
+		}
+		if err := saveStore(); err != nil {
+			return fmt.Errorf("error in saving database state %v", err)
+		}
+		return nil
+	}
+	return gw, store, save, nil
+}
+
+// withBackends loads the config, opens the backends for fn and saves their state afterwards
+func withBackends(ctx context.Context, cf *configFlags, fn func(conf model.Config, gw aws.KeyGateway, store database.Store) error) error {
+	conf, err := cf.load(ctx)
+	if err != nil {
+		return err
+	}
+	gw, store, save, err := openBackends(ctx, conf)
+	if err != nil {
+		return err
+	}
+	err = fn(conf, gw, store)
+	if serr := save(); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+func runCreate(ctx context.Context, args []string) error {
+	fs := newFlagSet("create")
+	cf := addConfigFlags(fs, true)
+	dryRun := fs.Bool("dry-run", false, "print what would be created without changing anything")
+	retry := fs.String("retry", "", "create keys and policies again for the failed tenants of this outcome file")
+	resume := fs.String("resume", "", "finish an interrupted run, by run id or checkpoint file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	if *retry != "" && *resume != "" {
+		return fmt.Errorf("-retry and -resume can not be used together, resume the run first")
+	}
+	return withBackends(ctx, cf, func(conf model.Config, gw aws.KeyGateway, store database.Store) error {
+		if *dryRun {
+			PlanCreate(ctx, conf, store)
+			return nil
+		}
+		if *retry != "" {
+			return Retry(ctx, conf, gw, store, *retry)
+		}
+		if *resume != "" {
+			return Resume(ctx, conf, gw, store, *resume)
+		}
+		return Create(ctx, conf, gw, store)
+	})
+}
+
+func runCleanup(ctx context.Context, args []string) error {
+	fs := newFlagSet("cleanup")
+	cf := addConfigFlags(fs, false)
+	dryRun := fs.Bool("dry-run", false, "print what would be deleted without changing anything")
+	opts := addCleanupFlags(fs)
+	sel := addSelectorFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("cleanup needs exactly one target")
+	}
+	return withBackends(ctx, cf, func(conf model.Config, gw aws.KeyGateway, store database.Store) error {
+		return cleanupTarget(ctx, conf, gw, store, fs.Arg(0), *dryRun, *opts, *sel)
+	})
+}
+
+func addCleanupFlags(fs *flag.FlagSet) *CleanupOptions {
+	opts := &CleanupOptions{}
+	fs.BoolVar(&opts.Yes, "yes", false, "cleanup without prompting, requires -confirm")
+	fs.StringVar(&opts.Confirm, "confirm", "", "email domain, or run id for a manifest, being cleaned up; must match for -yes")
+	fs.IntVar(&opts.MaxDelete, "max-delete", 0, "abort cleanup if more tenants would be deleted, 0 for no limit")
+	fs.BoolVar(&opts.PolicyApi, "policy-api", false, "delete policies through the policy service with a management key of their tenant before deleting the rows")
+	return opts
+}
+
+// cleanupTarget runs or plans the cleanup of all tenants, a number of tenants or a run manifest; sel narrows the
+// first two
+func cleanupTarget(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, target string, dryRun bool, opts CleanupOptions, sel CleanupSelector) error {
+	limiters := NewLimiters(conf.Limits)
+	gw = limiters.Gateway(gw)
+	defer limiters.LogSummary()
+
+	if strings.HasSuffix(strings.ToLower(target), ".json") {
+		if sel.IsSet() {
+			return fmt.Errorf("selectors do not apply to a run manifest, use -run-id to select a run by its key tags")
+		}
+		manifest, err := model.ReadManifest(target)
+		if err != nil {
+			return fmt.Errorf("error in reading manifest %s, %v", target, err)
+		}
+		mergeCheckpoint(manifest, CheckpointFileName(target))
+		if dryRun {
+			PlanCleanUpManifest(ctx, store, manifest)
+			return nil
+		}
+		return CleanUpManifest(ctx, conf, gw, store, manifest, opts)
+	}
+	var count []int
+	if strings.ToLower(target) != "all" {
+		n, err := strconv.Atoi(target)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid count %s", target)
+		}
+		count = append(count, n)
+	}
+	if dryRun {
+		PlanCleanUpSelected(ctx, conf, gw, store, sel, count...)
+		return nil
+	}
+	return CleanUpSelected(ctx, conf, gw, store, sel, opts, count...)
+}
+
+func runReconcile(ctx context.Context, args []string) error {
+	fs := newFlagSet("reconcile")
+	cf := addConfigFlags(fs, false)
+	opts := &ReconcileOptions{}
+	fs.DurationVar(&opts.MinAge, "min-age", time.Hour, "leave out keys and subscriptions younger than this, they may belong to a running create")
+	fs.BoolVar(&opts.DeleteKeys, "delete-keys", false, "delete orphan gateway keys")
+	fs.StringVar(&opts.Subscriptions, "subscriptions", "", "repair dangling subscriptions: mark (status "+orphanedStatus+") or delete")
+	fs.BoolVar(&opts.Yes, "yes", false, "repair without prompting, requires -confirm")
+	fs.StringVar(&opts.Confirm, "confirm", "", "email domain being reconciled; must match for -yes")
+	fs.IntVar(&opts.MaxRepair, "max-repair", 0, "abort if more keys and subscriptions would be repaired, 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if opts.Subscriptions != "" && opts.Subscriptions != "mark" && opts.Subscriptions != "delete" {
+		return fmt.Errorf("-subscriptions must be mark or delete, got %q", opts.Subscriptions)
+	}
+	return withBackends(ctx, cf, func(conf model.Config, gw aws.KeyGateway, store database.Store) error {
+		limiters := NewLimiters(conf.Limits)
+		gw = limiters.Gateway(gw)
+		defer limiters.LogSummary()
+
+		emailDomain := conf.RequiredDetail.EmailDomain
+		orphans, err := FindOrphans(ctx, gw, store, emailDomain, opts.MinAge)
+		if err != nil {
+			return err
+		}
+		if err := printOrphans(os.Stdout, orphans, opts.MinAge); err != nil {
+			return err
+		}
+		if !opts.DeleteKeys && opts.Subscriptions == "" {
+			return nil
+		}
+		return RepairOrphans(ctx, gw, store, emailDomain, orphans, *opts)
+	})
+}
+
+func runList(ctx context.Context, args []string) error {
+	fs := newFlagSet("list")
+	cf := addConfigFlags(fs, false)
+	limit := fs.Int("limit", 0, "list at most this many tenants, 0 for all")
+	run := fs.String("run", "", "list the tenants of this run manifest instead of the email domain")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return withBackends(ctx, cf, func(conf model.Config, gw aws.KeyGateway, store database.Store) error {
+		var tenantIds []uuid.UUID
+		title := fmt.Sprintf("Tenants with email domain %s", conf.RequiredDetail.EmailDomain)
+		if *run != "" {
+			manifest, err := model.ReadManifest(*run)
+			if err != nil {
+				return fmt.Errorf("error in reading manifest %s, %v", *run, err)
+			}
+			tenantIds = manifest.TenantIds()
+			if *limit > 0 && len(tenantIds) > *limit {
+				tenantIds = tenantIds[:*limit]
+			}
+			title = fmt.Sprintf("Tenants of run %s", manifest.RunId)
+		} else {
+			ids, err := store.SelectTenantIds(ctx, database.TenantSelector{EmailDomain: conf.RequiredDetail.EmailDomain, Limit: *limit})
+			if err != nil {
+				return fmt.Errorf("error in selecting tenants %v", err)
+			}
+			tenantIds = ids
+		}
+		resources, err := store.GetTenantResources(ctx, tenantIds)
+		if err != nil {
+			return fmt.Errorf("error in getting tenant resources %v", err)
+		}
+		printTenantResources(title, resources)
+		return nil
+	})
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	fs := newFlagSet("verify")
+	cf := addConfigFlags(fs, false)
+	identities := addIdentityFlag(fs)
+	probe := fs.Bool("probe", false, "send a GET with every full key to the readiness url, or -probe-url, and expect 2xx")
+	probeUrl := fs.String("probe-url", "", "url probed with -probe instead of policies_config.readiness_url")
+	jsonFile := fs.String("json", "", "also write the results as JSON to this file, - for stdout instead of the table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("verify needs a run manifest or a report")
+	}
+	return withBackends(ctx, cf, func(conf model.Config, gw aws.KeyGateway, store database.Store) error {
+		targets, runId, err := readVerifyTargets(fs.Arg(0), *identities, conf.RequiredDetail.ReportPassphrase)
+		if err != nil {
+			return fmt.Errorf("error in reading %s, %v", fs.Arg(0), err)
+		}
+		var p *ReadinessProbe
+		if *probe || *probeUrl != "" {
+			p = NewReadinessProbe(conf.PoliciesConfig)
+			if *probeUrl != "" {
+				p.Url = *probeUrl
+			}
+		}
+		results, err := VerifyKeys(ctx, gw, store, targets, p)
+		if err != nil {
+			return err
+		}
+
+		report := VerifyReport{Source: fs.Arg(0), RunId: runId, Time: time.Now().UTC(), Keys: len(results), Results: results}
+		for _, r := range results {
+			if !r.Passed {
+				report.Failed++
+			}
+		}
+		title := fs.Arg(0)
+		if runId != "" {
+			title = fmt.Sprintf("run %s", runId)
+		}
+		if *jsonFile != "-" {
+			if err := printVerifyResults(os.Stdout, title, results); err != nil {
+				return err
+			}
+		}
+		switch *jsonFile {
+		case "":
+		case "-":
+			if err := writeVerifyReport(os.Stdout, report); err != nil {
+				return err
+			}
+		default:
+			f, err := os.Create(*jsonFile)
+			if err != nil {
+				return err
+			}
+			if err := writeVerifyReport(f, report); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+		if report.Failed > 0 {
+			return fmt.Errorf("%d of %d keys failed verification", report.Failed, report.Keys)
+		}
+		return nil
+	})
+}
+
+func runDecode(ctx context.Context, args []string) error {
+	fs := newFlagSet("decode")
+	cf := addConfigFlags(fs, false)
+	identities := addIdentityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("decode needs a full key or a report")
+	}
+	targets, err := inspectTargets(ctx, fs.Args(), cf, *identities)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Version\tVariable key\tApi key\tResult")
+	for _, t := range targets {
+		k, err := fullkey.Decode(t.FullKey)
+		result := "ok"
+		if err != nil {
+			failed++
+			result = fmt.Sprintf("FAIL: %v", err)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", k.Version, k.VariableKey, k.ApiKey, result)
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d keys could not be decoded", failed)
+	}
+	return nil
+}
+
+func runInspect(ctx context.Context, args []string) error {
+	fs := newFlagSet("inspect")
+	cf := addConfigFlags(fs, false)
+	identities := addIdentityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("inspect needs a full key or a report")
+	}
+	targets, err := inspectTargets(ctx, fs.Args(), cf, *identities)
+	if err != nil {
+		return err
+	}
+	return withBackends(ctx, cf, func(conf model.Config, gw aws.KeyGateway, store database.Store) error {
+		failed := 0
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "Version\tVariable key\tTenant id\tSubscription id\tKey id\tResult")
+		for _, t := range targets {
+			i := InspectKey(ctx, gw, store, t.FullKey, t.Reported)
+			if len(i.Problems) > 0 {
+				failed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", i.Key.Version, i.Key.VariableKey, i.TenantId, i.SubscriptionId, i.KeyId, i.Result())
+		}
+		w.Flush()
+		if failed > 0 {
+			return fmt.Errorf("%d keys failed inspection", failed)
+		}
+		return nil
+	})
+}
+
+func runDoctor(ctx context.Context, args []string) error {
+	fs := newFlagSet("doctor")
+	cf := addConfigFlags(fs, false)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	check := func(name string, err error, ok string) {
+		if err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL\t%s\t%v\n", name, err)
+		} else {
+			fmt.Fprintf(w, "ok\t%s\t%s\n", name, ok)
+		}
+	}
+	defer w.Flush()
+
+	conf, err := cf.load(ctx)
+	check("config", err, cf.file)
+	if err != nil {
+		return fmt.Errorf("doctor found %d problems", failed)
+	}
+
+	store, saveStore, err := NewStore(ctx, conf)
+	check("database", err, fmt.Sprintf("driver %s", conf.DbConf.Driver))
+	if err == nil {
+		defer saveStore()
+		tSource := "Amber"
+		if conf.RequiredDetail.TenantSource != "" {
+			tSource = conf.RequiredDetail.TenantSource
+		}
+		_, err := store.GetTenantSourceId(ctx, tSource)
+		check("tenant source", err, tSource)
+		for _, p := range []struct{ name, id string }{
+			{"attestation product", conf.RequiredDetail.AttestationProductId},
+			{"management product", conf.RequiredDetail.ManagementProductId},
+		} {
+			extId, err := productExtId(ctx, store, p.id)
+			check(p.name, err, fmt.Sprintf("%s, usage plan %s", p.id, extId))
+		}
+	}
+
+	gw, saveGateway, err := NewGateway(ctx, conf)
+	check("api gateway", err, fmt.Sprintf("backend %s", conf.AwsConf.Backend))
+	if err == nil {
+		defer saveGateway()
+		keys, err := gw.ListKeysByTag(ctx, aws.TagOperation, aws.OperationPerfTesting)
+		check("api gateway keys", err, fmt.Sprintf("%d perf testing keys", len(keys)))
+	}
+
+	status, err := policyApiStatus(ctx, conf.PoliciesConfig.Url)
+	check("policy api", err, fmt.Sprintf("%s answers %d without a key", conf.PoliciesConfig.Url, status))
+
+	reportDir := filepath.Dir(conf.RequiredDetail.ReportFileName)
+	_, err = os.Stat(reportDir)
+	check("report directory", err, reportDir)
+
+	if failed > 0 {
+		return fmt.Errorf("doctor found %d problems", failed)
+	}
+	return nil
+}
+
+func productExtId(ctx context.Context, store database.Store, productId string) (string, error) {
+	id, err := uuid.Parse(productId)
+	if err != nil {
+		return "", fmt.Errorf("invalid product id %s, %v", productId, err)
+	}
+	extId, err := store.GetProductExtId(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if extId == "" {
+		return "", fmt.Errorf("product %s not found", productId)
+	}
+	return extId, nil
+}
+
+// policyApiStatus calls the policy api without a key, any http answer means it is reachable
+func policyApiStatus(ctx context.Context, url string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func runReport(ctx context.Context, args []string) error {
+	if len(args) > 0 && args[0] == "decrypt" {
+		return runReportDecrypt(ctx, args[1:])
+	}
+	fs := newFlagSet("report")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("report needs a run manifest")
+	}
+	manifest, err := model.ReadManifest(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("error in reading manifest %s, %v", fs.Arg(0), err)
+	}
+
+	keyTypes := map[string]int{}
+	for _, t := range manifest.Tenants {
+		for _, s := range t.Subscriptions {
+			keyTypes[s.KeyType]++
+		}
+	}
+	finished, duration := "not finished", "-"
+	if !manifest.FinishedAt.IsZero() {
+		finished = manifest.FinishedAt.Format(time.RFC3339)
+		duration = manifest.FinishedAt.Sub(manifest.StartedAt).Round(time.Second).String()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Run\t%s\n", manifest.RunId)
+	fmt.Fprintf(w, "Email domain\t%s\n", manifest.EmailDomain)
+	fmt.Fprintf(w, "Config hash\t%s\n", manifest.ConfigHash)
+	fmt.Fprintf(w, "Started\t%s\n", manifest.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Finished\t%s\t(%s)\n", finished, duration)
+	fmt.Fprintf(w, "Tenants\t%d\n", len(manifest.Tenants))
+	fmt.Fprintf(w, "Management keys\t%d\n", keyTypes["management"])
+	fmt.Fprintf(w, "Attestation keys\t%d\n", keyTypes["attestation"])
+	fmt.Fprintf(w, "Policies\t%d\n", len(manifest.PolicyIds()))
+	fmt.Fprintf(w, "Not undone\t%d\n", len(manifest.NotUndone))
+	for _, n := range manifest.NotUndone {
+		fmt.Fprintf(w, "\t%s\n", n)
+	}
+	return w.Flush()
+}
+
+func runExport(ctx context.Context, args []string) error {
+	fs := newFlagSet("export")
+	cf := addConfigFlags(fs, false)
+	tools := fs.String("tools", "", "comma separated load tools, "+strings.Join(model.ExportTools, ", ")+", override export.tools")
+	targetUrl := fs.String("target-url", "", "url of the vegeta targets, override export.target_url")
+	method := fs.String("method", "", "http method of the vegeta targets, override export.method")
+	bodyFile := fs.String("body-file", "", "request body of the vegeta targets, override export.body_file")
+	split := fs.Bool("split", false, "write attestation and management keys to separate files, override export.split_key_types")
+	identities := addIdentityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("export needs a report file")
+	}
+	conf, err := cf.loadUnchecked(ctx)
+	if err != nil {
+		return err
+	}
+	ec := conf.Export
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "tools":
+			ec.Tools = strings.Split(*tools, ",")
+		case "target-url":
+			ec.TargetUrl = *targetUrl
+		case "method":
+			ec.Method = *method
+		case "body-file":
+			ec.BodyFile = *bodyFile
+		case "split":
+			ec.SplitKeyTypes = *split
+		}
+	})
+	if len(ec.Tools) == 0 {
+		return fmt.Errorf("no load tools, set export.tools or -tools")
+	}
+	if err := ec.Validate(); err != nil {
+		return err
+	}
+
+	rd := conf.RequiredDetail
+	apiKeys, err := ReadReport(fs.Arg(0), *identities, rd.ReportPassphrase)
+	if err != nil {
+		return err
+	}
+	files, err := ExportLoadTools(strings.TrimSuffix(fs.Arg(0), crypt.Ext), ec, rd.ReportEncryption(), apiKeys)
+	for _, f := range files {
+		fmt.Println(f)
+	}
+	return err
+}
+
+// runReportDecrypt writes a decrypted report, or load tool file, to -o or stdout
+func runReportDecrypt(ctx context.Context, args []string) error {
+	fs := newFlagSet("report")
+	cf := addConfigFlags(fs, false)
+	identities := addIdentityFlag(fs)
+	out := fs.String("o", "", "write to this file, with owner only permissions, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("report decrypt needs an encrypted report")
+	}
+	passphrase := ""
+	if len(*identities) == 0 {
+		conf, err := cf.loadUnchecked(ctx)
+		if err != nil {
+			return err
+		}
+		passphrase = conf.RequiredDetail.ReportPassphrase
+	}
+	byt, err := readReportFile(fs.Arg(0), *identities, passphrase)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(byt)
+		return err
+	}
+	_, err = crypt.WriteFile(*out, byt, crypt.Options{})
+	return err
+}
+
+// identityFlag collects the -identity files, it can be given more than once
+type identityFlag []string
+
+func (i *identityFlag) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *identityFlag) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+func addIdentityFlag(fs *flag.FlagSet) *identityFlag {
+	identities := &identityFlag{}
+	fs.Var(identities, "identity", "age identity file to decrypt with, instead of "+model.EnvName("required_detail.report_passphrase")+", can be repeated")
+	return identities
+}
+
+func runConfig(ctx context.Context, args []string) error {
+	fs := newFlagSet("config")
+	cf := addConfigFlags(fs, true)
+	if len(args) == 0 || args[0] != "validate" {
+		fs.Usage()
+		if len(args) > 0 && (args[0] == "-help" || args[0] == "--help" || args[0] == "-h") {
+			return nil
+		}
+		return fmt.Errorf("unknown config command %v", args)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	conf, err := cf.loadUnchecked(ctx)
+	if err != nil {
+		return err
+	}
+	if err := conf.Validate(); err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Printf("FAIL\t%s\n", line)
+		}
+		return fmt.Errorf("config %s is invalid", cf.file)
+	}
+	fmt.Printf("ok\t%s\n", cf.file)
+	return nil
+}
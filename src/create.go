@@ -2,144 +2,599 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/apikey-gen/aws"
 	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
 	"github.com/apikey-gen/model"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 )
 
-func Create(ctx context.Context) {
-	conf, err := model.GetConfig(ctx, "properties.toml")
+// keyRun holds what the workers of a run share to create the keys and policies of tenants
+type keyRun struct {
+	conf     model.Config
+	gw       aws.KeyGateway
+	store    database.Store
+	probe    *ReadinessProbe
+	limiters *Limiters
+	//checkpoint records progress for resume, nil when it could not be written
+	checkpoint     *model.Checkpoint
+	checkpointFile string
+	//manifestFile is rewritten after every tenant, so a killed run leaves the keys of its finished tenants in it
+	manifestFile string
+
+	attestationProductId, managementProductId       uuid.UUID
+	attestationProductExtId, managementProductExtId string
+	//rows referenced by the service of each tenant
+	sourceId, serviceOfferId, planId, serviceOfferPlanSourceId uuid.UUID
+}
+
+func newKeyRun(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store) (*keyRun, error) {
+	r := &keyRun{conf: conf, store: store, probe: NewReadinessProbe(conf.PoliciesConfig), limiters: NewLimiters(conf.Limits)}
+	r.gw = r.limiters.Gateway(gw)
+
+	var err error
+	r.attestationProductId, err = uuid.Parse(conf.RequiredDetail.AttestationProductId)
 	if err != nil {
-		logrus.Errorf("error in config file %v", err)
-		return
+		return nil, fmt.Errorf("error in parsing attestation product id %s, %v", conf.RequiredDetail.AttestationProductId, err)
 	}
-
-	attestationProductId, err := uuid.Parse(conf.RequiredDetail.AttestationProductId)
+	r.managementProductId, err = uuid.Parse(conf.RequiredDetail.ManagementProductId)
 	if err != nil {
-		logrus.Errorf("error in parsing attestation product id %s, %v", conf.RequiredDetail.AttestationProductId, err)
-		return
+		return nil, fmt.Errorf("error in parsing management product id %s, %v", conf.RequiredDetail.ManagementProductId, err)
 	}
-	managementProductId, err := uuid.Parse(conf.RequiredDetail.ManagementProductId)
+	r.attestationProductExtId, err = store.GetProductExtId(ctx, r.attestationProductId)
 	if err != nil {
-		logrus.Errorf("error in parsing management product id %s, %v", conf.RequiredDetail.AttestationProductId, err)
-		return
+		return nil, fmt.Errorf("error in getting product external id %v", err)
 	}
-	/************** AWS init *******************/
-	cli := aws.InitAwsClient(conf.AwsConf.AccessKeyId, conf.AwsConf.SecretAccessKey, conf.AwsConf.SessionToken, conf.AwsConf.AWSRegion)
-	if cli == nil {
-		logrus.Errorf("error in creating aws client")
-		return
+	r.managementProductExtId, err = store.GetProductExtId(ctx, r.managementProductId)
+	if err != nil {
+		return nil, fmt.Errorf("error in getting product external id %v", err)
 	}
 
-	/************** Database ******************/
-	connection, err := database.GetConnection(ctx, model.DBConf{
-		Host:     conf.DbConf.Host,
-		Port:     conf.DbConf.Port,
-		User:     conf.DbConf.User,
-		Password: conf.DbConf.Password,
-		DBName:   conf.DbConf.DBName,
-		SSLMode:  conf.DbConf.SSLMode,
-	})
+	tSource := "Amber"
+	if conf.RequiredDetail.TenantSource != "" {
+		tSource = conf.RequiredDetail.TenantSource
+	}
+	r.sourceId, err = store.GetTenantSourceId(ctx, tSource)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("error in getting source id %v", err)
 	}
+	//validated by Config.Validate
+	r.serviceOfferId, _ = uuid.Parse(conf.PoliciesConfig.ServiceOfferId)
+	r.planId, _ = uuid.Parse(conf.PoliciesConfig.PlanId)
+	r.serviceOfferPlanSourceId, _ = uuid.Parse(conf.PoliciesConfig.ServiceOfferPlanSourceId)
+	return r, nil
+}
 
-	tx := connection.Begin()
-	defer tx.Rollback()
+func Create(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store) error {
+	run, err := newKeyRun(ctx, conf, gw, store)
+	if err != nil {
+		return err
+	}
 
-	tenantsCount := conf.RequiredDetail.TenantsCount
-	keysPerTenant := conf.RequiredDetail.AttKeyPerTenant
-	mgmtkeysPerTenant := conf.RequiredDetail.MagtKeyPerTenant
-	policiesCount := conf.PoliciesConfig.PolicyCount
+	tenants := NewTenants(conf.RequiredDetail.TenantsCount)
 
-	tSource := "Amber"
-	if conf.RequiredDetail.TenantSource != "" {
-		tSource = conf.RequiredDetail.TenantSource
+	/************** Create API keys ******************/
+	manifest := model.NewManifest(NewRunId(), conf.Hash(), conf.RequiredDetail.EmailDomain)
+	manifestFileName := ManifestFileName(conf.RequiredDetail.ManifestFileName, manifest.RunId)
+	for _, t := range tenants {
+		manifest.AddTenant(t.ID, t.ServiceId)
+	}
+	if err := manifest.WriteFile(manifestFileName); err != nil {
+		logrus.Errorf("error in writing run manifest %s, %v", manifestFileName, err)
 	}
+	logrus.Infof("Run %s, manifest %s", manifest.RunId, manifestFileName)
 
-	var sUid uuid.UUID
-	if sourceId, err := database.GetTenantSourceId(ctx, connection, tSource); err != nil {
-		logrus.Errorf("error in getting source id %v", err)
-		return
+	run.manifestFile = manifestFileName
+	run.checkpointFile = CheckpointFileName(manifestFileName)
+	if cp, err := model.CreateCheckpoint(run.checkpointFile, manifest.RunId, manifest.ConfigHash, manifestFileName); err != nil {
+		logrus.Warnf("error in creating checkpoint %s, the run can not be resumed, %v", run.checkpointFile, err)
 	} else {
-		sUid = sourceId
+		run.checkpoint = cp
+		defer cp.Close()
+		planned := make([]model.CheckpointTenant, 0, len(tenants))
+		for _, t := range tenants {
+			planned = append(planned, model.CheckpointTenant{TenantId: t.ID, ServiceId: t.ServiceId})
+		}
+		checkpointed(cp.TenantsPlanned(planned))
 	}
-	tenants, err := CreateTenant(ctx, tenantsCount, tx, conf.RequiredDetail.EmailDomain,
-		uuid.MustParse(conf.PoliciesConfig.ServiceOfferId), uuid.MustParse(conf.PoliciesConfig.PlanId), uuid.MustParse(conf.PoliciesConfig.ServiceOfferPlanSourceId), sUid)
+
+	outcome := newOutcome(manifest, manifestFileName)
+	results := run.createKeys(ctx, tenants, manifest)
+	return run.finish(ctx, manifest, manifestFileName, outcome, results)
+}
+
+func newOutcome(manifest *model.Manifest, manifestFileName string) *model.Outcome {
+	return &model.Outcome{
+		RunId:        manifest.RunId,
+		ManifestFile: manifestFileName,
+		ReportFiles:  []string{},
+		ConfigHash:   manifest.ConfigHash,
+		StartedAt:    manifest.StartedAt,
+	}
+}
+
+// CheckpointFileName puts the checkpoint next to the manifest, run-1.json gives run-1.checkpoint.jsonl
+func CheckpointFileName(manifestFileName string) string {
+	return strings.TrimSuffix(manifestFileName, filepath.Ext(manifestFileName)) + ".checkpoint.jsonl"
+}
+
+// Resume finishes an interrupted run from its checkpoint: done tenants are kept, tenants that were in progress
+// have their recorded keys and policies removed and are created again together with the pending ones
+func Resume(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, runId string) error {
+	fileName := runId
+	if !strings.HasSuffix(fileName, ".jsonl") {
+		fileName = CheckpointFileName(ManifestFileName(conf.RequiredDetail.ManifestFileName, runId))
+	}
+	cp, err := model.OpenCheckpoint(fileName)
 	if err != nil {
-		return
+		return fmt.Errorf("error in opening checkpoint %s, %v", fileName, err)
 	}
-	logrus.Infof("%d Tenants created successfully", tenantsCount)
-	/************** Create API keys ******************/
-	attestationProductExtId, err := database.GetProductExtId(ctx, tx, attestationProductId)
-	managementProductExtId, err := database.GetProductExtId(ctx, tx, managementProductId)
+	defer cp.Close()
+	if cp.ConfigHash != conf.Hash() {
+		return fmt.Errorf("config differs from run %s, resume it with the same config file and overrides", cp.RunId)
+	}
+	manifest, err := model.ReadManifest(cp.ManifestFile)
 	if err != nil {
-		logrus.Errorf("error in getting product external id %v", err)
-		return
+		return fmt.Errorf("error in reading manifest %s, %v", cp.ManifestFile, err)
 	}
 
-	tx.Commit() //has to commit otherwise create policy will fail
-	apiKeysInfos := make([]model.ApiKeyModel, 0)
-	wg := sync.WaitGroup{}
-	wg.Add(len(tenants))
+	run, err := newKeyRun(ctx, conf, gw, store)
+	if err != nil {
+		return err
+	}
+	run.checkpoint, run.checkpointFile, run.manifestFile = cp, fileName, cp.ManifestFile
+
+	done := make([]model.TenantResult, 0)
+	tenants := make([]Tenant, 0)
+	for _, t := range cp.Tenants {
+		switch t.State {
+		case model.TenantDone:
+			if t.ApiKeys, err = run.keyValues(ctx, t.ApiKeys); err != nil {
+				return fmt.Errorf("error in reading the keys of tenant %s for the report, %v", t.TenantId, err)
+			}
+			done = append(done, checkpointResult(t, manifest))
+			continue
+		case model.TenantInProgress:
+			logrus.Infof("Removing interrupted tenant %s", t.TenantId)
+			for _, f := range run.undoCheckpointed(ctx, t) {
+				logrus.Errorf("Not undone, remove manually: %s", f)
+				manifest.NotUndone = append(manifest.NotUndone, f.String())
+			}
+			checkpointed(cp.TenantUndone(t.TenantId))
+		}
+		tenants = append(tenants, Tenant{ID: t.TenantId, ServiceId: t.ServiceId})
+	}
+	if tenants, err = skipExisting(ctx, store, tenants); err != nil {
+		return err
+	}
+	logrus.Infof("Resuming run %s: %d tenants done, %d to create", cp.RunId, len(done), len(tenants))
+
+	outcome := newOutcome(manifest, cp.ManifestFile)
+	outcome.Merge(done)
+	results := run.createKeys(ctx, tenants, manifest)
+	return run.finish(ctx, manifest, cp.ManifestFile, outcome, append(done, results...))
+}
+
+// skipDone leaves out the tenants the checkpoint has done, a resume may have finished them after the outcome was written
+func skipDone(cp *model.Checkpoint, tenants []Tenant) []Tenant {
+	done := map[uuid.UUID]bool{}
+	for _, t := range cp.Tenants {
+		if t.State == model.TenantDone {
+			done[t.TenantId] = true
+		}
+	}
+	kept := make([]Tenant, 0, len(tenants))
 	for _, t := range tenants {
-		go func(wgPtr *sync.WaitGroup, tenantI Tenant) {
-			defer wg.Done()
-			logrus.Infof("Creating api keys for tenant %s", tenantI.ID)
-			apiKeyInfo, err := CreateAPIKey(ctx, keysPerTenant, mgmtkeysPerTenant, policiesCount, connection, tenantI.ID, attestationProductId, managementProductId, tenantI.ServiceId,
-				attestationProductExtId, managementProductExtId, conf.RequiredDetail.MaintainerEmail)
+		if done[t.ID] {
+			logrus.Infof("Tenant %s is done in the checkpoint, not retrying it", t.ID)
+			continue
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
+
+// skipExisting leaves out the tenants whose rows exist although the checkpoint does not have them done, creating
+// them again would fail on the tenant primary key and undoing that would remove rows of another attempt
+func skipExisting(ctx context.Context, store database.Store, tenants []Tenant) ([]Tenant, error) {
+	ids := make([]uuid.UUID, 0, len(tenants))
+	for _, t := range tenants {
+		ids = append(ids, t.ID)
+	}
+	existing, err := store.GetTenantResources(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("error in getting tenant resources %v", err)
+	}
+	exists := make(map[uuid.UUID]bool, len(existing))
+	for _, r := range existing {
+		exists[r.TenantId] = true
+		logrus.Warnf("Tenant %s already has rows that are not in the checkpoint, skipping it; check it with 'verify' or remove it with 'cleanup -tenant-id %s all'", r.TenantId, r.TenantId)
+	}
+	kept := make([]Tenant, 0, len(tenants))
+	for _, t := range tenants {
+		if !exists[t.ID] {
+			kept = append(kept, t)
+		}
+	}
+	return kept, nil
+}
+
+// checkpointResult is the result of a tenant finished before the run was interrupted
+func checkpointResult(t model.CheckpointTenant, manifest *model.Manifest) model.TenantResult {
+	result := model.TenantResult{TenantId: t.TenantId, ServiceId: t.ServiceId, Success: true, Policies: len(t.PolicyIds), ApiKeys: t.ApiKeys, PolicyIds: t.PolicyIds}
+	countKeys(&result, t.ApiKeys)
+	manifest.SetKeys(t.TenantId, t.ApiKeys, t.PolicyIds)
+	return result
+}
+
+// undoCheckpointed removes the rows, keys and policies recorded for a tenant whose run was interrupted
+func (r *keyRun) undoCheckpointed(ctx context.Context, t model.CheckpointTenant) []UndoFailure {
+	undo := &UndoLog{}
+	r.undoTenantRows(undo, Tenant{ID: t.TenantId, ServiceId: t.ServiceId})
+	managementKey := ""
+	for _, k := range t.ApiKeys {
+		k := k
+		if k.KeyType == "management" && managementKey == "" && len(t.PolicyIds) > 0 {
+			if keys, err := r.keyValues(ctx, []model.ApiKeyModel{k}); err != nil {
+				logrus.Warnf("error in reading management key of tenant %s, its policies can not be deleted, %v", t.TenantId, err)
+			} else {
+				managementKey = keys[0].FullKey
+			}
+		}
+		undo.Add(fmt.Sprintf("gateway key %s", k.KeyId), func(ctx context.Context) error {
+			return ignoreNotFound(r.gw.DeleteKey(ctx, k.KeyId))
+		})
+		undo.Add(fmt.Sprintf("subscription %s", k.ID), func(ctx context.Context) error {
+			if err := r.store.DeleteSubscriptionPoliciesBySubscriptionIds(ctx, []uuid.UUID{k.ID}); err != nil {
+				return err
+			}
+			return r.store.DeleteSubscriptionsByIds(ctx, []uuid.UUID{k.ID})
+		})
+	}
+	for _, policyId := range t.PolicyIds {
+		policyId := policyId
+		undo.Add(fmt.Sprintf("policy %s", policyId), func(ctx context.Context) error {
+			return DeletePolicy(ctx, r.conf.PoliciesConfig.Url, managementKey, policyId)
+		})
+	}
+	return undo.Rollback(ctx)
+}
+
+// keyValues fills in the values of keys the checkpoint recorded without them from API Gateway
+func (r *keyRun) keyValues(ctx context.Context, apiKeys []model.ApiKeyModel) ([]model.ApiKeyModel, error) {
+	filled := make([]model.ApiKeyModel, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		if k.FullKey == "" {
+			key, err := r.gw.GetKey(ctx, k.KeyId)
 			if err != nil {
-				logrus.Errorf("error in create api key %v", err)
-				return
+				return nil, fmt.Errorf("error in getting api key %s, %v", k.KeyId, err)
 			}
-			apiKeysInfos = append(apiKeysInfos, apiKeyInfo...)
-		}(&wg, t)
+			k.ApiKey = key.Value
+			k.FullKey, err = fullkey.Encode(fullkey.Key{Version: k.Version, VariableKey: k.VariableKey, ApiKey: key.Value})
+			if err != nil {
+				return nil, err
+			}
+		}
+		filled = append(filled, k)
 	}
-	wg.Wait()
-	ExportToFile(ctx, conf.RequiredDetail.ReportFileName, conf.RequiredDetail.ReportTmpl, apiKeysInfos)
+	return filled, nil
 }
 
-func ExportToFile(ctx context.Context, fileName string, template string, apiKeys []model.ApiKeyModel) {
-	fileName = fmt.Sprintf(fileName, time.Now().UnixNano())
-	templants := []string{}
+// Retry runs key and policy creation again for the tenants that failed in an outcome file
+func Retry(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, outcomeFile string) error {
+	outcome, err := model.ReadOutcome(outcomeFile)
+	if err != nil {
+		return fmt.Errorf("error in reading outcome %s, %v", outcomeFile, err)
+	}
+	if outcome.ConfigHash != conf.Hash() {
+		return fmt.Errorf("config differs from run %s, retry it with the same config file and overrides", outcome.RunId)
+	}
+	manifest, err := model.ReadManifest(outcome.ManifestFile)
+	if err != nil {
+		return fmt.Errorf("error in reading manifest %s, %v", outcome.ManifestFile, err)
+	}
+	failed := outcome.Failed()
+	if len(failed) == 0 {
+		logrus.Infof("No failed tenants in run %s", outcome.RunId)
+		return nil
+	}
+	tenants := make([]Tenant, 0, len(failed))
+	for _, t := range failed {
+		tenants = append(tenants, Tenant{ID: t.TenantId, ServiceId: t.ServiceId})
+	}
+	logrus.Infof("Retrying %d failed tenants of run %s", len(tenants), outcome.RunId)
 
-	if len(apiKeys) == 0 {
-		return
+	run, err := newKeyRun(ctx, conf, gw, store)
+	if err != nil {
+		return err
+	}
+	run.manifestFile = outcome.ManifestFile
+	// keep the checkpoint of the run up to date, so a later resume does not create the retried tenants again
+	checkpointFile := CheckpointFileName(outcome.ManifestFile)
+	if cp, err := model.OpenCheckpoint(checkpointFile); err != nil {
+		logrus.Warnf("error in opening checkpoint %s, the retried tenants are not recorded for resume, %v", checkpointFile, err)
+	} else {
+		defer cp.Close()
+		if cp.RunId != outcome.RunId {
+			return fmt.Errorf("checkpoint %s is of run %s, not %s", checkpointFile, cp.RunId, outcome.RunId)
+		}
+		run.checkpoint, run.checkpointFile = cp, checkpointFile
+		tenants = skipDone(cp, tenants)
+	}
+	if tenants, err = skipExisting(ctx, store, tenants); err != nil {
+		return err
+	}
+	results := run.createKeys(ctx, tenants, manifest)
+	return run.finish(ctx, manifest, outcome.ManifestFile, outcome, results)
+}
+
+// createKeys creates the rows, keys and policies of the tenants with a pool of workers sending one result per
+// tenant. Each tenant is written in its own transactions; with all_or_nothing the first failure stops the run and
+// every tenant created so far is removed again.
+func (r *keyRun) createKeys(ctx context.Context, tenants []Tenant, manifest *model.Manifest) []model.TenantResult {
+	rd := r.conf.RequiredDetail
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	kept := map[uuid.UUID]*UndoLog{}
+	firstFailed := uuid.Nil
+
+	work := make(chan Tenant)
+	resultsCh := make(chan model.TenantResult)
+	wg := sync.WaitGroup{}
+	tags := aws.KeyTags(rd.MaintainerEmail, manifest.RunId)
+	workers := min(r.conf.Limits.WithDefaults().Concurrency, len(tenants))
+	logrus.Infof("Creating api keys with %d workers", workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tenantI := range work {
+				tenantI := tenantI
+				result := model.TenantResult{TenantId: tenantI.ID, ServiceId: tenantI.ServiceId}
+				if workCtx.Err() != nil {
+					result.Error = "not started, the run was stopped"
+					resultsCh <- result
+					continue
+				}
+				logrus.Infof("Creating api keys for tenant %s", tenantI.ID)
+				start := time.Now()
+				undo := &UndoLog{}
+				bootstrap := func(tx database.Store) error {
+					if err := MakeTenant(workCtx, tx, tenantI, rd.EmailDomain, r.serviceOfferId, r.planId, r.serviceOfferPlanSourceId, r.sourceId); err != nil {
+						return err
+					}
+					// only rows this attempt wrote are removed, a tenant that already exists is left alone
+					r.undoTenantRows(undo, tenantI)
+					return nil
+				}
+				apiKeyInfo, policyIds, err := CreateAPIKey(workCtx, r.gw, r.probe, undo, r.checkpoint, rd.AttKeyPerTenant, rd.MagtKeyPerTenant, r.conf.PoliciesConfig, r.limiters.PolicyCreate, r.store, bootstrap,
+					tenantI.ID, r.attestationProductId, r.managementProductId, tenantI.ServiceId, r.attestationProductExtId, r.managementProductExtId, tags)
+				result.Success, result.Policies = err == nil, len(policyIds)
+				countKeys(&result, apiKeyInfo)
+				if err != nil {
+					logrus.Errorf("error in create api key for tenant %s, %v, undoing it", tenantI.ID, err)
+					result.Error = err.Error()
+					var stageErr *StageError
+					if errors.As(err, &stageErr) {
+						result.Stage = stageErr.Stage
+						result.Error = stageErr.Err.Error()
+					}
+					if rd.AllOrNothing {
+						mu.Lock()
+						if firstFailed == uuid.Nil {
+							firstFailed = tenantI.ID
+						}
+						mu.Unlock()
+						cancel()
+					}
+					for _, f := range undo.Rollback(ctx) {
+						result.NotUndone = append(result.NotUndone, f.String())
+					}
+					checkpointed(r.checkpoint.TenantUndone(tenantI.ID))
+				} else {
+					result.ApiKeys = apiKeyInfo
+					result.PolicyIds = policyIds
+					manifest.SetKeys(tenantI.ID, apiKeyInfo, policyIds)
+					r.writeManifest(manifest)
+					if rd.AllOrNothing {
+						mu.Lock()
+						kept[tenantI.ID] = undo
+						mu.Unlock()
+					}
+					checkpointed(r.checkpoint.TenantDone(tenantI.ID))
+				}
+				result.DurationSeconds = time.Since(start).Seconds()
+				resultsCh <- result
+			}
+		}()
 	}
+	go func() {
+		for _, t := range tenants {
+			work <- t
+		}
+		close(work)
+		wg.Wait()
+		close(resultsCh)
+	}()
 
-	apiKey := apiKeys[0]
-	apiKeyMap := map[string]string{}
-	byt, _ := json.Marshal(apiKey)
-	_ = json.Unmarshal(byt, &apiKeyMap)
-	tmplStr := template
-	for key, _ := range apiKeyMap {
-		tmplStr = strings.ReplaceAll(tmplStr, fmt.Sprintf("{{%s}}", key), key)
+	results := make([]model.TenantResult, 0, len(tenants))
+	for result := range resultsCh {
+		results = append(results, result)
 	}
-	templants = append(templants, tmplStr)
 
-	for _, apiKey := range apiKeys {
-		apiKeyMap := map[string]string{}
-		byt, _ := json.Marshal(apiKey)
-		_ = json.Unmarshal(byt, &apiKeyMap)
-		tmplStr := template
-		for key, value := range apiKeyMap {
-			tmplStr = strings.ReplaceAll(tmplStr, fmt.Sprintf("{{%s}}", key), value)
+	reason := ""
+	for _, result := range results {
+		if !result.Success {
+			reason = "the run did not finish"
 		}
-		templants = append(templants, tmplStr)
 	}
+	if firstFailed != uuid.Nil {
+		reason = fmt.Sprintf("tenant %s failed", firstFailed)
+	}
+	if rd.AllOrNothing && reason != "" {
+		logrus.Errorf("all_or_nothing is set and %s, removing the %d tenants created", reason, len(kept))
+		for i := range results {
+			result := &results[i]
+			undo, ok := kept[result.TenantId]
+			if !ok {
+				continue
+			}
+			for _, f := range undo.Rollback(ctx) {
+				result.NotUndone = append(result.NotUndone, f.String())
+			}
+			checkpointed(r.checkpoint.TenantUndone(result.TenantId))
+			result.Success, result.Stage, result.ApiKeys, result.PolicyIds = false, StageAllOrNothing, nil, nil
+			result.Error = "removed because " + reason
+			manifest.SetKeys(result.TenantId, nil, nil)
+		}
+		r.writeManifest(manifest)
+	}
+	logrus.Infof("Management key readiness: %s", r.probe.Summary())
+	r.limiters.LogSummary()
+	return results
+}
 
-	tmp := strings.Join(templants, "\n")
-	err := os.WriteFile(fileName, []byte(tmp), fs.ModeAppend)
-	if err != nil {
+func (r *keyRun) writeManifest(manifest *model.Manifest) {
+	if r.manifestFile == "" {
 		return
 	}
+	if err := manifest.WriteFile(r.manifestFile); err != nil {
+		logrus.Errorf("error in writing run manifest %s, %v", r.manifestFile, err)
+	}
+}
+
+// undoTenantRows registers the removal of the tenant and service rows, first so they are removed last
+func (r *keyRun) undoTenantRows(undo *UndoLog, t Tenant) {
+	undo.Add(fmt.Sprintf("tenant %s", t.ID), func(ctx context.Context) error {
+		if err := r.store.DeleteServicesByIds(ctx, []uuid.UUID{t.ServiceId}); err != nil {
+			return err
+		}
+		return r.store.DeleteTenantsByIds(ctx, []uuid.UUID{t.ID})
+	})
+}
+
+func countKeys(result *model.TenantResult, apiKeys []model.ApiKeyModel) {
+	for _, k := range apiKeys {
+		if k.KeyType == "management" {
+			result.ManagementKeys++
+		} else {
+			result.AttestationKeys++
+		}
+	}
+}
+
+// finish writes the manifest, report and outcome files of the results and prints the summary table
+func (r *keyRun) finish(ctx context.Context, manifest *model.Manifest, manifestFileName string, outcome *model.Outcome, results []model.TenantResult) error {
+	apiKeysInfos := make([]model.ApiKeyModel, 0)
+	failed := 0
+	for _, result := range results {
+		for _, apiKey := range result.ApiKeys {
+			apiKey.RunId = outcome.RunId
+			apiKeysInfos = append(apiKeysInfos, apiKey)
+		}
+		if !result.Success {
+			failed++
+		}
+		for _, n := range result.NotUndone {
+			logrus.Errorf("Not undone, remove manually: %s", n)
+			manifest.NotUndone = append(manifest.NotUndone, n)
+		}
+	}
+
+	manifest.FinishedAt = time.Now().UTC()
+	if err := manifest.WriteFile(manifestFileName); err != nil {
+		logrus.Errorf("error in writing run manifest %s, %v", manifestFileName, err)
+	}
+
+	reportFileName := fmt.Sprintf(r.conf.RequiredDetail.ReportFileName, time.Now().UnixNano())
+	reportWritten := "none"
+	if len(apiKeysInfos) > 0 {
+		rd := r.conf.RequiredDetail
+		opts := newReportOptions(ctx, r.conf, r.store, outcome.RunId, apiKeysInfos)
+		if written, err := ExportToFile(ctx, reportFileName, opts, apiKeysInfos); err != nil {
+			logrus.Error(err)
+		} else {
+			outcome.ReportFiles = append(outcome.ReportFiles, written)
+			reportWritten = written
+		}
+		if len(r.conf.Export.Tools) > 0 {
+			files, err := ExportLoadTools(reportFileName, r.conf.Export, rd.ReportEncryption(), apiKeysInfos)
+			if err != nil {
+				logrus.Error(err)
+			}
+			logrus.Infof("Load tool data %s", strings.Join(files, ", "))
+		}
+	}
+	outcome.Merge(results)
+	outcome.FinishedAt = manifest.FinishedAt
+	outcomeFileName := OutcomeFileName(reportFileName)
+	if err := outcome.WriteFile(outcomeFileName); err != nil {
+		logrus.Errorf("error in writing outcome %s, %v", outcomeFileName, err)
+	}
+
+	if failed == 0 && r.checkpointFile != "" && (r.checkpoint == nil || len(r.checkpoint.Remaining()) == 0) {
+		// nothing left to resume
+		if err := os.Remove(r.checkpointFile); err != nil {
+			logrus.Warnf("error in removing checkpoint %s, %v", r.checkpointFile, err)
+		}
+	}
+
+	printResults(results)
+	logrus.Infof("Run %s: report %s, outcome %s, manifest %s", outcome.RunId, reportWritten, outcomeFileName, manifestFileName)
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %d of %d tenants were not created, finish the run with 'create -resume %s'", ErrInterrupted, failed, len(results), outcome.RunId)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d tenants failed, retry them with 'create -resume %s' or 'create -retry %s'", ErrPartialFailure, failed, len(results), outcome.RunId, outcomeFileName)
+	}
+	return nil
+}
+
+// OutcomeFileName puts the outcome next to the report, report_1.csv gives report_1.outcome.json
+func OutcomeFileName(reportFileName string) string {
+	return strings.TrimSuffix(reportFileName, filepath.Ext(reportFileName)) + ".outcome.json"
+}
+
+func printResults(results []model.TenantResult) {
+	var mgmtKeys, attKeys, policies, failed int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Tenant id\tResult\tMgmt keys\tAtt keys\tPolicies\tDuration\tFailed stage\tError")
+	for _, r := range results {
+		status := "ok"
+		if !r.Success {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%.1fs\t%s\t%s\n", r.TenantId, status, r.ManagementKeys, r.AttestationKeys, r.Policies, r.DurationSeconds, r.Stage, r.Error)
+		if r.Success {
+			mgmtKeys += r.ManagementKeys
+			attKeys += r.AttestationKeys
+			policies += r.Policies
+		}
+	}
+	fmt.Fprintf(w, "TOTAL %d tenants, %d failed\t\t%d\t%d\t%d\t\t\t\n", len(results), failed, mgmtKeys, attKeys, policies)
+	w.Flush()
+}
+
+func NewRunId() string {
+	return fmt.Sprintf("run-%s-%s", time.Now().UTC().Format("20060102-150405"), strings.ToLower(RandStringRunes(6)))
+}
+
+// ManifestFileName formats manifest_file, which Config.Validate checks has a %s, with the run id, defaulting to
+// <run id>.json
+func ManifestFileName(pattern, runId string) string {
+	if pattern == "" {
+		return runId + ".json"
+	}
+	return fmt.Sprintf(pattern, runId)
 }
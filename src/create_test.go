@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
+	"github.com/apikey-gen/model"
+	"github.com/apikey-gen/policyserver"
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAttestationProductId = "c9ae42c4-73c3-47c2-9c22-ce70e406591b"
+	testManagementProductId  = "24e8554a-dbf7-4a36-94b5-ab6232a52028"
+	testEmailDomain          = "example.com"
+)
+
+// testEnv is a create run on the in-memory gateway and database against a mock policy api
+type testEnv struct {
+	conf     model.Config
+	gw       *aws.MemoryGateway
+	store    *database.MemoryStore
+	policies *policyserver.Server
+}
+
+// newTestEnv serves the mock policy api through handler, which gets the mock server to pass requests on to
+func newTestEnv(t *testing.T, tenants int, handler func(policies http.Handler) http.Handler) *testEnv {
+	t.Helper()
+	policies := policyserver.New(policyserver.AllowAll(), policyserver.Options{})
+	var h http.Handler = policies
+	if handler != nil {
+		h = handler(policies)
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	conf := model.Config{
+		RequiredDetail: model.RequiredDetail{
+			TenantsCount:         tenants,
+			AttKeyPerTenant:      2,
+			MagtKeyPerTenant:     1,
+			MaintainerEmail:      "perf@example.com",
+			AttestationProductId: testAttestationProductId,
+			ManagementProductId:  testManagementProductId,
+			EmailDomain:          testEmailDomain,
+			ReportFileName:       filepath.Join(dir, "report_%d.csv"),
+			ManifestFileName:     filepath.Join(dir, "%s.json"),
+			ReportFormat:         "csv",
+		},
+		PoliciesConfig: model.PoliciesConfig{
+			Policy:                   "default matches_sgx_policy = true",
+			PolicyName:               "sgx-perf-policy{count_ext}",
+			PolicyType:               "Appraisal policy",
+			AttestationType:          "SGX Attestation",
+			ServiceOfferId:           uuid.NewString(),
+			Url:                      srv.URL + policyserver.PoliciesPath,
+			PlanId:                   uuid.NewString(),
+			ServiceOfferPlanSourceId: uuid.NewString(),
+			PolicyCount:              2,
+			ReadinessTimeout:         5 * time.Second,
+			ReadinessInitialInterval: 10 * time.Millisecond,
+		},
+		Limits: model.LimitsConf{GatewayCreateRps: -1, UsagePlanAttachRps: -1, GatewayDeleteRps: -1, PolicyCreateRps: -1},
+	}
+
+	store := database.NewMemoryStore()
+	if err := seedMemoryStore(context.Background(), store, conf); err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{
+		conf:     conf,
+		gw:       aws.NewMemoryGateway(testAttestationProductId, testManagementProductId),
+		store:    store,
+		policies: policies,
+	}
+}
+
+func (e *testEnv) tenantIds(t *testing.T) []uuid.UUID {
+	t.Helper()
+	ids, err := e.store.SelectTenantIds(context.Background(), database.TenantSelector{EmailDomain: testEmailDomain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func (e *testEnv) rows(t *testing.T, tenantIds []uuid.UUID) map[string]int64 {
+	t.Helper()
+	counts, err := e.store.CountTenantRows(context.Background(), tenantIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func (e *testEnv) keys(t *testing.T, tagKey, tagValue string) []aws.ApiKey {
+	t.Helper()
+	keys, err := e.gw.ListKeysByTag(context.Background(), tagKey, tagValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// manifests returns the manifests written in the run directory
+func (e *testEnv) manifests(t *testing.T) []*model.Manifest {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(e.conf.RequiredDetail.ManifestFileName), "run-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := make([]*model.Manifest, 0, len(files))
+	for _, f := range files {
+		m, err := model.ReadManifest(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests
+}
+
+func TestCreateCleanupRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, 3, nil)
+
+	if err := Create(ctx, e.conf, e.gw, e.store); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	ids := e.tenantIds(t)
+	if len(ids) != 3 {
+		t.Fatalf("got %d tenants, want 3", len(ids))
+	}
+	rows := e.rows(t, ids)
+	if rows["tenant"] != 3 || rows["service"] != 3 || rows["subscription"] != 9 {
+		t.Errorf("got rows %v, want 3 tenants, 3 services and 9 subscriptions", rows)
+	}
+	if keys := e.keys(t, aws.TagOperation, aws.OperationPerfTesting); len(keys) != 9 {
+		t.Errorf("got %d gateway keys, want 9", len(keys))
+	}
+	if policies := e.policies.Policies(); len(policies) != 6 {
+		t.Errorf("got %d policies, want 6", len(policies))
+	}
+
+	opts := CleanupOptions{Yes: true, Confirm: testEmailDomain}
+	if err := CleanUpSelected(ctx, e.conf, e.gw, e.store, CleanupSelector{}, opts); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if ids := e.tenantIds(t); len(ids) != 0 {
+		t.Errorf("got %d tenants after cleanup, want 0", len(ids))
+	}
+	for table, n := range e.rows(t, ids) {
+		if n != 0 {
+			t.Errorf("got %d %s rows after cleanup, want 0", n, table)
+		}
+	}
+	if keys := e.keys(t, aws.TagOperation, aws.OperationPerfTesting); len(keys) != 0 {
+		t.Errorf("got %d gateway keys after cleanup, want 0", len(keys))
+	}
+}
+
+// cancelOnNthPost cancels the run when the nth policy create comes in and fails that call
+func cancelOnNthPost(n int, cancel context.CancelFunc) func(policies http.Handler) http.Handler {
+	return func(policies http.Handler) http.Handler {
+		var mu sync.Mutex
+		posts := 0
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				mu.Lock()
+				posts++
+				stop := posts == n
+				mu.Unlock()
+				if stop {
+					cancel()
+					http.Error(w, "interrupted", http.StatusServiceUnavailable)
+					return
+				}
+			}
+			policies.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestResumeByRunId(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the first tenant is done, the second is interrupted while creating its policies and the third is pending
+	e := newTestEnv(t, 3, cancelOnNthPost(3, cancel))
+	e.conf.Limits.Concurrency = 1
+
+	if err := Create(ctx, e.conf, e.gw, e.store); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("got %v, want %v", err, ErrInterrupted)
+	}
+	manifests := e.manifests(t)
+	if len(manifests) != 1 {
+		t.Fatalf("got %d manifests, want 1", len(manifests))
+	}
+	if ids := e.tenantIds(t); len(ids) != 1 {
+		t.Fatalf("got %d tenants after the interrupt, want 1", len(ids))
+	}
+
+	// the manifest is not in the working directory, the run id is resolved with manifest_file
+	if err := Resume(context.Background(), e.conf, e.gw, e.store, manifests[0].RunId); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if rows := e.rows(t, manifests[0].TenantIds()); rows["tenant"] != 3 || rows["subscription"] != 9 {
+		t.Errorf("got rows %v after resume, want 3 tenants and 9 subscriptions", rows)
+	}
+	if keys := e.keys(t, aws.TagRunId, manifests[0].RunId); len(keys) != 9 {
+		t.Errorf("got %d gateway keys after resume, want 9", len(keys))
+	}
+	if policies := e.policies.Policies(); len(policies) != 6 {
+		t.Errorf("got %d policies after resume, want 6", len(policies))
+	}
+	checkpointFile := CheckpointFileName(ManifestFileName(e.conf.RequiredDetail.ManifestFileName, manifests[0].RunId))
+	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
+		t.Errorf("checkpoint %s is left after the run finished, %v", checkpointFile, err)
+	}
+}
+
+// failNthPost answers the nth policy create with a server error
+func failNthPost(n int) func(policies http.Handler) http.Handler {
+	return func(policies http.Handler) http.Handler {
+		var mu sync.Mutex
+		posts := 0
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				mu.Lock()
+				posts++
+				fail := posts == n
+				mu.Unlock()
+				if fail {
+					http.Error(w, "injected failure", http.StatusInternalServerError)
+					return
+				}
+			}
+			policies.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestResumeReadsKeyValuesFromGateway(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := newTestEnv(t, 2, cancelOnNthPost(3, cancel))
+	e.conf.Limits.Concurrency = 1
+	dir := filepath.Dir(e.conf.RequiredDetail.ReportFileName)
+	e.conf.RequiredDetail.ReportFormat = "json"
+	e.conf.RequiredDetail.ReportFileName = filepath.Join(dir, "report_%d.json")
+
+	if err := Create(ctx, e.conf, e.gw, e.store); !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("got %v, want %v", err, ErrInterrupted)
+	}
+	runId := e.manifests(t)[0].RunId
+	journal, err := os.ReadFile(CheckpointFileName(ManifestFileName(e.conf.RequiredDetail.ManifestFileName, runId)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := e.keys(t, aws.TagRunId, runId)
+	if len(keys) == 0 {
+		t.Fatal("no keys were created before the interrupt")
+	}
+	for _, k := range keys {
+		key, err := e.gw.GetKey(context.Background(), k.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(journal), key.Value) {
+			t.Errorf("checkpoint holds the value of key %s", k.Id)
+		}
+	}
+
+	if err := Resume(context.Background(), e.conf, e.gw, e.store, runId); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	// the interrupted run reported its done tenant, the resume reports the whole run
+	reports, err := filepath.Glob(filepath.Join(dir, "report_*[0-9].json"))
+	if err != nil || len(reports) != 2 {
+		t.Fatalf("got reports %v, %v, want the one of the run and of the resume", reports, err)
+	}
+	slices.Sort(reports)
+	byt, err := os.ReadFile(reports[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported []model.ApiKeyModel
+	if err := json.Unmarshal(byt, &reported); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 6 {
+		t.Fatalf("got %d keys in the report, want the 6 of both tenants", len(reported))
+	}
+	for _, k := range reported {
+		key, err := e.gw.GetKey(context.Background(), k.KeyId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := fullkey.New(k.VariableKey, key.Value)
+		if k.ApiKey != key.Value || k.FullKey != want {
+			t.Errorf("key %s is reported with the wrong value", k.KeyId)
+		}
+	}
+}
+
+func TestOutcomeAndRetry(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, 3, failNthPost(2))
+	e.conf.Limits.Concurrency = 1
+	dir := filepath.Dir(e.conf.RequiredDetail.ReportFileName)
+
+	if err := Create(ctx, e.conf, e.gw, e.store); !errors.Is(err, ErrPartialFailure) {
+		t.Fatalf("got %v, want %v", err, ErrPartialFailure)
+	}
+	outcomes, err := filepath.Glob(filepath.Join(dir, "*.outcome.json"))
+	if err != nil || len(outcomes) != 1 {
+		t.Fatalf("got outcomes %v, %v, want 1", outcomes, err)
+	}
+	outcome, err := model.ReadOutcome(outcomes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcome.Tenants) != 3 || len(outcome.ReportFiles) != 1 || outcome.ConfigHash != e.conf.Hash() {
+		t.Fatalf("got outcome %+v, want 3 tenants, the report and the config hash", outcome)
+	}
+	failed := outcome.Failed()
+	if len(failed) != 1 || failed[0].Stage == "" || failed[0].Error == "" {
+		t.Fatalf("got failed tenants %+v, want one with its stage and error", failed)
+	}
+	for _, r := range outcome.Tenants {
+		if r.Success && (r.ManagementKeys != 1 || r.AttestationKeys != 2 || r.Policies != 2) {
+			t.Errorf("got %+v, want 1 management key, 2 attestation keys and 2 policies", r)
+		}
+	}
+
+	changed := e.conf
+	changed.RequiredDetail.AttKeyPerTenant = 3
+	if err := Retry(ctx, changed, e.gw, e.store, outcomes[0]); err == nil {
+		t.Error("retried with another config")
+	}
+
+	if err := Retry(ctx, e.conf, e.gw, e.store, outcomes[0]); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if keys := e.keys(t, aws.TagRunId, outcome.RunId); len(keys) != 9 {
+		t.Errorf("got %d gateway keys of the run after the retry, want 9", len(keys))
+	}
+	outcomes, err = filepath.Glob(filepath.Join(dir, "*.outcome.json"))
+	if err != nil || len(outcomes) != 2 {
+		t.Fatalf("got outcomes %v, %v, want the one of the run and of the retry", outcomes, err)
+	}
+	slices.Sort(outcomes)
+	if outcome, err = model.ReadOutcome(outcomes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(outcome.Tenants) != 3 || len(outcome.Failed()) != 0 || len(outcome.ReportFiles) != 2 {
+		t.Errorf("got outcome %+v after the retry, want 3 succeeded tenants and both reports", outcome)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/crypt"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
+	"github.com/apikey-gen/model"
+	"os"
+	"strings"
+)
+
+// inspectTarget is a full key given on the command line, or one read from a report with the rest of its record
+type inspectTarget struct {
+	FullKey  string
+	Reported *model.ApiKeyModel
+}
+
+// KeyInspection is a full key with its parts, its subscription and gateway key and what does not match
+type KeyInspection struct {
+	Key            fullkey.Key
+	SubscriptionId string
+	TenantId       string
+	KeyId          string
+	Problems       []string
+}
+
+func (i KeyInspection) Result() string {
+	if len(i.Problems) == 0 {
+		return "ok"
+	}
+	return "FAIL: " + strings.Join(i.Problems, "; ")
+}
+
+// inspectTargets are the full keys of args, an arg naming a file is read as a report, encrypted reports are
+// decrypted with identities or the passphrase of the config loaded by cf
+func inspectTargets(ctx context.Context, args []string, cf *configFlags, identities []string) ([]inspectTarget, error) {
+	targets := make([]inspectTarget, 0, len(args))
+	for _, arg := range args {
+		if _, err := os.Stat(arg); err != nil {
+			targets = append(targets, inspectTarget{FullKey: arg})
+			continue
+		}
+		passphrase := ""
+		if strings.HasSuffix(arg, crypt.Ext) && len(identities) == 0 {
+			conf, err := cf.loadUnchecked(ctx)
+			if err != nil {
+				return nil, err
+			}
+			passphrase = conf.RequiredDetail.ReportPassphrase
+		}
+		apiKeys, err := ReadReport(arg, identities, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		for i := range apiKeys {
+			targets = append(targets, inspectTarget{FullKey: apiKeys[i].FullKey, Reported: &apiKeys[i]})
+		}
+	}
+	return targets, nil
+}
+
+// InspectKey decodes fullKey and checks that the subscription of its variable key and the gateway key of that
+// subscription agree with it, and with the report record it was read from when reported is set
+func InspectKey(ctx context.Context, gw aws.KeyGateway, store database.Store, fullKey string, reported *model.ApiKeyModel) KeyInspection {
+	var i KeyInspection
+	problem := func(format string, a ...any) {
+		i.Problems = append(i.Problems, fmt.Sprintf(format, a...))
+	}
+	k, err := fullkey.Decode(fullKey)
+	if err != nil {
+		problem("%v", err)
+		return i
+	}
+	i.Key = k
+	if reported != nil {
+		if reported.VariableKey != "" && reported.VariableKey != k.VariableKey {
+			problem("report variable_key is %s", reported.VariableKey)
+		}
+		if reported.ApiKey != "" && reported.ApiKey != k.ApiKey {
+			problem("report api_key does not match the full key")
+		}
+	}
+
+	subscription, err := store.GetSubscriptionByVariableKey(ctx, k.VariableKey)
+	if err != nil {
+		problem("subscription: %v", err)
+		return i
+	}
+	i.SubscriptionId, i.TenantId, i.KeyId = subscription.ID.String(), subscription.TenantId.String(), subscription.ExternalId
+	if subscription.Version != k.Version {
+		problem("subscription version is %s", subscription.Version)
+	}
+	if subscription.Status != "Active" {
+		problem("subscription status is %s", subscription.Status)
+	}
+	if reported != nil {
+		if reported.ID != subscription.ID {
+			problem("report id is %s", reported.ID)
+		}
+		if reported.KeyId != "" && reported.KeyId != subscription.ExternalId {
+			problem("report key_id is %s", reported.KeyId)
+		}
+	}
+
+	key, err := gw.GetKey(ctx, subscription.ExternalId)
+	if err != nil {
+		problem("gateway key %s: %v", subscription.ExternalId, err)
+		return i
+	}
+	if !key.Enabled {
+		problem("gateway key disabled")
+	}
+	if key.Value != k.ApiKey {
+		problem("gateway key value does not match the api key")
+	}
+	return i
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/model"
+	"github.com/apikey-gen/throttle"
+	"github.com/sirupsen/logrus"
+)
+
+// Limiters are the token buckets shared by all workers of a run, one per kind of backend call
+type Limiters struct {
+	GatewayCreate   *throttle.Limiter
+	UsagePlanAttach *throttle.Limiter
+	GatewayDelete   *throttle.Limiter
+	PolicyCreate    *throttle.Limiter
+}
+
+func NewLimiters(conf model.LimitsConf) *Limiters {
+	conf = conf.WithDefaults()
+	return &Limiters{
+		GatewayCreate:   throttle.New("gateway create key", conf.GatewayCreateRps, conf.Burst),
+		UsagePlanAttach: throttle.New("usage plan attach", conf.UsagePlanAttachRps, conf.Burst),
+		GatewayDelete:   throttle.New("gateway delete key", conf.GatewayDeleteRps, conf.Burst),
+		PolicyCreate:    throttle.New("policy create", conf.PolicyCreateRps, conf.Burst),
+	}
+}
+
+// Gateway wraps gw so its calls are limited by l
+func (l *Limiters) Gateway(gw aws.KeyGateway) aws.KeyGateway {
+	return aws.NewLimitedGateway(gw, l.GatewayCreate, l.UsagePlanAttach, l.GatewayDelete)
+}
+
+func (l *Limiters) Stats() []throttle.Stats {
+	return []throttle.Stats{l.GatewayCreate.Stats(), l.UsagePlanAttach.Stats(), l.GatewayDelete.Stats(), l.PolicyCreate.Stats()}
+}
+
+// LogSummary logs the throttling of every limiter that was used
+func (l *Limiters) LogSummary() {
+	for _, s := range l.Stats() {
+		if s.Calls > 0 || s.Throttled > 0 {
+			logrus.Infof("Rate limit %s", s)
+		}
+	}
+}
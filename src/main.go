@@ -2,39 +2,108 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/model"
 	"github.com/sirupsen/logrus"
-	"strconv"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
+// process exit codes
+const (
+	exitSuccess        = 0
+	exitError          = 1
+	exitAborted        = 2
+	exitPartialFailure = 3
+	//exitInterrupted follows the shell convention of 128 + SIGINT
+	exitInterrupted = 130
+)
+
+// ErrInterrupted is returned when a run was stopped by SIGINT or SIGTERM
+var ErrInterrupted = errors.New("interrupted")
+
 func main() {
 	// Run the API key generator
-	fmt.Print("API key generator\n\n")
-	ctx := context.Background()
-	cleanUpCountPtr := flag.String("cleanup", "", "clean up database and AWS resources")
-	flag.Parse()
-	if *cleanUpCountPtr == "" {
-		logrus.Info("Starting Creating API keys")
-		Create(ctx)
-	} else {
-		logrus.Info("Cleaning up")
-		if strings.ToLower(*cleanUpCountPtr) == "all" {
-			CleanUp(ctx)
-			return
+	// on stderr, so output such as report decrypt can be piped
+	fmt.Fprint(os.Stderr, "API key generator\n\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// a second signal kills the process
+		signal.Stop(signals)
+		logrus.Warnf("Received %v, undoing the work in flight and writing the partial report, send it again to quit now", sig)
+		cancel()
+	}()
+	err := run(ctx, os.Args[1:])
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ErrInterrupted) {
+		err = fmt.Errorf("%w: %v", ErrInterrupted, err)
+	}
+	cancel()
+	if err != nil {
+		logrus.Error(err)
+	}
+	os.Exit(exitCode(err))
+}
+
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitSuccess
+	case errors.Is(err, ErrInterrupted):
+		return exitInterrupted
+	case errors.Is(err, ErrAborted):
+		return exitAborted
+	case errors.Is(err, ErrPartialFailure):
+		return exitPartialFailure
+	default:
+		return exitError
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return runCommand(ctx, args)
+	}
+	return runLegacy(ctx, args)
+}
+
+// runLegacy keeps the original flags working, it creates by default and cleans up with -cleanup
+func runLegacy(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet(programName, flag.ContinueOnError)
+	fs.Usage = func() {
+		printUsage()
+		fmt.Fprintln(fs.Output(), "\nLegacy flags:")
+		fs.PrintDefaults()
+	}
+	cf := addConfigFlags(fs, false)
+	cleanUpCountPtr := fs.String("cleanup", "", "clean up database and AWS resources: all, <number of tenants> or <run manifest>.json")
+	dryRun := fs.Bool("dry-run", false, "print what would be created or deleted without changing anything")
+	opts := addCleanupFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
 		}
+		return err
+	}
 
-		if count, err := strconv.Atoi(*cleanUpCountPtr); err == nil {
-			if count < 1 {
-				logrus.Errorf("Invalid count %d", count)
-				return
-			} else {
-				CleanUp(ctx, count)
-				return
+	return withBackends(ctx, cf, func(conf model.Config, gw aws.KeyGateway, store database.Store) error {
+		if *cleanUpCountPtr == "" {
+			if *dryRun {
+				PlanCreate(ctx, conf, store)
+				return nil
 			}
-		} else {
-			logrus.Errorf("Invalid count %d", count)
+			logrus.Info("Starting Creating API keys")
+			return Create(ctx, conf, gw, store)
 		}
-	}
+		logrus.Info("Cleaning up")
+		return cleanupTarget(ctx, conf, gw, store, *cleanUpCountPtr, *dryRun, *opts, CleanupSelector{})
+	})
 }
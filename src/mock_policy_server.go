@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
+	"github.com/apikey-gen/model"
+	"github.com/apikey-gen/policyserver"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func RunMockPolicyServer(ctx context.Context, args []string) error {
+	fs := newFlagSet("mock-policy-server")
+	addr := fs.String("addr", ":8080", "address to listen on")
+	configFile := fs.String("config", defaultConfigFile(), "config file, used with -validate db")
+	validate := fs.String("validate", "any", "how x-api-key is validated: any, keys or db")
+	keysFile := fs.String("keys-file", "", "file with one accepted full key per line, optionally followed by ,<tenant id>")
+	latency := fs.Duration("latency", 0, "latency added to every request")
+	errorRate := fs.Float64("error-rate", 0, "probability (0-1) of answering with -error-status")
+	errorStatus := fs.Int("error-status", 500, "status code used for injected failures")
+	failFirst := fs.Int("fail-first", 0, "answer the first n requests with -error-status")
+	rateLimit := fs.Float64("rate-limit", 0, "requests per second before answering 429, 0 disables")
+	rateBurst := fs.Int("rate-burst", 0, "burst allowed by -rate-limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	var validator policyserver.KeyValidator
+	switch *validate {
+	case "any":
+		validator = policyserver.AllowAll()
+	case "keys":
+		keys, err := readKeysFile(*keysFile)
+		if err != nil {
+			return err
+		}
+		validator = policyserver.StaticKeys(keys)
+	case "db":
+		v, err := dbKeyValidator(ctx, *configFile)
+		if err != nil {
+			return err
+		}
+		validator = v
+	default:
+		return fmt.Errorf("unknown -validate mode %s", *validate)
+	}
+
+	server := policyserver.New(validator, policyserver.Options{
+		Latency:     *latency,
+		ErrorRate:   *errorRate,
+		ErrorStatus: *errorStatus,
+		FailFirst:   *failFirst,
+		RateLimit:   *rateLimit,
+		RateBurst:   *rateBurst,
+	})
+	return server.ListenAndServe(ctx, *addr)
+}
+
+func readKeysFile(fileName string) (map[string]string, error) {
+	if fileName == "" {
+		return nil, fmt.Errorf("-keys-file is required with -validate keys")
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, tenantId, _ := strings.Cut(line, ",")
+		if tenantId == "" {
+			tenantId = key
+		}
+		keys[strings.TrimSpace(key)] = strings.TrimSpace(tenantId)
+	}
+	return keys, scanner.Err()
+}
+
+// dbKeyValidator accepts full keys whose subscription exists and whose gateway key value matches. Memory backends
+// are loaded again when their files change, those are written when a command exits.
+func dbKeyValidator(ctx context.Context, configFile string) (policyserver.KeyValidator, error) {
+	conf, err := model.GetConfig(ctx, configFile)
+	if err != nil {
+		return nil, err
+	}
+	backends := &reloadingBackends{ctx: ctx, conf: conf}
+	if strings.ToLower(conf.AwsConf.Backend) == "memory" && conf.AwsConf.MemoryFile != "" {
+		backends.files = append(backends.files, conf.AwsConf.MemoryFile)
+	}
+	if strings.ToLower(conf.DbConf.Driver) == "memory" && conf.DbConf.MemoryFile != "" {
+		backends.files = append(backends.files, conf.DbConf.MemoryFile)
+	}
+	backends.modTimes = make([]time.Time, len(backends.files))
+	if _, _, err := backends.get(); err != nil {
+		return nil, err
+	}
+
+	return policyserver.ValidatorFunc(func(ctx context.Context, fullKey string) (string, error) {
+		k, err := fullkey.Decode(fullKey)
+		if err != nil {
+			return "", policyserver.ErrUnauthorized
+		}
+		gw, store, err := backends.get()
+		if err != nil {
+			return "", err
+		}
+		subscription, err := store.GetSubscriptionByVariableKey(ctx, k.VariableKey)
+		if err != nil || subscription.Status != "Active" {
+			return "", policyserver.ErrUnauthorized
+		}
+		key, err := gw.GetKey(ctx, subscription.ExternalId)
+		if errors.Is(err, aws.ErrNotFound) {
+			return "", policyserver.ErrUnauthorized
+		} else if err != nil {
+			return "", err
+		}
+		if !key.Enabled || key.Value != k.ApiKey {
+			return "", policyserver.ErrUnauthorized
+		}
+		return subscription.TenantId.String(), nil
+	}), nil
+}
+
+// reloadingBackends opens the backends of conf again when one of files changed since they were opened
+type reloadingBackends struct {
+	ctx      context.Context
+	conf     model.Config
+	files    []string
+	mu       sync.Mutex
+	modTimes []time.Time
+	gw       aws.KeyGateway
+	store    database.Store
+}
+
+func (b *reloadingBackends) get() (aws.KeyGateway, database.Store, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	changed := b.gw == nil
+	previous := append([]time.Time{}, b.modTimes...)
+	for i, f := range b.files {
+		if info, err := os.Stat(f); err == nil && !info.ModTime().Equal(b.modTimes[i]) {
+			b.modTimes[i], changed = info.ModTime(), true
+		}
+	}
+	if !changed {
+		return b.gw, b.store, nil
+	}
+	gw, _, err := NewGateway(b.ctx, b.conf)
+	if err == nil {
+		var store database.Store
+		if store, _, err = NewStore(b.ctx, b.conf); err == nil {
+			b.gw, b.store = gw, store
+			return b.gw, b.store, nil
+		}
+	}
+	// a file being written is read again with the next request
+	b.modTimes = previous
+	if b.gw == nil {
+		return nil, nil, err
+	}
+	logrus.Warnf("error in reloading backends, using the previous state, %v", err)
+	return b.gw, b.store, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStderr returns what fn writes to stderr, where flag sets print their usage
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	fn()
+	os.Stderr = stderr
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestMockPolicyServerFlags(t *testing.T) {
+	ctx := context.Background()
+	var err error
+	usage := captureStderr(t, func() { err = runCommand(ctx, []string{"mock-policy-server", "-help"}) })
+	if err != nil {
+		t.Errorf("help: got %v, want nil like every command", err)
+	}
+	if !strings.HasPrefix(usage, "Usage: api-key-gen mock-policy-server [flags]\n\nServe a local mock") {
+		t.Errorf("got usage\n%s\nwant the usage line and description of the command", usage)
+	}
+
+	for _, args := range [][]string{{"extra"}, {"-validate", "tokens"}, {"-validate", "keys"}} {
+		captureStderr(t, func() { err = RunMockPolicyServer(ctx, args) })
+		if err == nil {
+			t.Errorf("%v: got no error", args)
+		}
+	}
+}
+
+func TestReadKeysFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "keys.txt")
+	content := "# accepted keys\nkey1\n\n key2 , tenant2\n"
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := readKeysFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"key1": "key1", "key2": "tenant2"}
+	if len(keys) != len(want) || keys["key1"] != want["key1"] || keys["key2"] != want["key2"] {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// rough latencies used for the duration estimate of a plan
+const (
+	gatewayCallEstimate = 250 * time.Millisecond
+	policyCallEstimate  = 300 * time.Millisecond
+)
+
+// PlanCreate prints what Create would make without touching AWS, the policy api or the database
+func PlanCreate(ctx context.Context, conf model.Config, store database.Store) {
+	rd := conf.RequiredDetail
+	pc := conf.PoliciesConfig
+
+	tenants := rd.TenantsCount
+	mgmtKeys := tenants * rd.MagtKeyPerTenant
+	attKeys := tenants * rd.AttKeyPerTenant
+	policies := tenants * pc.PolicyCount
+	// every attestation key gets a random number of policies in [0, policies_per_tennant)
+	maxSubscriptionPolicies := attKeys * max(pc.PolicyCount-1, 0)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CREATE PLAN (dry run, nothing is created)")
+	fmt.Fprintf(w, "Tenants\t%d\t(email domain %s)\n", tenants, rd.EmailDomain)
+	fmt.Fprintf(w, "Services\t%d\n", tenants)
+	fmt.Fprintf(w, "Management keys\t%d\t(%d per tenant)\n", mgmtKeys, rd.MagtKeyPerTenant)
+	fmt.Fprintf(w, "Attestation keys\t%d\t(%d per tenant)\n", attKeys, rd.AttKeyPerTenant)
+	fmt.Fprintf(w, "Policies\t%d\t(%d per tenant)\n", policies, pc.PolicyCount)
+	fmt.Fprintf(w, "Subscription policies\tup to %d\t(about %d)\n", maxSubscriptionPolicies, maxSubscriptionPolicies/2)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "Key type\tProduct id\tUsage plan (product external id)")
+	for _, p := range []struct{ keyType, productId string }{
+		{"management", rd.ManagementProductId},
+		{"attestation", rd.AttestationProductId},
+	} {
+		usagePlan := "-"
+		if id, err := uuid.Parse(p.productId); err != nil {
+			usagePlan = fmt.Sprintf("invalid product id: %v", err)
+		} else if extId, err := store.GetProductExtId(ctx, id); err != nil {
+			usagePlan = fmt.Sprintf("error: %v", err)
+		} else if extId == "" {
+			usagePlan = "NOT FOUND"
+		} else {
+			usagePlan = extId
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p.keyType, p.productId, usagePlan)
+	}
+	fmt.Fprintln(w)
+
+	probe := NewReadinessProbe(pc)
+	keyCalls := time.Duration(rd.MagtKeyPerTenant+rd.AttKeyPerTenant) * 2 * gatewayCallEstimate
+	policyCalls := time.Duration(pc.PolicyCount) * policyCallEstimate
+	perTenant := keyCalls + policyCalls
+	fmt.Fprintf(w, "Estimated duration\t%v - %v\t(tenants run in parallel, upper bound assumes the full readiness timeout of %v)\n",
+		perTenant.Round(time.Second), (perTenant + probe.Timeout).Round(time.Second), probe.Timeout)
+	w.Flush()
+}
+
+// PlanCleanUpSelected prints what CleanUpSelected would delete without deleting anything
+func PlanCleanUpSelected(ctx context.Context, conf model.Config, gw aws.KeyGateway, store database.Store, sel CleanupSelector, count ...int) {
+	resources, err := SelectTenants(ctx, gw, store, conf.RequiredDetail.EmailDomain, sel, count...)
+	if err != nil {
+		logrus.Errorf("error in selecting tenants %v", err)
+		return
+	}
+	printTenantResources(fmt.Sprintf("CLEANUP PLAN for %s (dry run, nothing is deleted)", sel.describe(conf.RequiredDetail.EmailDomain)), resources)
+}
+
+// PlanCleanUpManifest prints what CleanUpManifest would delete for a run
+func PlanCleanUpManifest(ctx context.Context, store database.Store, manifest *model.Manifest) {
+	resources, err := store.GetTenantResources(ctx, manifest.TenantIds())
+	if err != nil {
+		logrus.Errorf("error in getting tenant resources %v", err)
+		return
+	}
+	printTenantResources(fmt.Sprintf("CLEANUP PLAN for run %s (dry run, nothing is deleted)", manifest.RunId), resources)
+	fmt.Printf("Manifest: %d gateway keys, %d subscriptions, %d policies, %d services\n",
+		len(manifest.KeyIds()), len(manifest.SubscriptionIds()), len(manifest.PolicyIds()), len(manifest.ServiceIds()))
+}
+
+func printTenantResources(title string, resources []model.TenantResources) {
+	var subscriptions, policies, services, subscriptionPolicies int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, title)
+	fmt.Fprintln(w, "Tenant id\tEmail\tServices\tSubscriptions\tPolicies\tSubscription policies\tGateway key ids")
+	for _, r := range resources {
+		keyIds := make([]string, 0, len(r.Subscriptions))
+		for _, s := range r.Subscriptions {
+			keyIds = append(keyIds, s.ExternalId)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", r.TenantId, r.Email, len(r.ServiceIds), len(r.Subscriptions), len(r.PolicyIds),
+			r.SubscriptionPolicies, strings.Join(keyIds, ","))
+		subscriptions += len(r.Subscriptions)
+		policies += len(r.PolicyIds)
+		services += len(r.ServiceIds)
+		subscriptionPolicies += r.SubscriptionPolicies
+	}
+	fmt.Fprintf(w, "TOTAL %d tenants\t\t%d\t%d\t%d\t%d\t%d gateway keys\n", len(resources), services, subscriptions, policies, subscriptionPolicies, subscriptions)
+	w.Flush()
+}
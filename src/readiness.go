@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/apikey-gen/model"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReadinessTimeout         = 5 * time.Minute
+	defaultReadinessInitialInterval = 2 * time.Second
+	defaultReadinessMaxInterval     = 30 * time.Second
+)
+
+// ReadinessProbe polls the policy api with a newly created management key until API Gateway accepts it
+type ReadinessProbe struct {
+	Url             string
+	Timeout         time.Duration
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+
+	mu    sync.Mutex
+	waits []time.Duration
+	fails int
+}
+
+func NewReadinessProbe(conf model.PoliciesConfig) *ReadinessProbe {
+	p := &ReadinessProbe{
+		Url:             conf.ReadinessUrl,
+		Timeout:         conf.ReadinessTimeout,
+		InitialInterval: conf.ReadinessInitialInterval,
+		MaxInterval:     conf.ReadinessMaxInterval,
+	}
+	if p.Url == "" {
+		p.Url = conf.Url
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultReadinessTimeout
+	}
+	if p.InitialInterval <= 0 {
+		p.InitialInterval = defaultReadinessInitialInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = defaultReadinessMaxInterval
+	}
+	return p
+}
+
+// Wait blocks until the key is accepted, backing off exponentially, and returns how long it took
+func (p *ReadinessProbe) Wait(ctx context.Context, managementKey string) (time.Duration, error) {
+	start := time.Now()
+	deadline := start.Add(p.Timeout)
+	interval := p.InitialInterval
+	for attempt := 1; ; attempt++ {
+		status, err := p.check(ctx, managementKey)
+		if err == nil && status >= 200 && status < 300 {
+			waited := time.Since(start)
+			logrus.Infof("Management key accepted after %v (%d attempts)", waited.Round(time.Millisecond), attempt)
+			p.record(waited, false)
+			return waited, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			waited := time.Since(start)
+			p.record(waited, true)
+			if err != nil {
+				return waited, fmt.Errorf("management key not accepted after %v: %v", waited.Round(time.Millisecond), err)
+			}
+			return waited, fmt.Errorf("management key not accepted after %v, last status %d", waited.Round(time.Millisecond), status)
+		}
+		if interval > remaining {
+			interval = remaining
+		}
+		if err != nil {
+			logrus.Infof("Management key not ready (%v), retrying in %v", err, interval)
+		} else {
+			logrus.Infof("Management key not ready (status %d), retrying in %v", status, interval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Since(start), ctx.Err()
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > p.MaxInterval {
+			interval = p.MaxInterval
+		}
+	}
+}
+
+func (p *ReadinessProbe) check(ctx context.Context, managementKey string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("x-api-key", managementKey)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+func (p *ReadinessProbe) record(waited time.Duration, failed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waits = append(p.waits, waited)
+	if failed {
+		p.fails++
+	}
+}
+
+// Summary describes the waits recorded so far
+func (p *ReadinessProbe) Summary() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waits) == 0 {
+		return "no management keys were probed"
+	}
+	var total, min, max time.Duration
+	min = p.waits[0]
+	for _, w := range p.waits {
+		total += w
+		if w < min {
+			min = w
+		}
+		if w > max {
+			max = w
+		}
+	}
+	avg := total / time.Duration(len(p.waits))
+	return fmt.Sprintf("%d management keys probed, %d timed out, wait min %v avg %v max %v, total %v",
+		len(p.waits), p.fails, min.Round(time.Millisecond), avg.Round(time.Millisecond), max.Round(time.Millisecond), total.Round(time.Millisecond))
+}
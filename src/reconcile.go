@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// orphanedStatus is the status reconcile -subscriptions mark gives dangling subscriptions
+const orphanedStatus = "Orphaned"
+
+// ReconcileOptions select what reconcile repairs, nothing by default
+type ReconcileOptions struct {
+	//MinAge leaves out keys and subscriptions younger than it, a running create has keys without committed rows
+	MinAge     time.Duration
+	DeleteKeys bool
+	//Subscriptions is "mark" to set dangling subscriptions to orphanedStatus, "delete" to delete them or empty
+	Subscriptions string
+	//Yes skips the prompt, Confirm must then repeat the email domain
+	Yes       bool
+	Confirm   string
+	MaxRepair int
+}
+
+// OrphanKey is a gateway key tagged by the tool that no subscription points to
+type OrphanKey struct {
+	Key    aws.ApiKey
+	Age    time.Duration
+	Recent bool
+}
+
+// DanglingSubscription is a subscription whose external_id is not an API Gateway key
+type DanglingSubscription struct {
+	model.Subscription
+	Email  string
+	Age    time.Duration
+	Recent bool
+}
+
+// Orphans is what reconcile found
+type Orphans struct {
+	Keys          []OrphanKey
+	Subscriptions []DanglingSubscription
+}
+
+// FindOrphans joins the gateway keys tagged operation=perf_testing against subscription.external_id, both ways.
+// Dangling subscriptions are only looked for among the tenants of emailDomain.
+func FindOrphans(ctx context.Context, gw aws.KeyGateway, store database.Store, emailDomain string, minAge time.Duration) (Orphans, error) {
+	var orphans Orphans
+	now := time.Now()
+	keys, err := gw.ListKeysByTag(ctx, aws.TagOperation, aws.OperationPerfTesting)
+	if err != nil {
+		return orphans, fmt.Errorf("error in listing gateway keys %v", err)
+	}
+	keyIds := make([]string, 0, len(keys))
+	tagged := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		keyIds = append(keyIds, k.Id)
+		tagged[k.Id] = true
+	}
+	subscriptions, err := store.GetSubscriptionsByExternalIds(ctx, keyIds)
+	if err != nil {
+		return orphans, fmt.Errorf("error in getting subscriptions of gateway keys %v", err)
+	}
+	known := make(map[string]bool, len(subscriptions))
+	for _, s := range subscriptions {
+		known[s.ExternalId] = true
+	}
+	for _, k := range keys {
+		if known[k.Id] {
+			continue
+		}
+		age := now.Sub(k.CreatedDate)
+		orphans.Keys = append(orphans.Keys, OrphanKey{Key: k, Age: age, Recent: age < minAge})
+	}
+	sort.Slice(orphans.Keys, func(i, j int) bool { return orphans.Keys[i].Age > orphans.Keys[j].Age })
+
+	tenantIds, err := store.SelectTenantIds(ctx, database.TenantSelector{EmailDomain: emailDomain})
+	if err != nil {
+		return orphans, fmt.Errorf("error in selecting tenants %v", err)
+	}
+	resources, err := store.GetTenantResources(ctx, tenantIds)
+	if err != nil {
+		return orphans, fmt.Errorf("error in getting tenant resources %v", err)
+	}
+	for _, r := range resources {
+		for _, s := range r.Subscriptions {
+			if tagged[s.ExternalId] {
+				continue
+			}
+			// keys created before they were tagged are not listed, so ask for the key itself
+			if s.ExternalId != "" {
+				_, err := gw.GetKey(ctx, s.ExternalId)
+				if err == nil {
+					continue
+				}
+				if !errors.Is(err, aws.ErrNotFound) {
+					return orphans, fmt.Errorf("error in getting gateway key %s, %v", s.ExternalId, err)
+				}
+			}
+			age := now.Sub(s.CreatedAt)
+			orphans.Subscriptions = append(orphans.Subscriptions, DanglingSubscription{Subscription: s, Email: r.Email, Age: age, Recent: age < minAge})
+		}
+	}
+	sort.Slice(orphans.Subscriptions, func(i, j int) bool { return orphans.Subscriptions[i].Age > orphans.Subscriptions[j].Age })
+	return orphans, nil
+}
+
+// repairable counts what opts would change, recent orphans are never repaired
+func (o Orphans) repairable(opts ReconcileOptions) (keys []string, subscriptions []uuid.UUID) {
+	if opts.DeleteKeys {
+		for _, k := range o.Keys {
+			if !k.Recent {
+				keys = append(keys, k.Key.Id)
+			}
+		}
+	}
+	if opts.Subscriptions != "" {
+		for _, s := range o.Subscriptions {
+			if !s.Recent && !(opts.Subscriptions == "mark" && s.Status == orphanedStatus) {
+				subscriptions = append(subscriptions, s.ID)
+			}
+		}
+	}
+	return keys, subscriptions
+}
+
+// RepairOrphans deletes orphan keys and marks or deletes dangling subscriptions as opts say
+func RepairOrphans(ctx context.Context, gw aws.KeyGateway, store database.Store, emailDomain string, orphans Orphans, opts ReconcileOptions) error {
+	keyIds, subscriptionIds := orphans.repairable(opts)
+	if len(keyIds) == 0 && len(subscriptionIds) == 0 {
+		logrus.Info("Nothing to repair")
+		return nil
+	}
+	if opts.MaxRepair > 0 && len(keyIds)+len(subscriptionIds) > opts.MaxRepair {
+		return fmt.Errorf("%w: %d keys and %d subscriptions would be repaired, more than -max-repair %d", ErrAborted, len(keyIds), len(subscriptionIds), opts.MaxRepair)
+	}
+	if opts.Yes && opts.Confirm != emailDomain {
+		return fmt.Errorf("%w: -yes requires -confirm=%s", ErrAborted, emailDomain)
+	}
+	if !opts.Yes && !confirmRepair(len(keyIds), len(subscriptionIds), opts.Subscriptions) {
+		return ErrAborted
+	}
+
+	var errs []error
+	for i, id := range keyIds {
+		if ctx.Err() != nil {
+			return gatewayCleanupError(i, len(errs), ctx.Err())
+		}
+		if err := ignoreNotFound(gw.DeleteKey(ctx, id)); err != nil {
+			errs = append(errs, err)
+			logrus.Errorf("Error in deleting orphan key %s %v", id, err)
+			continue
+		}
+		logrus.Infof("Deleted orphan key %s", id)
+	}
+
+	if len(subscriptionIds) > 0 {
+		if err := repairSubscriptions(ctx, store, subscriptionIds, opts.Subscriptions); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func repairSubscriptions(ctx context.Context, store database.Store, subscriptionIds []uuid.UUID, mode string) error {
+	tx, err := store.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error in starting transaction %v", err)
+	}
+	defer tx.Rollback()
+	switch mode {
+	case "mark":
+		err = tx.UpdateSubscriptionStatus(ctx, subscriptionIds, orphanedStatus)
+	case "delete":
+		if err = tx.DeleteSubscriptionPoliciesBySubscriptionIds(ctx, subscriptionIds); err == nil {
+			err = tx.DeleteSubscriptionsByIds(ctx, subscriptionIds)
+		}
+	default:
+		err = fmt.Errorf("unknown subscription repair %q, use mark or delete", mode)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error in committing subscription repair %v", err)
+	}
+	return nil
+}
+
+func confirmRepair(keys, subscriptions int, mode string) bool {
+	var resp string
+	fmt.Printf("Delete %d orphan keys and %s %d dangling subscriptions? (yes/no)\n", keys, mode, subscriptions)
+	for {
+		if _, err := fmt.Scanln(&resp); err != nil {
+			return false
+		}
+		switch resp {
+		case "yes":
+			return true
+		case "no":
+			return false
+		default:
+			logrus.Info("Type yes/no")
+		}
+	}
+}
+
+// printOrphans writes the orphan keys and dangling subscriptions tables
+func printOrphans(w io.Writer, orphans Orphans, minAge time.Duration) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	recent := func(r bool) string {
+		if r {
+			return fmt.Sprintf("younger than %v, left alone", minAge)
+		}
+		return ""
+	}
+	fmt.Fprintf(tw, "ORPHAN GATEWAY KEYS (%d), tagged %s=%s without a subscription\n", len(orphans.Keys), aws.TagOperation, aws.OperationPerfTesting)
+	fmt.Fprintln(tw, "Key id\tName\tMaintainer\tCreated\tAge\tNote")
+	for _, k := range orphans.Keys {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", k.Key.Id, k.Key.Name, k.Key.Tags[aws.TagMaintainer], k.Key.CreatedDate.UTC().Format(time.RFC3339), k.Age.Round(time.Minute), recent(k.Recent))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintf(tw, "DANGLING SUBSCRIPTIONS (%d), external_id not in API Gateway\n", len(orphans.Subscriptions))
+	fmt.Fprintln(tw, "Subscription id\tTenant id\tTenant email\tExternal id\tStatus\tCreated\tAge\tNote")
+	for _, s := range orphans.Subscriptions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.TenantId, s.Email, s.ExternalId, s.Status, s.CreatedAt.UTC().Format(time.RFC3339), s.Age.Round(time.Minute), recent(s.Recent))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/apikey-gen/aws"
+	"testing"
+	"time"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, 1, nil)
+	if err := Create(ctx, e.conf, e.gw, e.store); err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := e.gw.CreateKey(ctx, "orphan", "", aws.KeyTags("perf@example.com", "run-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dangling := e.keys(t, aws.TagRunId, e.manifests(t)[0].RunId)[0]
+	if err := e.gw.DeleteKey(ctx, dangling.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := FindOrphans(ctx, e.gw, e.store, testEmailDomain, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans.Keys) != 1 || orphans.Keys[0].Key.Id != orphan.Id || !orphans.Keys[0].Recent {
+		t.Fatalf("got orphan keys %+v, want the recent orphan key", orphans.Keys)
+	}
+	if len(orphans.Subscriptions) != 1 || orphans.Subscriptions[0].ExternalId != dangling.Id || !orphans.Subscriptions[0].Recent {
+		t.Fatalf("got dangling subscriptions %+v, want the recent one of the deleted key", orphans.Subscriptions)
+	}
+	// younger than -min-age, nothing is repaired
+	if err := RepairOrphans(ctx, e.gw, e.store, testEmailDomain, orphans, ReconcileOptions{DeleteKeys: true, Subscriptions: "delete", Yes: true, Confirm: testEmailDomain}); err != nil {
+		t.Fatal(err)
+	}
+
+	if orphans, err = FindOrphans(ctx, e.gw, e.store, testEmailDomain, 0); err != nil {
+		t.Fatal(err)
+	}
+	aborted := []struct {
+		name  string
+		opts  ReconcileOptions
+		stdin string
+	}{
+		{name: "declined", opts: ReconcileOptions{DeleteKeys: true, Subscriptions: "mark"}, stdin: "no\n"},
+		{name: "yes without confirm", opts: ReconcileOptions{DeleteKeys: true, Yes: true}},
+		{name: "max repair", opts: ReconcileOptions{DeleteKeys: true, Subscriptions: "mark", Yes: true, Confirm: testEmailDomain, MaxRepair: 1}},
+	}
+	for _, tt := range aborted {
+		t.Run(tt.name, func(t *testing.T) {
+			withStdin(t, tt.stdin, func() {
+				err = RepairOrphans(ctx, e.gw, e.store, testEmailDomain, orphans, tt.opts)
+			})
+			if !errors.Is(err, ErrAborted) {
+				t.Errorf("got %v, want %v", err, ErrAborted)
+			}
+		})
+	}
+	if orphans, err = FindOrphans(ctx, e.gw, e.store, testEmailDomain, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans.Keys) != 1 || len(orphans.Subscriptions) != 1 {
+		t.Fatalf("got %d orphan keys and %d dangling subscriptions after aborted repairs, want 1 and 1", len(orphans.Keys), len(orphans.Subscriptions))
+	}
+
+	withStdin(t, "yes\n", func() {
+		err = RepairOrphans(ctx, e.gw, e.store, testEmailDomain, orphans, ReconcileOptions{DeleteKeys: true, Subscriptions: "mark"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orphans, err = FindOrphans(ctx, e.gw, e.store, testEmailDomain, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans.Keys) != 0 {
+		t.Errorf("got orphan keys %+v after the repair, want none", orphans.Keys)
+	}
+	if len(orphans.Subscriptions) != 1 || orphans.Subscriptions[0].Status != orphanedStatus {
+		t.Fatalf("got dangling subscriptions %+v, want the one marked %s", orphans.Subscriptions, orphanedStatus)
+	}
+	if keys, subscriptions := orphans.repairable(ReconcileOptions{Subscriptions: "mark"}); len(keys)+len(subscriptions) != 0 {
+		t.Errorf("marked subscription is marked again")
+	}
+
+	if err := RepairOrphans(ctx, e.gw, e.store, testEmailDomain, orphans, ReconcileOptions{Subscriptions: "delete", Yes: true, Confirm: testEmailDomain}); err != nil {
+		t.Fatal(err)
+	}
+	if orphans, err = FindOrphans(ctx, e.gw, e.store, testEmailDomain, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(orphans.Subscriptions) != 0 {
+		t.Errorf("got dangling subscriptions %+v after the delete, want none", orphans.Subscriptions)
+	}
+	if rows := e.rows(t, e.tenantIds(t)); rows["subscription"] != 2 {
+		t.Errorf("got rows %v, want the 2 subscriptions with keys left", rows)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apikey-gen/crypt"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/export"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reportColumns are the columns of the csv report format
+var reportColumns = []string{"run_id", "tenant_id", "service_id", "id", "key_type", "product_id", "key_id", "variable_key", "api_key", "version", "full_key", "policy_ids"}
+
+// ReportOptions decide how ExportToFile writes a report
+type ReportOptions struct {
+	//Format is one of model.ReportFormats, Template is report_tmpl and Templates are used by "gotemplate"
+	Format    string
+	Template  string
+	Templates model.ReportTemplateConf
+	//Header and Tenants fill in the header and the tenant and service fields of "gotemplate" rows
+	Header         model.ReportHeader
+	Tenants        map[uuid.UUID]model.ReportTenant
+	PlanId         string
+	ServiceOfferId string
+	Encryption     crypt.Options
+}
+
+// newReportOptions are the report options of conf, tenant emails are looked up in store for "gotemplate" reports
+func newReportOptions(ctx context.Context, conf model.Config, store database.Store, runId string, apiKeys []model.ApiKeyModel) ReportOptions {
+	rd := conf.RequiredDetail
+	opts := ReportOptions{
+		Format:         rd.ReportFormat,
+		Template:       rd.ReportTmpl,
+		Templates:      conf.ReportTemplate,
+		Header:         model.ReportHeader{RunId: runId, Time: time.Now().UTC(), Keys: len(apiKeys)},
+		Tenants:        map[uuid.UUID]model.ReportTenant{},
+		PlanId:         conf.PoliciesConfig.PlanId,
+		ServiceOfferId: conf.PoliciesConfig.ServiceOfferId,
+		Encryption:     rd.ReportEncryption(),
+	}
+	tenantIds := make([]uuid.UUID, 0)
+	for _, k := range apiKeys {
+		if _, ok := opts.Tenants[k.TenantId]; !ok {
+			opts.Tenants[k.TenantId] = model.ReportTenant{Id: k.TenantId}
+			tenantIds = append(tenantIds, k.TenantId)
+		}
+	}
+	opts.Header.Tenants = len(tenantIds)
+	if opts.Format != "gotemplate" {
+		return opts
+	}
+	resources, err := store.GetTenantResources(ctx, tenantIds)
+	if err != nil {
+		logrus.Warnf("error in getting tenant emails for the report, they are left empty, %v", err)
+		return opts
+	}
+	for _, r := range resources {
+		opts.Tenants[r.TenantId] = model.ReportTenant{Id: r.TenantId, Email: r.Email}
+	}
+	return opts
+}
+
+// ExportToFile writes the report of apiKeys in opts.Format, the legacy report_tmpl lines when it is empty. The file
+// is only readable by its owner and, with opts.Encryption, encrypted to fileName.age; the name written is returned.
+func ExportToFile(ctx context.Context, fileName string, opts ReportOptions, apiKeys []model.ApiKeyModel) (string, error) {
+	if len(apiKeys) == 0 {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	var err error
+	switch opts.Format {
+	case "", "template":
+		err = writeTemplateReport(&buf, opts.Template, apiKeys)
+	case "gotemplate":
+		err = writeGoTemplateReport(&buf, opts, apiKeys)
+	case "csv":
+		err = writeCsvReport(&buf, apiKeys)
+	case "json":
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(apiKeys)
+	case "jsonl":
+		enc := json.NewEncoder(&buf)
+		for _, apiKey := range apiKeys {
+			if err = enc.Encode(apiKey); err != nil {
+				break
+			}
+		}
+	case "yaml":
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err = enc.Encode(apiKeys); err == nil {
+			err = enc.Close()
+		}
+	default:
+		err = fmt.Errorf("unknown report format %q", opts.Format)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error in writing report %s, %v", fileName, err)
+	}
+	written, err := crypt.WriteFile(fileName, buf.Bytes(), opts.Encryption)
+	if err != nil {
+		return "", fmt.Errorf("error in writing report %s, %v", fileName, err)
+	}
+	return written, nil
+}
+
+// writeTemplateReport replaces the {{field}} placeholders of template, the header line holds the field names
+func writeTemplateReport(w io.Writer, template string, apiKeys []model.ApiKeyModel) error {
+	fields := model.ApiKeyModelFields()
+	header := expandPlaceholders(template, func(field string) (string, bool) { return field, fields[field] })
+	lines := []string{header}
+
+	for _, apiKey := range apiKeys {
+		values, err := reportValues(apiKey)
+		if err != nil {
+			return err
+		}
+		line := expandPlaceholders(template, func(field string) (string, bool) {
+			value, ok := values[field]
+			return value, ok
+		})
+		lines = append(lines, line)
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// expandPlaceholders replaces the placeholders of template that value knows, the same ones Config.Validate accepts
+func expandPlaceholders(template string, value func(field string) (string, bool)) string {
+	return model.ReportPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if v, ok := value(model.ReportPlaceholder.FindStringSubmatch(placeholder)[1]); ok {
+			return v
+		}
+		return placeholder
+	})
+}
+
+// writeGoTemplateReport executes the header template once and the row template of its key type for every key
+func writeGoTemplateReport(w io.Writer, opts ReportOptions, apiKeys []model.ApiKeyModel) error {
+	templates, err := opts.Templates.Parse()
+	if err != nil {
+		return err
+	}
+	if templates.Header != nil {
+		if err := templates.Header.Execute(w, opts.Header); err != nil {
+			return err
+		}
+	}
+	for i, apiKey := range apiKeys {
+		tmpl, err := templates.Row(apiKey.KeyType)
+		if err != nil {
+			return err
+		}
+		row := model.ReportRow{
+			ApiKeyModel: apiKey,
+			Index:       i,
+			Tenant:      opts.Tenants[apiKey.TenantId],
+			Service:     model.ReportService{Id: apiKey.ServiceId, PlanId: opts.PlanId, ServiceOfferId: opts.ServiceOfferId},
+		}
+		if err := tmpl.Execute(w, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCsvReport writes RFC 4180 csv, a field is quoted when it holds a comma, quote or line break
+func writeCsvReport(w io.Writer, apiKeys []model.ApiKeyModel) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(reportColumns); err != nil {
+		return err
+	}
+	for _, apiKey := range apiKeys {
+		values, err := reportValues(apiKey)
+		if err != nil {
+			return err
+		}
+		record := make([]string, 0, len(reportColumns))
+		for _, column := range reportColumns {
+			record = append(record, values[column])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// reportValues are the json fields of apiKey as text, lists are joined with " | "
+func reportValues(apiKey model.ApiKeyModel) (map[string]string, error) {
+	byt, err := json.Marshal(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]any{}
+	if err := json.Unmarshal(byt, &fields); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case nil:
+			values[key] = ""
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, " | ")
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	values["policy_id"] = values["policy_ids"]
+	return values, nil
+}
+
+// ExportLoadTools writes the load tool data files of ec.Tools next to reportFile and returns their names
+func ExportLoadTools(reportFile string, ec model.ExportConf, enc crypt.Options, apiKeys []model.ApiKeyModel) ([]string, error) {
+	opts := export.Options{TargetUrl: ec.TargetUrl, Method: ec.Method, BodyFile: ec.BodyFile, SplitKeyTypes: ec.SplitKeyTypes}
+	fileNames := make([]string, 0)
+	var errs []error
+	for _, tool := range ec.Tools {
+		files, err := export.Render(strings.TrimSpace(tool), reportFile, apiKeys, opts)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, f := range files {
+			fileName, err := crypt.WriteFile(f.Name, f.Data, enc)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error in writing %s, %v", f.Name, err))
+				continue
+			}
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	return fileNames, errors.Join(errs...)
+}
+
+// ReadReport reads the keys of a report, by its extension: json, jsonl, yaml or a csv with a header line, which
+// also reads the default report_tmpl. A report encrypted to .age is decrypted with identityFiles or passphrase.
+func ReadReport(fileName string, identityFiles []string, passphrase string) ([]model.ApiKeyModel, error) {
+	byt, err := readReportFile(fileName, identityFiles, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := make([]model.ApiKeyModel, 0)
+	switch strings.ToLower(filepath.Ext(strings.TrimSuffix(fileName, crypt.Ext))) {
+	case ".json":
+		err = json.Unmarshal(byt, &apiKeys)
+	case ".jsonl":
+		dec := json.NewDecoder(bytes.NewReader(byt))
+		for dec.More() {
+			var apiKey model.ApiKeyModel
+			if err = dec.Decode(&apiKey); err != nil {
+				break
+			}
+			apiKeys = append(apiKeys, apiKey)
+		}
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(byt, &apiKeys)
+	default:
+		apiKeys, err = readCsvReport(bytes.NewReader(byt))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error in reading report %s, %v", fileName, err)
+	}
+	return apiKeys, nil
+}
+
+// readReportFile returns the content of a report, decrypted when its name ends with .age
+func readReportFile(fileName string, identityFiles []string, passphrase string) ([]byte, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if !strings.HasSuffix(fileName, crypt.Ext) {
+		return io.ReadAll(f)
+	}
+	r, err := crypt.Decrypt(f, identityFiles, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("error in decrypting %s, %v", fileName, err)
+	}
+	return io.ReadAll(r)
+}
+
+func readCsvReport(r io.Reader) ([]model.ApiKeyModel, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := make([]model.ApiKeyModel, 0, len(records))
+	if len(records) == 0 {
+		return apiKeys, nil
+	}
+	header := records[0]
+	for line, record := range records[1:] {
+		var k model.ApiKeyModel
+		for i, column := range header {
+			value := record[i]
+			switch column {
+			case "tenant_id":
+				k.TenantId, err = parseOptionalUUID(value)
+			case "id", "subscription_id":
+				k.ID, err = parseOptionalUUID(value)
+			case "service_id":
+				k.ServiceId, err = parseOptionalUUID(value)
+			case "product_id":
+				k.ProductId, err = parseOptionalUUID(value)
+			case "variable_key":
+				k.VariableKey = value
+			case "api_key":
+				k.ApiKey = value
+			case "key_id":
+				k.KeyId = value
+			case "version":
+				k.Version = value
+			case "full_key":
+				k.FullKey = value
+			case "key_type":
+				k.KeyType = value
+			case "run_id":
+				k.RunId = value
+			case "policy_ids", "policy_id":
+				k.PolicyIds = []string{}
+				for _, id := range strings.Split(value, "|") {
+					if id = strings.TrimSpace(id); id != "" {
+						k.PolicyIds = append(k.PolicyIds, id)
+					}
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d column %s, %v", line+2, column, err)
+			}
+		}
+		apiKeys = append(apiKeys, k)
+	}
+	return apiKeys, nil
+}
+
+// parseOptionalUUID leaves an empty column as the nil uuid
+func parseOptionalUUID(value string) (uuid.UUID, error) {
+	if value == "" {
+		return uuid.Nil, nil
+	}
+	return uuid.Parse(value)
+}
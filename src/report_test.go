@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testReportKeys() []model.ApiKeyModel {
+	return []model.ApiKeyModel{
+		{
+			TenantId: uuid.New(), ServiceId: uuid.New(), ID: uuid.New(), VariableKey: uuid.NewString(), ApiKey: "value1",
+			KeyId: "key1", Version: "v1", FullKey: "full1", KeyType: "management", PolicyIds: []string{}, RunId: "run-1",
+		},
+		{
+			TenantId: uuid.New(), ServiceId: uuid.New(), ID: uuid.New(), VariableKey: uuid.NewString(), ApiKey: "value,\"2\"",
+			KeyId: "key2", Version: "v1", FullKey: "full2", KeyType: "attestation", ProductId: uuid.New(),
+			PolicyIds: []string{"p1", "p2"}, RunId: "run-1",
+		},
+	}
+}
+
+func TestReportFormatsRoundTrip(t *testing.T) {
+	tests := []struct {
+		format, fileName string
+	}{
+		{format: "csv", fileName: "report.csv"},
+		{format: "json", fileName: "report.json"},
+		{format: "jsonl", fileName: "report.jsonl"},
+		{format: "yaml", fileName: "report.yaml"},
+	}
+	keys := testReportKeys()
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), tt.fileName)
+			written, err := ExportToFile(context.Background(), fileName, ReportOptions{Format: tt.format}, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != fileName {
+				t.Errorf("got file %s, want %s", written, fileName)
+			}
+			got, err := ReadReport(written, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, keys) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, keys)
+			}
+		})
+	}
+	if _, err := ExportToFile(context.Background(), filepath.Join(t.TempDir(), "report.xml"), ReportOptions{Format: "xml"}, testReportKeys()); err == nil {
+		t.Error("unknown format is written")
+	}
+}
+
+func TestWriteCsvReport(t *testing.T) {
+	var b strings.Builder
+	if err := writeCsvReport(&b, testReportKeys()); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || !slices.Equal(records[0], reportColumns) {
+		t.Fatalf("got %v, want the header and 2 keys", records)
+	}
+	column := func(name string) int { return slices.Index(reportColumns, name) }
+	tests := []struct {
+		row          int
+		column, want string
+	}{
+		{row: 1, column: "product_id", want: uuid.Nil.String()},
+		{row: 1, column: "policy_ids", want: ""},
+		{row: 2, column: "api_key", want: "value,\"2\""},
+		{row: 2, column: "policy_ids", want: "p1 | p2"},
+		{row: 2, column: "run_id", want: "run-1"},
+	}
+	for _, tt := range tests {
+		if got := records[tt.row][column(tt.column)]; got != tt.want {
+			t.Errorf("row %d %s: got %q, want %q", tt.row, tt.column, got, tt.want)
+		}
+	}
+}
+
+func TestWriteTemplateReport(t *testing.T) {
+	apiKeys := []model.ApiKeyModel{
+		{KeyId: "key1", FullKey: "full1", KeyType: "management"},
+		{KeyId: "key2", FullKey: "full2", KeyType: "attestation", PolicyIds: []string{"p1", "p2"}},
+	}
+	tests := []struct {
+		name, template, want string
+	}{
+		{
+			name:     "placeholders",
+			template: "{{key_id}},{{full_key}},{{policy_id}}",
+			want:     "key_id,full_key,policy_id\nkey1,full1,\nkey2,full2,p1 | p2",
+		},
+		{
+			name:     "spaced placeholders",
+			template: "{{ key_id }},{{full_key }}",
+			want:     "key_id,full_key\nkey1,full1\nkey2,full2",
+		},
+		{
+			name:     "text around placeholders",
+			template: "key={{key_id}};type={{ key_type }}",
+			want:     "key=key_id;type=key_type\nkey=key1;type=management\nkey=key2;type=attestation",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := writeTemplateReport(&b, tt.template, apiKeys); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+// CleanupSelector narrows a cleanup of the email domain, the fields that are set must all match (AND). Maintainer
+// and RunId are read from the tags of the gateway keys of a tenant, the rest from its tenant row.
+type CleanupSelector struct {
+	Maintainer string
+	RunId      string
+	TenantIds  []uuid.UUID
+	OlderThan  time.Duration
+	//CreatedAfter and CreatedBefore are -created-between, the zero time leaves that side open
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func (s CleanupSelector) IsSet() bool {
+	return s.Maintainer != "" || s.RunId != "" || s.TenantIds != nil || s.OlderThan > 0 || !s.CreatedAfter.IsZero() || !s.CreatedBefore.IsZero()
+}
+
+// byTags tells whether tenants are also selected by the tags of their gateway keys
+func (s CleanupSelector) byTags() bool {
+	return s.Maintainer != "" || s.RunId != ""
+}
+
+// describe names the selection in logs and plans
+func (s CleanupSelector) describe(emailDomain string) string {
+	parts := []string{fmt.Sprintf("email domain %s", emailDomain)}
+	if s.Maintainer != "" {
+		parts = append(parts, fmt.Sprintf("maintainer %s", s.Maintainer))
+	}
+	if s.RunId != "" {
+		parts = append(parts, fmt.Sprintf("run id %s", s.RunId))
+	}
+	if s.TenantIds != nil {
+		parts = append(parts, fmt.Sprintf("%d tenant ids", len(s.TenantIds)))
+	}
+	if s.OlderThan > 0 {
+		parts = append(parts, fmt.Sprintf("older than %v", s.OlderThan))
+	}
+	if !s.CreatedAfter.IsZero() || !s.CreatedBefore.IsZero() {
+		parts = append(parts, fmt.Sprintf("created between %s and %s", formatBound(s.CreatedAfter), formatBound(s.CreatedBefore)))
+	}
+	return "tenants with " + strings.Join(parts, " and ")
+}
+
+func formatBound(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// tenantSelector is the database part of s, -older-than becomes an upper bound of created_at
+func (s CleanupSelector) tenantSelector(emailDomain string, limit int, now time.Time) database.TenantSelector {
+	sel := database.TenantSelector{EmailDomain: emailDomain, TenantIds: s.TenantIds, CreatedAfter: s.CreatedAfter, CreatedBefore: s.CreatedBefore, Limit: limit}
+	if s.OlderThan > 0 {
+		if cutoff := now.Add(-s.OlderThan); sel.CreatedBefore.IsZero() || cutoff.Before(sel.CreatedBefore) {
+			sel.CreatedBefore = cutoff
+		}
+	}
+	return sel
+}
+
+// SelectTenants resolves sel to the tenants of emailDomain and everything they own, at most count of them when
+// count is given. A tenant is selected by a tag when all of its gateway keys that still exist carry that tag value,
+// a tenant without any gateway key is never selected by a tag.
+func SelectTenants(ctx context.Context, gw aws.KeyGateway, store database.Store, emailDomain string, sel CleanupSelector, count ...int) ([]model.TenantResources, error) {
+	limit := 0
+	if len(count) > 0 {
+		limit = count[0]
+	}
+	dbLimit := limit
+	if sel.byTags() {
+		// the limit applies to the tenants left after the tag filter
+		dbLimit = 0
+	}
+	ids, err := store.SelectTenantIds(ctx, sel.tenantSelector(emailDomain, dbLimit, time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("error in selecting tenants %v", err)
+	}
+	resources, err := store.GetTenantResources(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("error in getting tenant resources %v", err)
+	}
+	if !sel.byTags() {
+		return resources, nil
+	}
+
+	keys, err := gw.ListKeysByTag(ctx, aws.TagOperation, aws.OperationPerfTesting)
+	if err != nil {
+		return nil, fmt.Errorf("error in listing gateway keys %v", err)
+	}
+	tags := make(map[string]map[string]string, len(keys))
+	for _, k := range keys {
+		tags[k.Id] = k.Tags
+	}
+	selected := make([]model.TenantResources, 0, len(resources))
+	for _, r := range resources {
+		if limit > 0 && len(selected) == limit {
+			break
+		}
+		if tenantTagsMatch(r, tags, sel) {
+			selected = append(selected, r)
+		}
+	}
+	return selected, nil
+}
+
+func tenantTagsMatch(r model.TenantResources, tags map[string]map[string]string, sel CleanupSelector) bool {
+	found := 0
+	for _, s := range r.Subscriptions {
+		keyTags, ok := tags[s.ExternalId]
+		if !ok {
+			continue
+		}
+		found++
+		if sel.Maintainer != "" && keyTags[aws.TagMaintainer] != sel.Maintainer {
+			return false
+		}
+		if sel.RunId != "" && keyTags[aws.TagRunId] != sel.RunId {
+			return false
+		}
+	}
+	return found > 0
+}
+
+// addSelectorFlags registers the cleanup selectors
+func addSelectorFlags(fs *flag.FlagSet) *CleanupSelector {
+	sel := &CleanupSelector{}
+	fs.StringVar(&sel.Maintainer, "maintainer", "", "only tenants whose gateway keys are tagged with this maintainer")
+	fs.StringVar(&sel.RunId, "run-id", "", "only tenants whose gateway keys are tagged with this run id")
+	fs.DurationVar(&sel.OlderThan, "older-than", 0, "only tenants created longer ago than this, e.g. 72h")
+	fs.Func("tenant-id", "only these tenants, comma separated, can be repeated", func(value string) error {
+		for _, id := range strings.Split(value, ",") {
+			uid, err := uuid.Parse(strings.TrimSpace(id))
+			if err != nil {
+				return fmt.Errorf("invalid tenant id %s, %v", id, err)
+			}
+			sel.TenantIds = append(sel.TenantIds, uid)
+		}
+		return nil
+	})
+	fs.Func("created-between", "only tenants created in <from>,<to>, RFC 3339 times or dates, either side may be empty", func(value string) error {
+		from, to, ok := strings.Cut(value, ",")
+		if !ok {
+			return fmt.Errorf("want <from>,<to>, got %q", value)
+		}
+		var err error
+		if sel.CreatedAfter, err = parseBound(from); err != nil {
+			return err
+		}
+		if sel.CreatedBefore, err = parseBound(to); err != nil {
+			return err
+		}
+		if !sel.CreatedAfter.IsZero() && !sel.CreatedBefore.IsZero() && !sel.CreatedAfter.Before(sel.CreatedBefore) {
+			return fmt.Errorf("%s is not before %s", from, to)
+		}
+		return nil
+	})
+	return sel
+}
+
+func parseBound(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 or YYYY-MM-DD", value)
+	}
+	return t, nil
+}
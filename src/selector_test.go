@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/apikey-gen/aws"
+	"github.com/google/uuid"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectorFlags(t *testing.T) {
+	id1, id2 := uuid.New(), uuid.New()
+	day := func(d int) time.Time { return time.Date(2024, time.March, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name    string
+		args    []string
+		want    CleanupSelector
+		wantErr bool
+	}{
+		{name: "none", want: CleanupSelector{}},
+		{name: "tags", args: []string{"-maintainer", "perf@example.com", "-run-id", "run-1"}, want: CleanupSelector{Maintainer: "perf@example.com", RunId: "run-1"}},
+		{name: "older than", args: []string{"-older-than", "72h"}, want: CleanupSelector{OlderThan: 72 * time.Hour}},
+		{name: "tenant ids", args: []string{"-tenant-id", id1.String() + ", " + id2.String()}, want: CleanupSelector{TenantIds: []uuid.UUID{id1, id2}}},
+		{name: "repeated tenant ids", args: []string{"-tenant-id", id1.String(), "-tenant-id", id2.String()}, want: CleanupSelector{TenantIds: []uuid.UUID{id1, id2}}},
+		{name: "invalid tenant id", args: []string{"-tenant-id", "tenant-1"}, wantErr: true},
+		{name: "created between dates", args: []string{"-created-between", "2024-03-01,2024-03-05"}, want: CleanupSelector{CreatedAfter: day(1), CreatedBefore: day(5)}},
+		{name: "created between times", args: []string{"-created-between", "2024-03-01T00:00:00Z, 2024-03-05T00:00:00Z"}, want: CleanupSelector{CreatedAfter: day(1), CreatedBefore: day(5)}},
+		{name: "created after", args: []string{"-created-between", "2024-03-01,"}, want: CleanupSelector{CreatedAfter: day(1)}},
+		{name: "created before", args: []string{"-created-between", ",2024-03-05"}, want: CleanupSelector{CreatedBefore: day(5)}},
+		{name: "created between one time", args: []string{"-created-between", "2024-03-01"}, wantErr: true},
+		{name: "created between reversed", args: []string{"-created-between", "2024-03-05,2024-03-01"}, wantErr: true},
+		{name: "created between invalid time", args: []string{"-created-between", "yesterday,"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			sel := addSelectorFlags(fs)
+			err := fs.Parse(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(*sel, tt.want) {
+				t.Errorf("got %+v, want %+v", *sel, tt.want)
+			}
+			if err == nil && sel.IsSet() != (len(tt.args) > 0) {
+				t.Errorf("got IsSet %v for %v", sel.IsSet(), tt.args)
+			}
+		})
+	}
+}
+
+func TestTenantSelectorOlderThan(t *testing.T) {
+	now := time.Date(2024, time.March, 10, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		sel  CleanupSelector
+		want time.Time
+	}{
+		{name: "older than", sel: CleanupSelector{OlderThan: 48 * time.Hour}, want: now.Add(-48 * time.Hour)},
+		{name: "earlier created before wins", sel: CleanupSelector{OlderThan: 48 * time.Hour, CreatedBefore: now.Add(-72 * time.Hour)}, want: now.Add(-72 * time.Hour)},
+		{name: "earlier cutoff wins", sel: CleanupSelector{OlderThan: 96 * time.Hour, CreatedBefore: now.Add(-72 * time.Hour)}, want: now.Add(-96 * time.Hour)},
+		{name: "no bound", sel: CleanupSelector{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.sel.tenantSelector(testEmailDomain, 5, now)
+			if !got.CreatedBefore.Equal(tt.want) || got.EmailDomain != testEmailDomain || got.Limit != 5 {
+				t.Errorf("got %+v, want created before %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectTenantsByTags(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, 2, nil)
+	if err := Create(ctx, e.conf, e.gw, e.store); err != nil {
+		t.Fatal(err)
+	}
+	first := e.manifests(t)[0]
+	e.conf.RequiredDetail.MaintainerEmail = "other@example.com"
+	if err := Create(ctx, e.conf, e.gw, e.store); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		sel   CleanupSelector
+		count []int
+		want  int
+	}{
+		{name: "all", want: 4},
+		{name: "count", count: []int{3}, want: 3},
+		{name: "run id", sel: CleanupSelector{RunId: first.RunId}, want: 2},
+		{name: "maintainer", sel: CleanupSelector{Maintainer: "other@example.com"}, want: 2},
+		{name: "maintainer and run id", sel: CleanupSelector{Maintainer: "other@example.com", RunId: first.RunId}, want: 0},
+		{name: "count after tags", sel: CleanupSelector{Maintainer: "perf@example.com"}, count: []int{1}, want: 1},
+		{name: "tenant ids", sel: CleanupSelector{TenantIds: first.TenantIds()}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SelectTenants(ctx, e.gw, e.store, testEmailDomain, tt.sel, tt.count...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Errorf("got %d tenants, want %d", len(got), tt.want)
+			}
+		})
+	}
+
+	// a tenant whose keys are gone is never selected by a tag
+	for _, k := range e.keys(t, aws.TagRunId, first.RunId) {
+		if err := e.gw.DeleteKey(ctx, k.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := SelectTenants(ctx, e.gw, e.store, testEmailDomain, CleanupSelector{RunId: first.RunId}); err != nil || len(got) != 0 {
+		t.Errorf("got %d tenants, %v, want none without keys", len(got), err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const undoTimeout = 2 * time.Minute
+
+// UndoLog collects compensating actions for everything a create unit made outside a database transaction
+type UndoLog struct {
+	mu    sync.Mutex
+	steps []undoStep
+}
+
+type undoStep struct {
+	description string
+	undo        func(ctx context.Context) error
+}
+
+// UndoFailure is a resource that could not be removed by Rollback
+type UndoFailure struct {
+	Description string `json:"description"`
+	Error       string `json:"error"`
+}
+
+func (u *UndoLog) Add(description string, undo func(ctx context.Context) error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.steps = append(u.steps, undoStep{description: description, undo: undo})
+}
+
+// Rollback runs the recorded actions newest first. It keeps going after a failed step and ignores cancellation
+// of ctx, since it is usually called because ctx was cancelled.
+func (u *UndoLog) Rollback(ctx context.Context) []UndoFailure {
+	u.mu.Lock()
+	steps := u.steps
+	u.steps = nil
+	u.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), undoTimeout)
+	defer cancel()
+
+	var failures []UndoFailure
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].undo(ctx); err != nil {
+			logrus.Errorf("Could not undo %s, %v", steps[i].description, err)
+			failures = append(failures, UndoFailure{Description: steps[i].description, Error: err.Error()})
+		} else {
+			logrus.Infof("Undone %s", steps[i].description)
+		}
+	}
+	return failures
+}
+
+func (f UndoFailure) String() string {
+	return fmt.Sprintf("%s: %s", f.Description, f.Error)
+}
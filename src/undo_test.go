@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/google/uuid"
+	"slices"
+	"testing"
+)
+
+func TestCreateUndoesFailedTenant(t *testing.T) {
+	ctx := context.Background()
+	// one tenant gets a policy created and then fails, its policy, keys and rows are undone, the others are kept
+	e := newTestEnv(t, 3, failNthPost(2))
+	e.conf.Limits.Concurrency = 1
+
+	err := Create(ctx, e.conf, e.gw, e.store)
+	if !errors.Is(err, ErrPartialFailure) {
+		t.Fatalf("got %v, want %v", err, ErrPartialFailure)
+	}
+	manifests := e.manifests(t)
+	if len(manifests) != 1 {
+		t.Fatalf("got %d manifests, want 1", len(manifests))
+	}
+	var failed, created []uuid.UUID
+	for _, mt := range manifests[0].Tenants {
+		if len(mt.Subscriptions) == 0 {
+			failed = append(failed, mt.TenantId)
+		} else {
+			created = append(created, mt.TenantId)
+		}
+	}
+	if len(failed) != 1 {
+		t.Fatalf("got %d failed tenants, want 1", len(failed))
+	}
+	for table, n := range e.rows(t, failed) {
+		if n != 0 {
+			t.Errorf("got %d %s rows of the failed tenant, want 0", n, table)
+		}
+	}
+	if rows := e.rows(t, created); rows["tenant"] != 2 || rows["subscription"] != 6 {
+		t.Errorf("got rows %v of the created tenants, want 2 tenants and 6 subscriptions", rows)
+	}
+	if keys := e.keys(t, aws.TagOperation, aws.OperationPerfTesting); len(keys) != 6 {
+		t.Errorf("got %d gateway keys, want the 6 of the created tenants", len(keys))
+	}
+	if policies := e.policies.Policies(); len(policies) != 4 {
+		t.Errorf("got %d policies, want the 4 of the created tenants", len(policies))
+	}
+}
+
+func TestUndoLogRollsBackNewestFirst(t *testing.T) {
+	var undo UndoLog
+	var order []string
+	for _, name := range []string{"tenant", "gateway key", "subscription", "policy"} {
+		name := name
+		undo.Add(name, func(ctx context.Context) error {
+			order = append(order, name)
+			if name == "subscription" {
+				return fmt.Errorf("still referenced")
+			}
+			return nil
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	failures := undo.Rollback(ctx)
+	if want := []string{"policy", "subscription", "gateway key", "tenant"}; !slices.Equal(order, want) {
+		t.Errorf("got undo order %v, want %v", order, want)
+	}
+	if len(failures) != 1 || failures[0].Description != "subscription" {
+		t.Errorf("got failures %v, want the subscription", failures)
+	}
+	if failures := undo.Rollback(ctx); len(failures) != 0 || len(order) != 4 {
+		t.Errorf("second rollback ran steps again")
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/apikey-gen/aws"
+	"github.com/apikey-gen/crypt"
+	"github.com/apikey-gen/database"
+	"github.com/apikey-gen/fullkey"
+	"github.com/apikey-gen/model"
+	"github.com/google/uuid"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const verifyProbeTimeout = 10 * time.Second
+
+// verifyChecks are the checks of every key, in the order of the table columns
+var verifyChecks = []string{"subscription", "gateway_key", "usage_plan", "policies", "probe"}
+
+// verifyTarget is a key to verify as recorded in a manifest or a report
+type verifyTarget struct {
+	TenantId       uuid.UUID
+	SubscriptionId uuid.UUID
+	KeyId          string
+	KeyType        string
+	//PolicyIds are the expected policies, when policiesExact is false the key may have any of them
+	PolicyIds     []string
+	policiesExact bool
+	//Reported is the report record of the key, nil for a manifest
+	Reported *model.ApiKeyModel
+}
+
+// VerifyCheck is the result of one check of a key, Skipped when it could not or was not asked to run
+type VerifyCheck struct {
+	Name    string `json:"name"`
+	Ok      bool   `json:"ok"`
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+type VerifyResult struct {
+	TenantId       uuid.UUID     `json:"tenant_id"`
+	SubscriptionId uuid.UUID     `json:"subscription_id"`
+	KeyType        string        `json:"key_type"`
+	KeyId          string        `json:"key_id"`
+	Passed         bool          `json:"passed"`
+	Checks         []VerifyCheck `json:"checks"`
+}
+
+// VerifyReport is the JSON output of verify
+type VerifyReport struct {
+	Source  string         `json:"source"`
+	RunId   string         `json:"run_id,omitempty"`
+	Time    time.Time      `json:"time"`
+	Keys    int            `json:"keys"`
+	Failed  int            `json:"failed"`
+	Results []VerifyResult `json:"results"`
+}
+
+// readVerifyTargets reads the keys of a run manifest, or of a report when fileName is not a manifest
+func readVerifyTargets(fileName string, identityFiles []string, passphrase string) ([]verifyTarget, string, error) {
+	if !strings.HasSuffix(fileName, crypt.Ext) {
+		if manifest, err := model.ReadManifest(fileName); err == nil && manifest.RunId != "" {
+			return manifestTargets(manifest), manifest.RunId, nil
+		}
+	}
+	apiKeys, err := ReadReport(fileName, identityFiles, passphrase)
+	if err != nil {
+		return nil, "", err
+	}
+	runId := ""
+	targets := make([]verifyTarget, 0, len(apiKeys))
+	for i, k := range apiKeys {
+		if k.RunId != "" {
+			runId = k.RunId
+		}
+		targets = append(targets, verifyTarget{
+			TenantId:       k.TenantId,
+			SubscriptionId: k.ID,
+			KeyId:          k.KeyId,
+			KeyType:        k.KeyType,
+			PolicyIds:      k.PolicyIds,
+			policiesExact:  k.PolicyIds != nil,
+			Reported:       &apiKeys[i],
+		})
+	}
+	return targets, runId, nil
+}
+
+func manifestTargets(manifest *model.Manifest) []verifyTarget {
+	targets := make([]verifyTarget, 0)
+	for _, t := range manifest.Tenants {
+		for _, s := range t.Subscriptions {
+			target := verifyTarget{TenantId: t.TenantId, SubscriptionId: s.SubscriptionId, KeyId: s.KeyId, KeyType: s.KeyType}
+			switch {
+			case len(s.PolicyIds) > 0:
+				target.PolicyIds, target.policiesExact = s.PolicyIds, true
+			case s.KeyType == "management":
+				target.PolicyIds, target.policiesExact = []string{}, true
+			default:
+				target.PolicyIds = t.PolicyIds
+			}
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// VerifyKeys checks every key of targets against the database and API Gateway and, when probe is set, sends a
+// request with its full key to probe.Url
+func VerifyKeys(ctx context.Context, gw aws.KeyGateway, store database.Store, targets []verifyTarget, probe *ReadinessProbe) ([]VerifyResult, error) {
+	tenantIds := make([]uuid.UUID, 0)
+	subscriptionIds := make([]uuid.UUID, 0, len(targets))
+	for _, t := range targets {
+		if !slices.Contains(tenantIds, t.TenantId) {
+			tenantIds = append(tenantIds, t.TenantId)
+		}
+		subscriptionIds = append(subscriptionIds, t.SubscriptionId)
+	}
+	resources, err := store.GetTenantResources(ctx, tenantIds)
+	if err != nil {
+		return nil, fmt.Errorf("error in getting tenant resources %v", err)
+	}
+	subscriptions := map[uuid.UUID]model.Subscription{}
+	for _, r := range resources {
+		for _, s := range r.Subscriptions {
+			subscriptions[s.ID] = s
+		}
+	}
+	policies, err := store.GetSubscriptionPolicyIds(ctx, subscriptionIds)
+	if err != nil {
+		return nil, fmt.Errorf("error in getting subscription policies %v", err)
+	}
+	usagePlans := map[uuid.UUID]string{}
+
+	results := make([]VerifyResult, 0, len(targets))
+	for _, t := range targets {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		r := VerifyResult{TenantId: t.TenantId, SubscriptionId: t.SubscriptionId, KeyType: t.KeyType, KeyId: t.KeyId}
+		check := func(name string, problems []string) {
+			r.Checks = append(r.Checks, VerifyCheck{Name: name, Ok: len(problems) == 0, Detail: strings.Join(problems, "; ")})
+		}
+		skip := func(name, detail string) {
+			r.Checks = append(r.Checks, VerifyCheck{Name: name, Skipped: true, Detail: detail})
+		}
+
+		subscription, found := subscriptions[t.SubscriptionId]
+		check("subscription", verifySubscription(t, subscription, found))
+		if !found {
+			for _, name := range verifyChecks[1:] {
+				skip(name, "no subscription")
+			}
+			results = append(results, finishVerifyResult(r))
+			continue
+		}
+		if r.KeyId == "" {
+			r.KeyId = subscription.ExternalId
+		}
+
+		key, err := gw.GetKey(ctx, r.KeyId)
+		keyProblems := make([]string, 0)
+		switch {
+		case err != nil:
+			keyProblems = append(keyProblems, err.Error())
+		case !key.Enabled:
+			keyProblems = append(keyProblems, "disabled")
+		case t.Reported != nil && t.Reported.ApiKey != "" && t.Reported.ApiKey != key.Value:
+			keyProblems = append(keyProblems, "value differs from the report api_key")
+		}
+		check("gateway_key", keyProblems)
+
+		usagePlanId, ok := usagePlans[subscription.ProductId]
+		if !ok {
+			usagePlanId, err = productExtId(ctx, store, subscription.ProductId.String())
+			if err != nil {
+				usagePlanId = ""
+			}
+			usagePlans[subscription.ProductId] = usagePlanId
+		}
+		if usagePlanId == "" {
+			check("usage_plan", []string{fmt.Sprintf("no external id for product %s", subscription.ProductId)})
+		} else if bound, err := gw.InUsagePlan(ctx, r.KeyId, usagePlanId); err != nil {
+			check("usage_plan", []string{err.Error()})
+		} else if !bound {
+			check("usage_plan", []string{fmt.Sprintf("not in usage plan %s", usagePlanId)})
+		} else {
+			check("usage_plan", nil)
+		}
+
+		check("policies", verifyPolicies(t, policies[t.SubscriptionId]))
+
+		if probe == nil {
+			skip("probe", "")
+		} else if key.Value == "" {
+			skip("probe", "no gateway key value")
+		} else if fullKey, err := fullkey.Encode(fullkey.Key{Version: subscription.Version, VariableKey: subscription.VariableKey, ApiKey: key.Value}); err != nil {
+			check("probe", []string{err.Error()})
+		} else if status, err := probeKey(ctx, probe, fullKey); err != nil {
+			check("probe", []string{err.Error()})
+		} else if status < 200 || status >= 300 {
+			check("probe", []string{fmt.Sprintf("status %d", status)})
+		} else {
+			check("probe", nil)
+		}
+		results = append(results, finishVerifyResult(r))
+	}
+	return results, nil
+}
+
+// probeKey sends one probe request, without the retries of ReadinessProbe.Wait
+func probeKey(ctx context.Context, probe *ReadinessProbe, fullKey string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, verifyProbeTimeout)
+	defer cancel()
+	return probe.check(ctx, fullKey)
+}
+
+func finishVerifyResult(r VerifyResult) VerifyResult {
+	r.Passed = true
+	for _, c := range r.Checks {
+		if !c.Ok && !c.Skipped {
+			r.Passed = false
+		}
+	}
+	return r
+}
+
+func verifySubscription(t verifyTarget, s model.Subscription, found bool) []string {
+	if !found {
+		return []string{"not found"}
+	}
+	problems := make([]string, 0)
+	if t.KeyId != "" && s.ExternalId != t.KeyId {
+		problems = append(problems, fmt.Sprintf("external_id is %s", s.ExternalId))
+	}
+	if s.Status != "Active" {
+		problems = append(problems, fmt.Sprintf("status is %s", s.Status))
+	}
+	if t.Reported != nil {
+		if t.Reported.VariableKey != "" && s.VariableKey != t.Reported.VariableKey {
+			problems = append(problems, fmt.Sprintf("variable_key is %s", s.VariableKey))
+		}
+		if t.Reported.Version != "" && s.Version != t.Reported.Version {
+			problems = append(problems, fmt.Sprintf("version is %s", s.Version))
+		}
+	}
+	return problems
+}
+
+// verifyPolicies compares the subscription_policy rows of a key with the policies it was created with
+func verifyPolicies(t verifyTarget, actual []uuid.UUID) []string {
+	problems := make([]string, 0)
+	have := map[string]bool{}
+	for _, id := range actual {
+		have[id.String()] = true
+		if !slices.Contains(t.PolicyIds, id.String()) {
+			problems = append(problems, fmt.Sprintf("unexpected policy %s", id))
+		}
+	}
+	if t.policiesExact {
+		for _, id := range t.PolicyIds {
+			if !have[id] {
+				problems = append(problems, fmt.Sprintf("missing policy %s", id))
+			}
+		}
+	}
+	return problems
+}
+
+// printVerifyResults writes the pass/fail table of results
+func printVerifyResults(w io.Writer, title string, results []VerifyResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "VERIFY %s\n", title)
+	fmt.Fprintln(tw, "Tenant id\tSubscription id\tKey type\tKey id\tSubscription\tGateway key\tUsage plan\tPolicies\tProbe\tResult")
+	for _, r := range results {
+		cells := make([]string, 0, len(r.Checks))
+		problems := make([]string, 0)
+		for _, c := range r.Checks {
+			switch {
+			case c.Skipped:
+				cells = append(cells, "-")
+			case c.Ok:
+				cells = append(cells, "ok")
+			default:
+				cells = append(cells, "FAIL")
+				problems = append(problems, fmt.Sprintf("%s: %s", c.Name, c.Detail))
+			}
+		}
+		result := "ok"
+		if !r.Passed {
+			result = "FAIL: " + strings.Join(problems, "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.TenantId, r.SubscriptionId, r.KeyType, r.KeyId, strings.Join(cells, "\t"), result)
+	}
+	return tw.Flush()
+}
+
+func writeVerifyReport(w io.Writer, report VerifyReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,90 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket for one kind of backend call that counts how much it slowed callers down.
+// A nil Limiter lets every call through.
+type Limiter struct {
+	name string
+	l    *rate.Limiter
+
+	mu        sync.Mutex
+	calls     int
+	delayed   int
+	waited    time.Duration
+	throttled int
+}
+
+// Stats are the counters of a Limiter
+type Stats struct {
+	Name string `json:"name"`
+	//Calls is the number of calls let through, Delayed how many of them had to wait for a token
+	Calls   int           `json:"calls"`
+	Delayed int           `json:"delayed"`
+	Waited  time.Duration `json:"waited"`
+	//Throttled counts calls the backend rejected for exceeding its own rate limit
+	Throttled int `json:"throttled"`
+}
+
+// New allows rps calls per second with bursts of burst calls, rps <= 0 means no limit
+func New(name string, rps float64, burst int) *Limiter {
+	limit := rate.Limit(rps)
+	if rps <= 0 {
+		limit = rate.Inf
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{name: name, l: rate.NewLimiter(limit, burst)}
+}
+
+// Wait blocks until the call may be made or ctx is done
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	start := time.Now()
+	if err := l.l.Wait(ctx); err != nil {
+		return err
+	}
+	waited := time.Since(start)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls++
+	// rate.Limiter.Wait returns at once when a token is available
+	if waited > time.Millisecond {
+		l.delayed++
+		l.waited += waited
+	}
+	return nil
+}
+
+// Throttled records that the backend answered a call with its own throttling error
+func (l *Limiter) Throttled() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.throttled++
+}
+
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{Name: l.name, Calls: l.calls, Delayed: l.delayed, Waited: l.waited, Throttled: l.throttled}
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%s: %d calls, %d delayed for %v, %d throttled by the backend", s.Name, s.Calls, s.Delayed, s.Waited.Round(time.Millisecond), s.Throttled)
+}
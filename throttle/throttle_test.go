@@ -0,0 +1,74 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l.Throttled()
+	if got := l.Stats(); got != (Stats{}) {
+		t.Errorf("got %+v, want no stats", got)
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		rps         float64
+		burst       int
+		wantDelayed bool
+	}{
+		{name: "unlimited", rps: 0, burst: 0},
+		{name: "negative rps is unlimited", rps: -1, burst: 1},
+		{name: "within burst", rps: 1, burst: 3},
+		{name: "over burst", rps: 50, burst: 1, wantDelayed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New("gateway-create", tt.rps, tt.burst)
+			for i := 0; i < 3; i++ {
+				if err := l.Wait(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := l.Stats()
+			if got.Name != "gateway-create" || got.Calls != 3 {
+				t.Errorf("got %+v, want 3 calls of gateway-create", got)
+			}
+			if (got.Delayed > 0) != tt.wantDelayed || (got.Waited > 0) != tt.wantDelayed {
+				t.Errorf("got %d delayed for %v, want calls delayed %v", got.Delayed, got.Waited, tt.wantDelayed)
+			}
+		})
+	}
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := New("policy-create", 0.001, 1)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err == nil {
+		t.Fatal("waited past the deadline for a token")
+	}
+	if got := l.Stats().Calls; got != 1 {
+		t.Errorf("got %d calls, want the cancelled one left out", got)
+	}
+}
+
+func TestStatsString(t *testing.T) {
+	l := New("usage-plan-attach", 0, 1)
+	l.Throttled()
+	l.Throttled()
+	want := "usage-plan-attach: 0 calls, 0 delayed for 0s, 2 throttled by the backend"
+	if got := l.Stats().String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}